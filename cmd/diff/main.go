@@ -0,0 +1,86 @@
+// Command diff compares two fingerprints, as returned by /api/all, field by field.
+// The reference can also be the name of a known client.
+//
+//	go run ./cmd/diff current.json reference.json
+//	go run ./cmd/diff current.json "Chrome"
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/clients"
+	"github.com/pagpeter/trackme/pkg/diff"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func readResponse(file string) (types.Response, error) {
+	var res types.Response
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return res, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return res, nil
+}
+
+func main() {
+	clientsFile := flag.String("clients", "static/known_clients.json", "known clients file")
+	asJSON := flag.Bool("json", false, "print the diff as JSON")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: diff [flags] <current.json> <reference.json | known client>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	res, err := readResponse(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	current := diff.FromResponse(res)
+
+	var reference diff.Fields
+	against := flag.Arg(1)
+	if _, statErr := os.Stat(against); statErr == nil {
+		ref, err := readResponse(against)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reference = diff.FromResponse(ref)
+	} else {
+		kc, err := clients.Load(*clientsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, ok := kc.Find(against)
+		if !ok {
+			log.Fatalf("%s is neither a file nor a known client", against)
+		}
+		reference = diff.FromKnownClient(c, current)
+		against = strings.TrimSpace(c.Name + " " + c.Version)
+	}
+
+	d := diff.Compare(current, reference, against)
+	if *asJSON {
+		data, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(diff.Format(d))
+	}
+	if !d.Identical {
+		os.Exit(1)
+	}
+}
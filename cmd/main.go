@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pagpeter/quic-go"
-	"github.com/pagpeter/quic-go/http3"
+	"github.com/pagpeter/trackme/pkg/certs"
+	"github.com/pagpeter/trackme/pkg/clients"
+	"github.com/pagpeter/trackme/pkg/db"
+	"github.com/pagpeter/trackme/pkg/logfile"
+	"github.com/pagpeter/trackme/pkg/metrics"
+	"github.com/pagpeter/trackme/pkg/proxyproto"
 	"github.com/pagpeter/trackme/pkg/server"
 	"github.com/pagpeter/trackme/pkg/tcp"
 	"github.com/pagpeter/trackme/pkg/utils"
@@ -26,6 +35,7 @@ var srv *server.Server
 var local = false
 
 func logCrash(r interface{}) {
+	metrics.Panics.Inc()
 	crashInfo := fmt.Sprintf("PANIC: %v\n", r)
 	crashInfo += fmt.Sprintf("Time: %v\n", time.Now().Format(time.RFC3339))
 
@@ -47,8 +57,38 @@ func logCrash(r interface{}) {
 		log.Printf("Error writing to crashes.txt: %v", err)
 	}
 
-	log.Printf("PANIC: %v", r)
-	log.Println("Crash details written to crashes.txt")
+	slog.Error("recovered from a panic, details written to crashes.txt", "panic", fmt.Sprint(r))
+}
+
+// certificateHosts are the names and addresses a generated certificate is valid for
+func certificateHosts(host string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host != "" && host != "0.0.0.0" && host != "::" && !slices.Contains(hosts, host) {
+		hosts = append([]string{host}, hosts...)
+	}
+	return hosts
+}
+
+// listen starts a TCP listener on addr. With proxy_protocol, connections from trusted_proxies start
+// with a PROXY protocol header and report the client's address.
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.GetConfig().ProxyProtocol {
+		return listener, nil
+	}
+	trusted, err := utils.ParsePrefixes(srv.GetConfig().TrustedProxies)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	if len(trusted) == 0 {
+		listener.Close()
+		return nil, fmt.Errorf("proxy_protocol needs trusted_proxies")
+	}
+	return proxyproto.NewListener(listener, trusted), nil
 }
 
 func init() {
@@ -70,53 +110,122 @@ func StartRedirectServer(host, port string) {
 	local = host == "" && port != "443"
 	srv.SetLocal(local)
 
+	if srv.GetConfig().EnableH2C || srv.GetConfig().ServePlainH1 {
+		StartPlainServer(host, port)
+		return
+	}
+
 	log.Println("Starting Redirect Server:", srv.GetConfig().HTTPRedirect)
 	log.Println("Listening on", host+":"+port)
 
+	listener, err := listen(host + ":" + port)
+	if err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
 	http.HandleFunc("/", redirect)
-	if err := http.ListenAndServe(host+":"+port, nil); err != nil {
+	if err := http.Serve(listener, nil); err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
 }
 
-// Timeout function
-func timeoutHandleTLSConnection(conn net.Conn) error {
-	result := make(chan error)
-	go func() {
-		result <- srv.HandleTLSConnection(conn)
-	}()
-	select {
-	case <-time.After(15 * time.Second):
-		return fmt.Errorf("connection timed out")
-	case err := <-result:
-		return err
+// StartPlainServer replaces the redirect server when h2c or plain HTTP/1 fingerprinting is enabled.
+// Requests that are neither still get redirected.
+func StartPlainServer(host, port string) {
+	log.Println("Starting plain HTTP server (h2c:", srv.GetConfig().EnableH2C, "http/1:", srv.GetConfig().ServePlainH1, ")")
+	log.Println("Listening on", host+":"+port)
+
+	listener, err := listen(host + ":" + port)
+	if err != nil {
+		log.Fatal("Error starting plain tcp listener", err)
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting plain connection", err)
+			continue
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logCrash(r)
+					log.Printf("Recovered from panic in plain connection handler for %s", conn.RemoteAddr())
+					if err := conn.Close(); err != nil {
+						log.Println("Error closing connection after panic:", err)
+					}
+				}
+			}()
+
+			if srv.IsBlocked(conn.RemoteAddr()) {
+				slog.Warn("blocked", "ip", conn.RemoteAddr().String(), "protocol", "plain")
+				rejectBlocked(conn, nil)
+				return
+			}
+			if err := srv.HandlePlainConnection(conn); err != nil {
+				slog.Info("request failed", "ip", conn.RemoteAddr().String(), "protocol", "plain", "error", err)
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing failed connection:", err)
+				}
+			}
+		}()
 	}
 }
 
-func StartHTTP3Server(host string, port int) {
-	// Use the server's HTTP/3 handler
-	handler := srv.HandleHTTP3()
+// StartMetricsServer serves the Prometheus metrics at /metrics
+func StartMetricsServer(addr string) {
+	metrics.NewGaugeFunc("trackme_tcp_fingerprints", "TCP fingerprints held by the sniffer.", func() float64 {
+		n := 0
+		srv.GetTCPFingerprints().Range(func(_, _ any) bool {
+			n++
+			return true
+		})
+		return float64(n)
+	})
 
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Println("Serving metrics on", addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Metrics server error:", err)
+	}
+}
+
+func StartHTTP3Server(host string, port int) {
 	// Configure TLS for HTTP/3
-	h3TLSConfig := http3.ConfigureTLSConfig(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3"},
-	})
+	h3TLSConfig := &tls.Config{
+		Certificates:   []tls.Certificate{cert},
+		GetCertificate: srv.GetHTTP3Certificate,
+		NextProtos:     []string{"h3"},
+	}
 
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	h3Server := &http3.Server{
-		Handler:   handler,
-		Addr:      addr,
-		TLSConfig: h3TLSConfig,
-		QUICConfig: &quic.Config{
-			Allow0RTT: true,
-		},
+	listener, err := quic.ListenAddrEarly(addr, h3TLSConfig, &quic.Config{
+		Allow0RTT: true,
+		Tracer:    srv.QUICTracer(),
+	})
+	if err != nil {
+		log.Printf("HTTP/3 server error: %v", err)
+		return
 	}
 
 	log.Println("Starting HTTP/3 server on", addr)
-	if err := h3Server.ListenAndServe(); err != nil {
-		log.Printf("HTTP/3 server error: %v", err)
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Printf("HTTP/3 server error: %v", err)
+			return
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logCrash(r)
+					log.Printf("Recovered from panic in HTTP/3 handler for %s", conn.RemoteAddr())
+				}
+			}()
+			srv.HandleHTTP3Connection(conn)
+		}()
 	}
 }
 
@@ -128,15 +237,61 @@ func main() {
 		}
 	}()
 
+	// log.Print goes through the same handler, at the info level
+	logger, err := server.NewLogger(os.Stdout, srv.GetConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
 	log.Println("Starting server...")
 	log.Println("Listening on " + srv.GetConfig().Host + ":" + srv.GetConfig().TLSPort)
 
-	// Load the TLS certificates
-	var err error
+	// Generate a certificate signed by a local CA if there is none, then load it
+	caFile, caKeyFile := srv.GetConfig().GetCAFiles()
+	generated, err := certs.Ensure(srv.GetConfig().CertFile, srv.GetConfig().KeyFile, caFile, caKeyFile, certificateHosts(srv.GetConfig().Host))
+	if err != nil {
+		log.Fatal("Error generating TLS certificates: ", err)
+	}
+	if generated {
+		log.Println("Generated", srv.GetConfig().CertFile, "signed by the local CA", caFile, "(served at /ca.pem)")
+	}
 	cert, err = tls.LoadX509KeyPair(srv.GetConfig().CertFile, srv.GetConfig().KeyFile)
 	if err != nil {
 		log.Fatal("Error loading TLS certificates", err)
 	}
+	if err := srv.LoadVirtualHosts(cert); err != nil {
+		log.Fatal("Error loading virtual hosts: ", err)
+	}
+	if err := srv.LoadAccessLists(); err != nil {
+		log.Fatal("Error loading access lists: ", err)
+	}
+
+	if file := srv.GetConfig().DatabaseFile; file != "" {
+		d, err := db.Open(file, srv.GetConfig().DatabaseRetention)
+		if err != nil {
+			log.Fatal("Error opening database ", err)
+		}
+		defer d.Close()
+		srv.SetDB(d)
+		log.Println("Saving requests to", file)
+	}
+
+	if file := srv.GetConfig().LogFile; file != "" {
+		w, err := logfile.Open(file, srv.GetConfig().LogRotation)
+		if err != nil {
+			log.Fatal("Error opening log file ", err)
+		}
+		defer w.Close()
+		srv.SetRequestLog(w)
+		log.Println("Logging requests to", file)
+	}
+
+	if c, err := clients.Load(srv.GetConfig().GetKnownClientsFile()); err != nil {
+		log.Println("Client identification disabled:", err)
+	} else {
+		srv.SetKnownClients(c)
+	}
 
 	// Convert standard TLS cert to utls cert
 	utlsCert = utls.Certificate{
@@ -153,11 +308,31 @@ func main() {
 		},
 		Certificates: []utls.Certificate{utlsCert},
 	}
+	config.GetConfigForClient = srv.GetConfigForClient(&config)
 
-	listener, err := utls.Listen("tcp", srv.GetConfig().Host+":"+srv.GetConfig().TLSPort, &config)
+	tcpListener, err := listen(srv.GetConfig().Host + ":" + srv.GetConfig().TLSPort)
 	if err != nil {
 		log.Fatal("Error starting tcp listener", err)
 	}
+	listener := utls.NewListener(tcpListener, &config)
+	if srv.GetConfig().ProxyProtocol {
+		log.Println("Reading PROXY protocol headers from", strings.Join(srv.GetConfig().TrustedProxies, ", "))
+	}
+
+	// The mTLS port asks for a client certificate and accepts any, they are only reported
+	if port := srv.GetConfig().MTLSPort; port != "" {
+		mtlsConfig := config.Clone()
+		mtlsConfig.ClientAuth = utls.RequestClientCert
+		mtlsConfig.GetConfigForClient = srv.GetConfigForClient(mtlsConfig)
+		mtlsTCPListener, err := listen(srv.GetConfig().Host + ":" + port)
+		if err != nil {
+			log.Fatal("Error starting mTLS listener", err)
+		}
+		mtlsListener := utls.NewListener(mtlsTCPListener, mtlsConfig)
+		defer mtlsListener.Close()
+		log.Println("Requesting client certificates on " + srv.GetConfig().Host + ":" + port)
+		go ServeTLS(mtlsListener, mtlsConfig)
+	}
 
 	tlsPort, err := strconv.Atoi(srv.GetConfig().TLSPort)
 	if err != nil {
@@ -166,6 +341,9 @@ func main() {
 
 	defer listener.Close()
 	go StartRedirectServer(srv.GetConfig().Host, srv.GetConfig().HTTPPort)
+	if addr := srv.GetConfig().MetricsAddress; addr != "" {
+		go StartMetricsServer(addr)
+	}
 	if srv.GetConfig().EnableQUIC {
 		go StartHTTP3Server(srv.GetConfig().Host, tlsPort)
 	}
@@ -191,6 +369,54 @@ func main() {
 		go tcp.SniffTCP(device, tlsPort, srv)
 	}
 
+	ServeTLS(listener, &config)
+}
+
+// rejectBlocked answers a client on the blocklist as configured by blocked_response and closes the
+// connection. config is the TLS config of the listener, nil for plain connections.
+func rejectBlocked(conn net.Conn, config *utls.Config) {
+	message := srv.GetConfig().GetBlockedMessage()
+	switch srv.GetConfig().BlockedResponse {
+	case "close":
+	case "http":
+		// Blocked TLS clients are only offered HTTP/1.1, so the 403 doesn't need HTTP/2
+		if tlsConn, ok := conn.(*utls.Conn); ok && config != nil {
+			blockedConfig := config.Clone()
+			blockedConfig.NextProtos = []string{"http/1.1"}
+			blockedConfig.GetConfigForClient = nil
+			conn = utls.Server(tlsConn.NetConn(), blockedConfig)
+		}
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			log.Println("Error setting deadline on blocked connection:", err)
+		}
+		// Read the request head first, closing with unread data would reset the connection before the response is read
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" || line == "\n" {
+				break
+			}
+		}
+		if _, err := fmt.Fprintf(conn, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(message), message); err != nil {
+			log.Println("Error writing to blocked connection:", err)
+		}
+	default:
+		// Written on the TCP connection, before the TLS handshake
+		raw := conn
+		if tlsConn, ok := conn.(*utls.Conn); ok {
+			raw = tlsConn.NetConn()
+		}
+		if _, err := raw.Write([]byte(message)); err != nil {
+			log.Println("Error writing to blocked connection:", err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		log.Println("Error closing blocked connection:", err)
+	}
+}
+
+// ServeTLS accepts TLS connections and handles each in its own goroutine. config is the TLS config of listener.
+func ServeTLS(listener net.Listener, config *utls.Config) {
 	for {
 		func() {
 			defer func() {
@@ -205,38 +431,36 @@ func main() {
 				log.Println("Error accepting connection", err)
 				return
 			}
-			var ip string
-			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-				ip = addr.IP.String()
-			}
-			if utils.IsIPBlocked(ip) {
-				server.Log("Request from IP " + ip + " blocked")
-				if _, err := conn.Write([]byte("Don't waste proxies")); err != nil {
-					log.Println("Error writing to blocked connection:", err)
-				}
-				if err := conn.Close(); err != nil {
-					log.Println("Error closing blocked connection:", err)
-				}
-			} else {
-				go func() {
-					defer func() {
-						if r := recover(); r != nil {
-							logCrash(r)
-							log.Printf("Recovered from panic in connection handler for IP %s", ip)
-							if err := conn.Close(); err != nil {
-								log.Println("Error closing connection after panic:", err)
-							}
-						}
-					}()
-
-					if err := timeoutHandleTLSConnection(conn); err != nil {
-						server.Log(fmt.Sprintf("Request failed for %s: %v", ip, err))
+			// The address is read in the connection's goroutine, behind a proxy it waits for the PROXY header
+			go func() {
+				var ip string
+				defer func() {
+					if r := recover(); r != nil {
+						logCrash(r)
+						log.Printf("Recovered from panic in connection handler for IP %s", ip)
 						if err := conn.Close(); err != nil {
-							log.Println("Error closing failed connection:", err)
+							log.Println("Error closing connection after panic:", err)
 						}
 					}
 				}()
-			}
+
+				if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+					ip = addr.IP.String()
+				}
+				if srv.IsBlocked(conn.RemoteAddr()) {
+					slog.Warn("blocked", "ip", conn.RemoteAddr().String(), "protocol", "tls")
+					rejectBlocked(conn, config)
+					return
+				}
+
+				// The handlers set deadlines for the handshake, every request and the idle time between them
+				if err := srv.HandleTLSConnection(conn); err != nil {
+					slog.Info("request failed", "ip", conn.RemoteAddr().String(), "protocol", "tls", "error", err)
+					if err := conn.Close(); err != nil {
+						log.Println("Error closing failed connection:", err)
+					}
+				}
+			}()
 		}()
 	}
 }
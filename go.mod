@@ -5,7 +5,9 @@ go 1.24
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/pagpeter/quic-go v0.0.0-20260120153640-0de4e3b8377b
+	github.com/quic-go/qpack v0.5.1
 	github.com/wwhtrbbtt/utls v0.0.0-20220918194152-45ee2a20799c
+	go.etcd.io/bbolt v1.4.0
 	golang.org/x/net v0.43.0
 )
 
@@ -14,7 +16,6 @@ require (
 require (
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
-	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/refraction-networking/utls v1.1.2 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/mod v0.27.0 // indirect
@@ -0,0 +1,197 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+	// leafValidity stays below the 398 days browsers accept for server certificates
+	leafValidity = 397 * 24 * time.Hour
+)
+
+// exists reports whether file may exist, files that can't be checked are never overwritten
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// missingPair returns an error if only one file of a certificate and key pair exists, generating the
+// other one would overwrite a file that belongs to an existing pair
+func missingPair(certFile, keyFile string) error {
+	switch {
+	case exists(certFile) && !exists(keyFile):
+		return fmt.Errorf("%s exists but %s doesn't", certFile, keyFile)
+	case !exists(certFile) && exists(keyFile):
+		return fmt.Errorf("%s exists but %s doesn't", keyFile, certFile)
+	}
+	return nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(file, blockType string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), perm)
+}
+
+func writeKey(file string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(file, "PRIVATE KEY", der, 0600)
+}
+
+// loadCA reads the CA certificate and its key
+func loadCA(caFile, caKeyFile string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported CA key type")
+	}
+	return cert, signer, nil
+}
+
+// createCA generates a new CA and writes it to caFile and caKeyFile
+func createCA(caFile, caKeyFile string) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"TrackMe"}, CommonName: "TrackMe local CA " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(caKeyFile, key); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(caFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Ensure creates a certificate for hosts (names or IP addresses) in certFile and keyFile if both are
+// missing, only one of them is an error. It is signed by the CA in caFile and caKeyFile, which is created
+// first if both of its files are missing. certFile contains the certificate followed by the CA. It reports
+// whether a certificate was created.
+func Ensure(certFile, keyFile, caFile, caKeyFile string, hosts []string) (bool, error) {
+	if err := missingPair(certFile, keyFile); err != nil {
+		return false, err
+	}
+	if exists(certFile) {
+		return false, nil
+	}
+	if err := missingPair(caFile, caKeyFile); err != nil {
+		return false, fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	var err error
+	if exists(caFile) {
+		if ca, caKey, err = loadCA(caFile, caKeyFile); err != nil {
+			return false, fmt.Errorf("failed to load CA: %w", err)
+		}
+	} else if ca, caKey, err = createCA(caFile, caKeyFile); err != nil {
+		return false, fmt.Errorf("failed to create CA: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return false, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"TrackMe"}, CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	if err := writeKey(keyFile, key); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", keyFile, err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(certFile, chain, 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", certFile, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,238 @@
+package clients
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// reloadInterval is how often the file is checked for changes
+const reloadInterval = time.Minute
+
+// weights of the fingerprints, JA3 is weak because browsers randomize the extension order
+var weights = map[string]float64{
+	"ja4":       3,
+	"peetprint": 3,
+	"akamai":    3,
+	"quic":      2,
+	"ja3":       1,
+}
+
+var kinds = []string{"ja4", "peetprint", "akamai", "quic", "ja3"}
+
+// KnownClient lists the fingerprints of a client. JA3, PeetPrint, Akamai and QUIC
+// fingerprints can be given in full or as their hash.
+type KnownClient struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version,omitempty"`
+	OS        string   `json:"os,omitempty"`
+	JA3       []string `json:"ja3,omitempty"`
+	JA4       []string `json:"ja4,omitempty"`
+	PeetPrint []string `json:"peetprint,omitempty"`
+	Akamai    []string `json:"akamai,omitempty"`
+	QUIC      []string `json:"quic,omitempty"`
+}
+
+type knownClientsFile struct {
+	Clients []KnownClient `json:"clients"`
+}
+
+// client is a KnownClient with its fingerprints as sets of hashes
+type client struct {
+	KnownClient
+	fingerprints map[string]map[string]bool
+}
+
+// Database holds the known clients, it is reloaded when the file changes
+type Database struct {
+	path string
+
+	mu        sync.RWMutex
+	clients   []client
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// hashFingerprint returns the MD5 hash of a full fingerprint, hashes are returned as they are
+func hashFingerprint(fp string) string {
+	if _, err := hex.DecodeString(fp); err == nil && len(fp) == 32 {
+		return fp
+	}
+	return utils.GetMD5Hash(fp)
+}
+
+func newClient(c KnownClient) client {
+	set := func(values []string, hash bool) map[string]bool {
+		m := map[string]bool{}
+		for _, v := range values {
+			if hash {
+				v = hashFingerprint(v)
+			}
+			m[v] = true
+		}
+		return m
+	}
+	return client{
+		KnownClient: c,
+		fingerprints: map[string]map[string]bool{
+			"ja3":       set(c.JA3, true),
+			"ja4":       set(c.JA4, false),
+			"peetprint": set(c.PeetPrint, true),
+			"akamai":    set(c.Akamai, true),
+			"quic":      set(c.QUIC, true),
+		},
+	}
+}
+
+// Load reads the known clients from a JSON file
+func Load(path string) (*Database, error) {
+	d := &Database{path: path}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Database) load() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to read known clients: %w", err)
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to read known clients: %w", err)
+	}
+	var f knownClientsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", d.path, err)
+	}
+
+	clients := make([]client, 0, len(f.Clients))
+	for _, c := range f.Clients {
+		clients = append(clients, newClient(c))
+	}
+
+	d.mu.Lock()
+	d.clients = clients
+	d.modTime = info.ModTime()
+	d.lastCheck = time.Now()
+	d.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the file if it was modified, at most once per reloadInterval
+func (d *Database) reloadIfChanged() {
+	d.mu.Lock()
+	if time.Since(d.lastCheck) < reloadInterval {
+		d.mu.Unlock()
+		return
+	}
+	d.lastCheck = time.Now()
+	modTime := d.modTime
+	d.mu.Unlock()
+
+	info, err := os.Stat(d.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := d.load(); err != nil {
+		log.Println("Error reloading known clients:", err)
+		return
+	}
+	log.Println("Reloaded known clients from", d.path)
+}
+
+// getFingerprints returns the fingerprints of the request in the form they are stored in
+func getFingerprints(res types.Response) map[string]string {
+	fps := map[string]string{}
+	if res.TLS != nil {
+		fps["ja3"] = res.TLS.JA3Hash
+		fps["ja4"] = res.TLS.JA4
+		fps["peetprint"] = res.TLS.PeetPrintHash
+	}
+	if res.Http2 != nil {
+		fps["akamai"] = res.Http2.AkamaiFingerprintHash
+	} else if res.Http3 != nil {
+		fps["akamai"] = res.Http3.AkamaiFingerprintHash
+		if res.Http3.QUIC != nil {
+			fps["quic"] = res.Http3.QUIC.FingerprintHash
+		}
+	}
+	for k, v := range fps {
+		if v == "" {
+			delete(fps, k)
+		}
+	}
+	return fps
+}
+
+// Identify returns the known client that matches the request best, nil if none matches.
+// Clients are ranked by the weight of the matching fingerprints, then by the fewest mismatches. The
+// confidence is the share of that weight among all fingerprints of the request, so a client that only
+// lists a few of them can't be fully trusted.
+func (d *Database) Identify(res types.Response) *types.IdentifiedClient {
+	d.reloadIfChanged()
+	fps := getFingerprints(res)
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var best *types.IdentifiedClient
+	var bestWeight float64
+	for _, c := range d.clients {
+		var matched, compared float64
+		id := &types.IdentifiedClient{
+			Name:    c.Name,
+			Version: c.Version,
+			OS:      c.OS,
+			Matched: []string{},
+		}
+		for _, kind := range kinds {
+			fp, ok := fps[kind]
+			if !ok {
+				continue
+			}
+			compared += weights[kind]
+			if len(c.fingerprints[kind]) == 0 {
+				id.Unknown = append(id.Unknown, kind)
+			} else if c.fingerprints[kind][fp] {
+				matched += weights[kind]
+				id.Matched = append(id.Matched, kind)
+			} else {
+				id.Mismatched = append(id.Mismatched, kind)
+			}
+		}
+		if matched == 0 {
+			continue
+		}
+		id.Confidence = math.Round(matched/compared*100) / 100
+		if best == nil || matched > bestWeight || (matched == bestWeight && len(id.Mismatched) < len(best.Mismatched)) {
+			best = id
+			bestWeight = matched
+		}
+	}
+	return best
+}
+
+// Find returns the first known client called name, which may include the version (e.g. "Safari 17+")
+func (d *Database) Find(name string) (KnownClient, bool) {
+	d.reloadIfChanged()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, c := range d.clients {
+		if strings.EqualFold(name, c.Name) || strings.EqualFold(name, c.Name+" "+c.Version) {
+			return c.KnownClient, true
+		}
+	}
+	return KnownClient{}, false
+}
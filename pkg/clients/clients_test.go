@@ -0,0 +1,42 @@
+package clients
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+func TestIdentifyConfidence(t *testing.T) {
+	d := &Database{lastCheck: time.Now(), clients: []client{
+		newClient(KnownClient{Name: "akamai only", Akamai: []string{"akamai-fp"}}),
+		newClient(KnownClient{Name: "full", JA4: []string{"ja4-fp"}, Akamai: []string{"akamai-fp"}, JA3: []string{"other"}}),
+	}}
+	res := types.Response{
+		TLS:   &types.TLSDetails{JA4: "ja4-fp", JA3Hash: utils.GetMD5Hash("ja3-fp")},
+		Http2: &types.Http2Details{AkamaiFingerprintHash: utils.GetMD5Hash("akamai-fp")},
+	}
+
+	id := d.Identify(res)
+	if id == nil || id.Name != "full" {
+		t.Fatalf("Identify() = %+v, want full", id)
+	}
+	// ja4 and akamai out of ja4, akamai and ja3
+	if id.Confidence != 0.86 {
+		t.Errorf("confidence = %v, want 0.86", id.Confidence)
+	}
+	if !slices.Equal(id.Mismatched, []string{"ja3"}) {
+		t.Errorf("mismatched = %v, want [ja3]", id.Mismatched)
+	}
+
+	d.clients = d.clients[:1]
+	id = d.Identify(res)
+	if id == nil || id.Confidence != 0.43 {
+		t.Fatalf("Identify() = %+v, want confidence 0.43", id)
+	}
+	if !slices.Equal(id.Unknown, []string{"ja4", "ja3"}) {
+		t.Errorf("unknown = %v, want [ja4 ja3]", id.Unknown)
+	}
+}
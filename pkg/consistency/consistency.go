@@ -0,0 +1,357 @@
+package consistency
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// profile is what the clients of a family send. The TLS and Client Hints checks only apply to browsers.
+type profile struct {
+	browser         bool
+	grease          bool
+	alps            bool
+	recordSizeLimit bool
+	clientHints     bool
+	certCompression []string
+	pseudoOrders    []string
+	windowUpdates   []string
+}
+
+var profiles = map[string]profile{
+	"chromium": {
+		browser:         true,
+		grease:          true,
+		alps:            true,
+		clientHints:     true,
+		certCompression: []string{"2"},
+		pseudoOrders:    []string{"m,a,s,p"},
+		windowUpdates:   []string{"15663105"},
+	},
+	"firefox": {
+		browser:         true,
+		recordSizeLimit: true,
+		pseudoOrders:    []string{"m,p,a,s"},
+		windowUpdates:   []string{"12517377"},
+	},
+	"safari": {
+		browser:         true,
+		grease:          true,
+		certCompression: []string{"1"},
+		pseudoOrders:    []string{"m,s,p,a", "m,s,a,p"},
+		windowUpdates:   []string{"10485760", "10420225"},
+	},
+	"curl":   {pseudoOrders: []string{"m,p,s,a"}},
+	"go":     {pseudoOrders: []string{"a,m,p,s"}},
+	"okhttp": {pseudoOrders: []string{"m,p,a,s"}},
+}
+
+// pseudoHeaderOrders are the clients known to send a pseudo-header order
+var pseudoHeaderOrders = map[string]string{
+	"m,a,s,p": "Chrome",
+	"m,p,a,s": "Firefox and okhttp",
+	"m,s,p,a": "Safari",
+	"m,s,a,p": "Safari",
+	"a,m,p,s": "Go net/http",
+	"m,p,s,a": "curl",
+}
+
+// clients are matched against the User-Agent in order, the first match wins
+var clients = []struct {
+	token  string
+	name   string
+	family string
+}{
+	{"Edg/", "Edge", "chromium"},
+	{"OPR/", "Opera", "chromium"},
+	{"SamsungBrowser/", "Samsung Internet", "chromium"},
+	// Browsers on iOS have to use WebKit
+	{"CriOS/", "Chrome", "safari"},
+	{"FxiOS/", "Firefox", "safari"},
+	{"Firefox/", "Firefox", "firefox"},
+	{"Chrome/", "Chrome", "chromium"},
+	{"Version/", "Safari", "safari"},
+	{"curl/", "curl", "curl"},
+	{"Go-http-client/", "Go net/http", "go"},
+	{"python-requests/", "Python requests", "python"},
+	{"Python-urllib/", "Python urllib", "python"},
+	{"okhttp/", "okhttp", "okhttp"},
+}
+
+var operatingSystems = []struct {
+	token string
+	name  string
+}{
+	{"Windows NT", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"CrOS", "ChromeOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// clientHintsPlatforms maps sec-ch-ua-platform to the OS names used above
+var clientHintsPlatforms = map[string]string{
+	"Windows":   "Windows",
+	"Android":   "Android",
+	"iOS":       "iOS",
+	"Chrome OS": "ChromeOS",
+	"macOS":     "macOS",
+	"Linux":     "Linux",
+}
+
+// knownClientFamilies maps the names in the known clients file to families
+var knownClientFamilies = map[string]string{
+	"Chrome":      "chromium",
+	"Firefox":     "firefox",
+	"Safari":      "safari",
+	"curl":        "curl",
+	"Go net/http": "go",
+	"Python":      "python",
+	"okhttp":      "okhttp",
+}
+
+var brandVersionRegex = regexp.MustCompile(`"([^"]+)";v="(\d+)`)
+
+// majorVersion returns the number following token in the User-Agent
+func majorVersion(ua, token string) int {
+	i := strings.Index(ua, token)
+	if i < 0 {
+		return 0
+	}
+	v := ua[i+len(token):]
+	end := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		v = v[:end]
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+// ParseUserAgent returns the browser or library and the OS a User-Agent claims
+func ParseUserAgent(ua string) types.ClaimedClient {
+	var c types.ClaimedClient
+	for _, b := range clients {
+		if !strings.Contains(ua, b.token) || (b.token == "Version/" && !strings.Contains(ua, "Safari/")) {
+			continue
+		}
+		c.Browser = b.name
+		c.Family = b.family
+		c.Version = majorVersion(ua, b.token)
+		break
+	}
+	for _, o := range operatingSystems {
+		if strings.Contains(ua, o.token) {
+			c.OS = o.name
+			break
+		}
+	}
+	c.Mobile = strings.Contains(ua, "Mobile")
+	return c
+}
+
+type checker struct {
+	d       *types.ConsistencyDetails
+	claimed string
+}
+
+// check records a comparison, the message is only formatted for failed ones
+func (c *checker) check(layer, name string, passed bool, format string, args ...any) {
+	check := types.ConsistencyCheck{Layer: layer, Name: name, Passed: passed}
+	if !passed {
+		check.Message = fmt.Sprintf("UA claims %s but ", c.claimed) + fmt.Sprintf(format, args...)
+		c.d.Mismatches = append(c.d.Mismatches, check.Message)
+	}
+	c.d.Checks = append(c.d.Checks, check)
+}
+
+// Check compares the client and OS claimed by the User-Agent and Client Hints with the
+// TLS, HTTP/2, HTTP/3 and TCP fingerprints of the request
+func Check(res types.Response) *types.ConsistencyDetails {
+	d := &types.ConsistencyDetails{
+		Claimed:    ParseUserAgent(res.UserAgent),
+		Mismatches: []string{},
+		Checks:     []types.ConsistencyCheck{},
+	}
+	c := &checker{d: d, claimed: d.Claimed.Browser}
+	p, ok := profiles[d.Claimed.Family]
+
+	if ok && p.browser {
+		checkClientHints(c, res, p)
+		checkTLS(c, res, p)
+		if res.Http1 != nil && len(res.Http1.Anomalies) > 0 {
+			c.check("http1", "anomalies", false, "the request has %s", strings.Join(res.Http1.Anomalies, ", "))
+		}
+	}
+	if ok {
+		checkHTTP2(c, res, p)
+		if res.Http3 != nil {
+			checkPseudoHeaderOrder(c, "http3", trackmehttp.GetHTTP3HeaderOrder(res.Http3.Headers), p)
+		}
+	}
+	if d.Claimed.OS != "" {
+		c.claimed = d.Claimed.OS
+		checkTCP(c, res)
+		c.claimed = d.Claimed.Browser
+	}
+	if res.IdentifiedAs != nil && d.Claimed.Family != "" {
+		for prefix, family := range knownClientFamilies {
+			if !strings.HasPrefix(res.IdentifiedAs.Name, prefix) {
+				continue
+			}
+			name := strings.TrimSpace(res.IdentifiedAs.Name + " " + res.IdentifiedAs.Version)
+			c.check("fingerprint", "known_client", family == d.Claimed.Family,
+				"the fingerprints match %s (%s)", name, strings.Join(res.IdentifiedAs.Matched, ", "))
+			break
+		}
+	}
+
+	d.Consistent = len(d.Mismatches) == 0
+	return d
+}
+
+func checkClientHints(c *checker, res types.Response, p profile) {
+	// Client Hints are only sent in secure contexts
+	if res.TLS == nil {
+		return
+	}
+	headers := res.GetHeaders()
+	hints, hasHints := headers["sec-ch-ua"]
+	if !p.clientHints {
+		c.check("client_hints", "sec_ch_ua", !hasHints, "the request has sec-ch-ua, which only Chromium browsers send")
+		return
+	}
+	c.check("client_hints", "sec_ch_ua", hasHints, "sec-ch-ua is missing")
+	if !hasHints {
+		return
+	}
+
+	if chrome := majorVersion(res.UserAgent, "Chrome/"); chrome > 0 {
+		for _, m := range brandVersionRegex.FindAllStringSubmatch(hints, -1) {
+			if m[1] == "Chromium" {
+				v, _ := strconv.Atoi(m[2])
+				c.check("client_hints", "sec_ch_ua_version", v == chrome, "sec-ch-ua has Chromium %d and the UA Chrome/%d", v, chrome)
+			}
+		}
+	}
+	if platform, ok := headers["sec-ch-ua-platform"]; ok && c.d.Claimed.OS != "" {
+		hinted := clientHintsPlatforms[strings.Trim(platform, `"`)]
+		c.check("client_hints", "sec_ch_ua_platform", hinted == c.d.Claimed.OS, "sec-ch-ua-platform is %s", platform)
+	}
+	if mobile, ok := headers["sec-ch-ua-mobile"]; ok {
+		c.check("client_hints", "sec_ch_ua_mobile", (mobile == "?1") == c.d.Claimed.Mobile, "sec-ch-ua-mobile is %s", mobile)
+	}
+}
+
+func checkTLS(c *checker, res types.Response, p profile) {
+	if res.TLS == nil {
+		return
+	}
+	// tls versions|protocols|groups|signature algorithms|psk mode|certificate compression|ciphers|extensions
+	peetprint := strings.Split(res.TLS.PeetPrint, "|")
+	ja3 := strings.Split(res.TLS.JA3, ",")
+	if len(peetprint) != 8 || len(ja3) != 5 {
+		return
+	}
+	extensions := strings.Split(ja3[2], "-")
+	has := func(ids ...string) bool {
+		for _, id := range ids {
+			if slices.Contains(extensions, id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	grease := strings.Contains(peetprint[7], "GREASE")
+	if p.grease {
+		c.check("tls", "grease", grease, "the ClientHello has no GREASE values")
+	} else {
+		c.check("tls", "grease", !grease, "the ClientHello has GREASE values")
+	}
+
+	// application_settings, with the old and the new codepoint
+	alps := has("17513", "17613")
+	if p.alps {
+		c.check("tls", "alps", alps, "ALPS missing")
+	} else {
+		c.check("tls", "alps", !alps, "the ClientHello has ALPS, which only Chromium sends")
+	}
+
+	rsl := has("28")
+	if p.recordSizeLimit {
+		c.check("tls", "record_size_limit", rsl, "record_size_limit missing")
+	} else {
+		c.check("tls", "record_size_limit", !rsl, "the ClientHello has record_size_limit, which Firefox sends")
+	}
+
+	if len(p.certCompression) > 0 {
+		c.check("tls", "cert_compression", slices.Contains(p.certCompression, peetprint[5]),
+			"the certificate compression algorithms are %q instead of %q", peetprint[5], strings.Join(p.certCompression, " or "))
+	}
+
+	// The QUIC ClientHello only offers h3
+	if res.HTTPVersion != "h3" {
+		c.check("tls", "alpn_h2", slices.Contains(strings.Split(peetprint[1], "-"), "2"), "ALPN doesn't offer h2")
+	}
+}
+
+func checkPseudoHeaderOrder(c *checker, layer, order string, p profile) {
+	if order == "" || len(p.pseudoOrders) == 0 {
+		return
+	}
+	if client, ok := pseudoHeaderOrders[order]; ok {
+		c.check(layer, "pseudo_header_order", slices.Contains(p.pseudoOrders, order),
+			"the %s header order %s matches %s", layer, order, client)
+	} else {
+		c.check(layer, "pseudo_header_order", false,
+			"the %s header order is %s instead of %s", layer, order, strings.Join(p.pseudoOrders, " or "))
+	}
+}
+
+func checkHTTP2(c *checker, res types.Response, p profile) {
+	if res.Http2 == nil {
+		return
+	}
+	// settings|window update|priority|pseudo-header order
+	akamai := strings.Split(res.Http2.AkamaiFingerprint, "|")
+	if len(akamai) != 4 {
+		return
+	}
+	checkPseudoHeaderOrder(c, "h2", akamai[3], p)
+	if len(p.windowUpdates) > 0 {
+		c.check("h2", "window_update", slices.Contains(p.windowUpdates, akamai[1]),
+			"the connection WINDOW_UPDATE is %s instead of %s", akamai[1], strings.Join(p.windowUpdates, " or "))
+	}
+}
+
+// initialTTL guesses the TTL a packet started with, operating systems use 64, 128 or 255
+func initialTTL(ttl int) int {
+	switch {
+	case ttl <= 64:
+		return 64
+	case ttl <= 128:
+		return 128
+	}
+	return 255
+}
+
+func checkTCP(c *checker, res types.Response) {
+	ttl := res.TCPIP.IP.TTL
+	if ttl == 0 {
+		return
+	}
+	expected := 64
+	if c.d.Claimed.OS == "Windows" {
+		expected = 128
+	}
+	initial := initialTTL(ttl)
+	typical := map[int]string{64: "Linux, macOS, Android and iOS", 128: "Windows", 255: "network devices"}[initial]
+	c.check("tcp", "ttl", initial == expected, "TTL %d (starting at %d, typical for %s)", ttl, initial, typical)
+}
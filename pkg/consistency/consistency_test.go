@@ -0,0 +1,328 @@
+package consistency
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const (
+	chromeUA  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36"
+	firefoxUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0"
+	curlUA    = "curl/8.5.0"
+)
+
+// chrome is a request of Chrome 130 on Windows over HTTP/2
+func chrome() types.Response {
+	res := types.Response{
+		UserAgent:   chromeUA,
+		HTTPVersion: "h2",
+		TLS: &types.TLSDetails{
+			JA3:       "771,4865-4866-4867,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513,29-23-24,0",
+			PeetPrint: "GREASE-772-771|2-1.1|GREASE-29-23-24|1027-2052-1025|1|2|GREASE-4865-4866-4867|GREASE-0-10-11-13-16-17513-18-23-27-35-43-45-5-51-65281",
+		},
+		Http2: &types.Http2Details{
+			AkamaiFingerprint: "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p",
+			SendFrames: []types.ParsedFrame{
+				{Type: "SETTINGS"},
+				{Type: "WINDOW_UPDATE"},
+				{Type: "HEADERS", Headers: []string{
+					":method: GET",
+					":authority: example.com",
+					":scheme: https",
+					":path: /",
+					`sec-ch-ua: \"Chromium\";v=\"130\", \"Google Chrome\";v=\"130\", \"Not?A_Brand\";v=\"99\"`,
+					"sec-ch-ua-mobile: ?0",
+					`sec-ch-ua-platform: \"Windows\"`,
+					"user-agent: " + chromeUA,
+				}},
+			},
+		},
+	}
+	res.TCPIP.IP.TTL = 116
+	return res
+}
+
+// firefox is a request of Firefox 131 on Windows over HTTP/2
+func firefox() types.Response {
+	res := types.Response{
+		UserAgent:   firefoxUA,
+		HTTPVersion: "h2",
+		TLS: &types.TLSDetails{
+			JA3:       "771,4865-4867-4866,0-23-65281-10-11-16-5-34-51-43-13-45-28-65037,4588-29-23-24,0",
+			PeetPrint: "772-771|2-1.1|4588-29-23-24|1027-1283-1539|1||4865-4867-4866|0-10-11-13-16-23-28-34-43-45-5-51-65037-65281",
+		},
+		Http2: &types.Http2Details{
+			AkamaiFingerprint: "1:65536;2:0;4:131072;5:16384|12517377|0|m,p,a,s",
+			SendFrames: []types.ParsedFrame{
+				{Type: "HEADERS", Headers: []string{":method: GET", ":path: /", ":authority: example.com", ":scheme: https", "user-agent: " + firefoxUA}},
+			},
+		},
+	}
+	res.TCPIP.IP.TTL = 128
+	return res
+}
+
+// curl is a request of curl over HTTP/2, without an OS in its User-Agent
+func curl() types.Response {
+	return types.Response{
+		UserAgent:   curlUA,
+		HTTPVersion: "h2",
+		TLS: &types.TLSDetails{
+			JA3:       "771,4866-4867-4865,0-11-10-35-16-22-23-13-43-45-51,29-23-30-25-24,0-1-2",
+			PeetPrint: "772-771|2-1.1|29-23-30-25-24|1027-1283-1539|1||4866-4867-4865|0-10-11-13-16-22-23-35-43-45-51",
+		},
+		Http2: &types.Http2Details{AkamaiFingerprint: "3:100;4:10485760;2:0|1048510465|0|m,p,s,a"},
+	}
+}
+
+// goTLS replaces the fingerprints with the ones of Go's crypto/tls and net/http
+func goTLS(res *types.Response) {
+	res.TLS = &types.TLSDetails{
+		JA3:       "771,4865-4866-4867-49195,0-5-10-11-13-65281-16-18-43-51,29-23-24-25,0",
+		PeetPrint: "772-771|2-1.1|29-23-24-25|2052-1027-1283|1||4865-4866-4867-49195|0-10-11-13-16-18-43-5-51-65281",
+	}
+	res.Http2 = &types.Http2Details{
+		AkamaiFingerprint: "2:0;4:4194304;6:10485760|1073741824|0|a,m,p,s",
+		SendFrames: []types.ParsedFrame{
+			{Type: "HEADERS", Headers: []string{":authority: example.com", ":method: GET", ":path: /", ":scheme: https", "user-agent: " + chromeUA}},
+		},
+	}
+}
+
+// setHeader replaces the value of a header in the HTTP/2 HEADERS frame, an empty value removes it
+func setHeader(res *types.Response, name, value string) {
+	h2 := *res.Http2
+	h2.SendFrames = slices.Clone(h2.SendFrames)
+	for i, f := range h2.SendFrames {
+		if f.Type != "HEADERS" {
+			continue
+		}
+		f.Headers = slices.DeleteFunc(slices.Clone(f.Headers), func(h string) bool { return strings.HasPrefix(h, name+": ") })
+		if value != "" {
+			f.Headers = append(f.Headers, name+": "+value)
+		}
+		h2.SendFrames[i] = f
+	}
+	res.Http2 = &h2
+}
+
+func TestCheck(t *testing.T) {
+	chromeChecks := []string{
+		"client_hints.sec_ch_ua", "client_hints.sec_ch_ua_version", "client_hints.sec_ch_ua_platform", "client_hints.sec_ch_ua_mobile",
+		"tls.grease", "tls.alps", "tls.record_size_limit", "tls.cert_compression", "tls.alpn_h2",
+		"h2.pseudo_header_order", "h2.window_update", "tcp.ttl",
+	}
+	firefoxChecks := []string{
+		"client_hints.sec_ch_ua", "tls.grease", "tls.alps", "tls.record_size_limit", "tls.alpn_h2",
+		"h2.pseudo_header_order", "h2.window_update", "tcp.ttl",
+	}
+	tests := []struct {
+		name   string
+		res    types.Response
+		modify func(*types.Response)
+		// checks are the layer.name of the checks that ran, failed of those that failed
+		checks []string
+		failed []string
+	}{
+		{name: "Chrome", res: chrome(), checks: chromeChecks},
+		{name: "Firefox", res: firefox(), checks: firefoxChecks},
+		{name: "curl", res: curl(), checks: []string{"h2.pseudo_header_order"}},
+		{
+			name:   "Chrome UA with a Go TLS ClientHello",
+			res:    chrome(),
+			modify: goTLS,
+			checks: []string{
+				"client_hints.sec_ch_ua", "tls.grease", "tls.alps", "tls.record_size_limit", "tls.cert_compression", "tls.alpn_h2",
+				"h2.pseudo_header_order", "h2.window_update", "tcp.ttl",
+			},
+			failed: []string{"client_hints.sec_ch_ua", "tls.grease", "tls.alps", "tls.cert_compression", "h2.pseudo_header_order", "h2.window_update"},
+		},
+		{
+			name:   "Chrome with another Chromium version in Client Hints",
+			res:    chrome(),
+			modify: func(res *types.Response) { setHeader(res, "sec-ch-ua", `\"Chromium\";v=\"120\"`) },
+			checks: chromeChecks,
+			failed: []string{"client_hints.sec_ch_ua_version"},
+		},
+		{
+			name: "Chrome with the Client Hints of Android",
+			res:  chrome(),
+			modify: func(res *types.Response) {
+				setHeader(res, "sec-ch-ua-platform", `\"Android\"`)
+				setHeader(res, "sec-ch-ua-mobile", "?1")
+			},
+			checks: chromeChecks,
+			failed: []string{"client_hints.sec_ch_ua_platform", "client_hints.sec_ch_ua_mobile"},
+		},
+		{
+			name: "Chrome without GREASE, ALPS and certificate compression",
+			res:  chrome(),
+			modify: func(res *types.Response) {
+				res.TLS = &types.TLSDetails{
+					JA3:       "771,4865-4866-4867,0-23-65281-10-11-35-16-5-13-18-51-45-43,29-23-24,0",
+					PeetPrint: "772-771|2-1.1|29-23-24|1027-2052-1025|1||4865-4866-4867|0-10-11-13-16-18-23-35-43-45-5-51-65281",
+				}
+			},
+			checks: chromeChecks,
+			failed: []string{"tls.grease", "tls.alps", "tls.cert_compression"},
+		},
+		{
+			name: "Chrome with record_size_limit and without h2",
+			res:  chrome(),
+			modify: func(res *types.Response) {
+				res.TLS = &types.TLSDetails{
+					JA3:       "771,4865-4866-4867,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-28,29-23-24,0",
+					PeetPrint: "GREASE-772-771|1.1|GREASE-29-23-24|1027-2052-1025|1|2|GREASE-4865-4866-4867|GREASE-0-10-11-13-16-17513-18-23-27-28-35-43-45-5-51-65281",
+				}
+			},
+			checks: chromeChecks,
+			failed: []string{"tls.record_size_limit", "tls.alpn_h2"},
+		},
+		{
+			name: "Chrome with the HTTP/2 settings of Firefox",
+			res:  chrome(),
+			modify: func(res *types.Response) {
+				res.Http2 = &types.Http2Details{AkamaiFingerprint: firefox().Http2.AkamaiFingerprint, SendFrames: res.Http2.SendFrames}
+			},
+			checks: chromeChecks,
+			failed: []string{"h2.pseudo_header_order", "h2.window_update"},
+		},
+		{
+			name:   "Chrome on Windows with the TTL of Linux",
+			res:    chrome(),
+			modify: func(res *types.Response) { res.TCPIP.IP.TTL = 52 },
+			checks: chromeChecks,
+			failed: []string{"tcp.ttl"},
+		},
+		{
+			name: "Firefox with Client Hints, ALPS and without record_size_limit",
+			res:  firefox(),
+			modify: func(res *types.Response) {
+				setHeader(res, "sec-ch-ua", `\"Chromium\";v=\"130\"`)
+				res.TLS = &types.TLSDetails{
+					JA3:       "771,4865-4867-4866,0-23-65281-10-11-16-5-34-51-43-13-45-17613,29-23-24,0",
+					PeetPrint: "772-771|2-1.1|29-23-24|1027-1283-1539|1||4865-4867-4866|0-10-11-13-16-17613-23-34-43-45-5-51-65281",
+				}
+			},
+			checks: firefoxChecks,
+			failed: []string{"client_hints.sec_ch_ua", "tls.alps", "tls.record_size_limit"},
+		},
+		{
+			name:   "Firefox with the TTL of a network device",
+			res:    firefox(),
+			modify: func(res *types.Response) { res.TCPIP.IP.TTL = 250 },
+			checks: firefoxChecks,
+			failed: []string{"tcp.ttl"},
+		},
+		{
+			name: "Chrome over HTTP/3 with the pseudo-header order of curl",
+			res:  chrome(),
+			modify: func(res *types.Response) {
+				res.HTTPVersion = "h3"
+				res.Http3 = &types.Http3Details{Headers: []string{
+					":method: GET", ":path: /", ":scheme: https", ":authority: example.com",
+					`sec-ch-ua: "Chromium";v="130", "Google Chrome";v="130"`, "sec-ch-ua-mobile: ?0", `sec-ch-ua-platform: "Windows"`,
+				}}
+				res.Http2 = nil
+			},
+			checks: []string{
+				"client_hints.sec_ch_ua", "client_hints.sec_ch_ua_version", "client_hints.sec_ch_ua_platform", "client_hints.sec_ch_ua_mobile",
+				"tls.grease", "tls.alps", "tls.record_size_limit", "tls.cert_compression", "http3.pseudo_header_order", "tcp.ttl",
+			},
+			failed: []string{"http3.pseudo_header_order"},
+		},
+		{
+			name:   "curl with the pseudo-header order of Chrome",
+			res:    curl(),
+			modify: func(res *types.Response) { res.Http2 = chrome().Http2 },
+			checks: []string{"h2.pseudo_header_order"},
+			failed: []string{"h2.pseudo_header_order"},
+		},
+		{
+			name: "curl with an unknown pseudo-header order",
+			res:  curl(),
+			modify: func(res *types.Response) {
+				res.Http2 = &types.Http2Details{AkamaiFingerprint: "3:100|1048510465|0|p,m,s,a"}
+			},
+			checks: []string{"h2.pseudo_header_order"},
+			failed: []string{"h2.pseudo_header_order"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.res
+			if tt.modify != nil {
+				tt.modify(&res)
+			}
+			d := Check(res)
+			var checks, failed []string
+			for _, c := range d.Checks {
+				checks = append(checks, c.Layer+"."+c.Name)
+				if !c.Passed {
+					failed = append(failed, c.Layer+"."+c.Name)
+					if c.Message == "" {
+						t.Errorf("%s.%s failed without a message", c.Layer, c.Name)
+					}
+				}
+			}
+			if !slices.Equal(checks, tt.checks) {
+				t.Errorf("checks = %v, want %v", checks, tt.checks)
+			}
+			if !slices.Equal(failed, tt.failed) {
+				t.Errorf("failed = %v, want %v\nmismatches: %q", failed, tt.failed, d.Mismatches)
+			}
+			if d.Consistent != (len(tt.failed) == 0) || len(d.Mismatches) != len(tt.failed) {
+				t.Errorf("consistent = %v, mismatches = %q", d.Consistent, d.Mismatches)
+			}
+		})
+	}
+}
+
+func TestCheckKnownClient(t *testing.T) {
+	res := chrome()
+	res.IdentifiedAs = &types.IdentifiedClient{Name: "curl", Version: "8", Matched: []string{"ja4"}}
+	d := Check(res)
+	if d.Consistent || d.Mismatches[0] != "UA claims Chrome but the fingerprints match curl 8 (ja4)" {
+		t.Errorf("mismatches = %q", d.Mismatches)
+	}
+	res.IdentifiedAs.Name = "Chrome"
+	if d := Check(res); !d.Consistent {
+		t.Errorf("mismatches = %q", d.Mismatches)
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want types.ClaimedClient
+	}{
+		{chromeUA, types.ClaimedClient{Browser: "Chrome", Family: "chromium", Version: 130, OS: "Windows"}},
+		{firefoxUA, types.ClaimedClient{Browser: "Firefox", Family: "firefox", Version: 131, OS: "Windows"}},
+		{curlUA, types.ClaimedClient{Browser: "curl", Family: "curl", Version: 8}},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/130.0.6723.90 Mobile/15E148 Safari/604.1",
+			types.ClaimedClient{Browser: "Chrome", Family: "safari", Version: 130, OS: "iOS", Mobile: true},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			types.ClaimedClient{Browser: "Safari", Family: "safari", Version: 17, OS: "macOS"},
+		},
+		{"Version/1.0", types.ClaimedClient{}},
+	}
+	for _, tt := range tests {
+		if got := ParseUserAgent(tt.ua); got != tt.want {
+			t.Errorf("ParseUserAgent(%q) = %+v, want %+v", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestInitialTTL(t *testing.T) {
+	for ttl, want := range map[int]int{1: 64, 64: 64, 65: 128, 116: 128, 128: 128, 129: 255, 255: 255} {
+		if got := initialTTL(ttl); got != want {
+			t.Errorf("initialTTL(%d) = %d, want %d", ttl, got, want)
+		}
+	}
+}
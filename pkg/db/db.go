@@ -0,0 +1,674 @@
+package db
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The identifiers that are indexed, every request counts how often each pair of them was seen together
+const (
+	UserAgent = "user_agent"
+	JA3       = "ja3"
+	JA4       = "ja4"
+	PeetPrint = "peetprint"
+	Akamai    = "akamai"
+)
+
+var kinds = []string{UserAgent, JA3, JA4, PeetPrint, Akamai}
+
+var (
+	bucketRequests   = []byte("requests")
+	bucketRequestIDs = []byte("request_ids")
+	bucketIndex      = []byte("index")
+	bucketSnapshots  = []byte("snapshots")
+	// bucketSnapshotOrder maps a sequence number to the save time and ID of a snapshot, oldest first
+	bucketSnapshotOrder = []byte("snapshot_order")
+	bucketMeta          = []byte("meta")
+
+	// countKey holds how often an identifier was seen, pair keys always start with a kind
+	countKey = []byte("#")
+	// requestCountKey and snapshotCountKey in the meta bucket hold the number of stored requests and snapshots
+	requestCountKey  = []byte("requests")
+	snapshotCountKey = []byte("snapshots")
+)
+
+var (
+	ErrNotFound         = errors.New("identifier not found")
+	ErrRequestNotFound  = errors.New("request not found")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// idAlphabet and the lengths define the random IDs of saved snapshots and requests, requests are
+// stored in the order they were made so their IDs must not be guessable
+const (
+	idAlphabet       = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	snapshotIDLength = 8
+	requestIDLength  = 12
+)
+
+// Defaults of types.DatabaseRetention, and how often old requests are removed
+const (
+	defaultMaxAge       = 30 * 24 * time.Hour
+	defaultMaxSnapshots = 10000
+	defaultMaxBody      = 4096
+	pruneInterval       = time.Minute
+)
+
+// maxValueLength limits indexed values, longer ones (e.g. user agents) are truncated
+const maxValueLength = 1024
+
+// DB is the request history, stored in a local BoltDB file
+type DB struct {
+	bolt *bolt.DB
+
+	maxAge       time.Duration
+	maxRequests  int
+	maxSnapshots int
+	maxBody      int
+	done         chan struct{}
+}
+
+// SearchResult contains the identifiers most often seen together with the searched one
+type SearchResult struct {
+	By         string                    `json:"by"`
+	Kind       string                    `json:"kind"`
+	Count      int                       `json:"count"`
+	SeenWith   map[string]map[string]int `json:"seen_with"`
+	TotalCount int                       `json:"total_requests"`
+}
+
+// Open opens (or creates) the database file, requests are removed as retention says (the defaults with nil)
+func Open(path string, retention *types.DatabaseRetention) (*DB, error) {
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketRequests); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bucketRequestIDs); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bucketSnapshots); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		// Databases created before the count was kept are counted once
+		if meta.Get(requestCountKey) == nil {
+			n := uint64(tx.Bucket(bucketRequests).Stats().KeyN)
+			if err := meta.Put(requestCountKey, binary.BigEndian.AppendUint64(nil, n)); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(bucketSnapshotOrder) == nil {
+			if err := orderSnapshots(tx); err != nil {
+				return err
+			}
+		}
+		index, err := tx.CreateBucketIfNotExists(bucketIndex)
+		if err != nil {
+			return err
+		}
+		for _, k := range kinds {
+			if _, err := index.CreateBucketIfNotExists([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+
+	d := &DB{bolt: b, maxAge: defaultMaxAge, maxSnapshots: defaultMaxSnapshots, maxBody: defaultMaxBody, done: make(chan struct{})}
+	if retention != nil {
+		if retention.MaxAgeHours > 0 {
+			d.maxAge = time.Duration(retention.MaxAgeHours) * time.Hour
+		}
+		if retention.MaxSnapshots > 0 {
+			d.maxSnapshots = retention.MaxSnapshots
+		}
+		if retention.MaxBody > 0 {
+			d.maxBody = retention.MaxBody
+		}
+		d.maxRequests = retention.MaxRequests
+	}
+	d.prune()
+	go d.pruneLoop()
+	return d, nil
+}
+
+// Close closes the database file
+func (d *DB) Close() error {
+	close(d.done)
+	return d.bolt.Close()
+}
+
+func (d *DB) prune() {
+	now := time.Now()
+	if n, err := d.Prune(now); err != nil {
+		log.Println("Error removing old requests:", err)
+	} else if n > 0 {
+		log.Printf("Removed %d old requests from the database", n)
+	}
+	if n, err := d.PruneSnapshots(now); err != nil {
+		log.Println("Error removing old snapshots:", err)
+	} else if n > 0 {
+		log.Printf("Removed %d old snapshots from the database", n)
+	}
+}
+
+func (d *DB) pruneLoop() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.prune()
+		}
+	}
+}
+
+// getIdentifiers returns the indexed identifiers of a request, empty ones are left out
+func getIdentifiers(res types.Response) map[string]string {
+	ids := map[string]string{
+		UserAgent: res.UserAgent,
+	}
+	if res.TLS != nil {
+		ids[JA3] = res.TLS.JA3Hash
+		ids[JA4] = res.TLS.JA4
+		ids[PeetPrint] = res.TLS.PeetPrintHash
+	}
+	if res.Http2 != nil {
+		ids[Akamai] = res.Http2.AkamaiFingerprintHash
+	} else if res.Http3 != nil {
+		ids[Akamai] = res.Http3.AkamaiFingerprintHash
+	}
+	for k, v := range ids {
+		if v == "" || v == "-" {
+			delete(ids, k)
+		} else if len(v) > maxValueLength {
+			ids[k] = v[:maxValueLength]
+		}
+	}
+	return ids
+}
+
+func pairKey(kind, value string) []byte {
+	return append([]byte(kind+"\x00"), value...)
+}
+
+func increment(b *bolt.Bucket, key []byte) error {
+	var n uint64
+	if v := b.Get(key); len(v) == 8 {
+		n = binary.BigEndian.Uint64(v)
+	}
+	return b.Put(key, binary.BigEndian.AppendUint64(nil, n+1))
+}
+
+// capBody returns the body with at most max bytes of its text and data, the decoded form of a larger
+// body is left out. The body of the response is shared, so a copy is returned.
+func capBody(body *types.RequestBody, max int) *types.RequestBody {
+	if body == nil || body.Size <= max {
+		return body
+	}
+	capped := *body
+	capped.Decoded = nil
+	capped.Truncated = true
+	if len(capped.Text) > max {
+		capped.Text = strings.ToValidUTF8(capped.Text[:max], "")
+	}
+	if n := max / 3 * 4; len(capped.Base64) > n {
+		capped.Base64 = capped.Base64[:n]
+	}
+	return &capped
+}
+
+// capDataFrames returns the frames with at most max bytes of DATA frame payloads in total. The frames
+// of the response are shared, so they are copied if any payload is cut.
+func capDataFrames(frames []types.ParsedFrame, max int) []types.ParsedFrame {
+	capped, copied := frames, false
+	room := max
+	for i, f := range frames {
+		if f.Type != "DATA" {
+			continue
+		}
+		if len(f.Payload) > room {
+			if !copied {
+				capped, copied = slices.Clone(frames), true
+			}
+			capped[i].Payload = f.Payload[:room]
+		}
+		room -= len(capped[i].Payload)
+	}
+	return capped
+}
+
+// stored returns what is saved of a request, bodies are limited to maxBody
+func (d *DB) stored(res types.Response) types.Response {
+	switch {
+	case res.Http1 != nil:
+		h := *res.Http1
+		h.Body = capBody(h.Body, d.maxBody)
+		res.Http1 = &h
+	case res.Http2 != nil:
+		h := *res.Http2
+		h.Body = capBody(h.Body, d.maxBody)
+		h.SendFrames = capDataFrames(h.SendFrames, d.maxBody)
+		res.Http2 = &h
+	case res.Http3 != nil:
+		h := *res.Http3
+		h.Body = capBody(h.Body, d.maxBody)
+		res.Http3 = &h
+	}
+	return res
+}
+
+// Save stores the request, counts its identifiers and returns the random ID of the request. It uses a
+// batch, so concurrent requests share a single write transaction.
+func (d *DB) Save(res types.Response) (string, error) {
+	res = d.stored(res)
+	ids := getIdentifiers(res)
+
+	err := d.bolt.Batch(func(tx *bolt.Tx) error {
+		requests := tx.Bucket(bucketRequests)
+		requestIDs := tx.Bucket(bucketRequestIDs)
+		seq, err := requests.NextSequence()
+		if err != nil {
+			return err
+		}
+		for {
+			if res.RequestID, err = newID(requestIDLength); err != nil {
+				return err
+			}
+			if requestIDs.Get([]byte(res.RequestID)) == nil {
+				break
+			}
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		key := binary.BigEndian.AppendUint64(nil, seq)
+		if err := requests.Put(key, data); err != nil {
+			return err
+		}
+		if err := requestIDs.Put([]byte(res.RequestID), key); err != nil {
+			return err
+		}
+		if err := addMetaCount(tx, requestCountKey, 1); err != nil {
+			return err
+		}
+
+		index := tx.Bucket(bucketIndex)
+		for kind, value := range ids {
+			b, err := index.Bucket([]byte(kind)).CreateBucketIfNotExists([]byte(value))
+			if err != nil {
+				return err
+			}
+			if err := increment(b, countKey); err != nil {
+				return err
+			}
+			for otherKind, otherValue := range ids {
+				if otherKind == kind {
+					continue
+				}
+				if err := increment(b, pairKey(otherKind, otherValue)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.RequestID, nil
+}
+
+// Get returns a stored request
+func (d *DB) Get(id string) (types.Response, error) {
+	var res types.Response
+	err := d.bolt.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketRequestIDs).Get([]byte(id))
+		if key == nil {
+			return ErrRequestNotFound
+		}
+		data := tx.Bucket(bucketRequests).Get(key)
+		if data == nil {
+			return ErrRequestNotFound
+		}
+		return json.Unmarshal(data, &res)
+	})
+	return res, err
+}
+
+// metaCount returns a count of the meta bucket, requests and snapshots are counted when they are saved or removed
+func metaCount(tx *bolt.Tx, key []byte) int {
+	if v := tx.Bucket(bucketMeta).Get(key); len(v) == 8 {
+		return int(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func addMetaCount(tx *bolt.Tx, key []byte, delta int) error {
+	n := max(metaCount(tx, key)+delta, 0)
+	return tx.Bucket(bucketMeta).Put(key, binary.BigEndian.AppendUint64(nil, uint64(n)))
+}
+
+// Count returns the number of stored requests
+func (d *DB) Count() (int, error) {
+	var n int
+	err := d.bolt.View(func(tx *bolt.Tx) error {
+		n = metaCount(tx, requestCountKey)
+		return nil
+	})
+	return n, err
+}
+
+// decrement lowers a count, and removes it when it reaches 0
+func decrement(b *bolt.Bucket, key []byte) (uint64, error) {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0, nil
+	}
+	n := binary.BigEndian.Uint64(v)
+	if n <= 1 {
+		return 0, b.Delete(key)
+	}
+	return n - 1, b.Put(key, binary.BigEndian.AppendUint64(nil, n-1))
+}
+
+// remove deletes a stored request and takes it out of the identifier counts
+func remove(tx *bolt.Tx, key []byte, res types.Response) error {
+	if err := tx.Bucket(bucketRequests).Delete(key); err != nil {
+		return err
+	}
+	if err := addMetaCount(tx, requestCountKey, -1); err != nil {
+		return err
+	}
+	if res.RequestID != "" {
+		if err := tx.Bucket(bucketRequestIDs).Delete([]byte(res.RequestID)); err != nil {
+			return err
+		}
+	}
+
+	ids := getIdentifiers(res)
+	index := tx.Bucket(bucketIndex)
+	for kind, value := range ids {
+		kindBucket := index.Bucket([]byte(kind))
+		b := kindBucket.Bucket([]byte(value))
+		if b == nil {
+			continue
+		}
+		n, err := decrement(b, countKey)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if err := kindBucket.DeleteBucket([]byte(value)); err != nil {
+				return err
+			}
+			continue
+		}
+		for otherKind, otherValue := range ids {
+			if otherKind == kind {
+				continue
+			}
+			if _, err := decrement(b, pairKey(otherKind, otherValue)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune removes the requests that are older than the maximum age, and the oldest ones above the
+// maximum number of requests. It returns how many were removed.
+func (d *DB) Prune(now time.Time) (int, error) {
+	cutoff := now.Add(-d.maxAge).UnixMilli()
+	var removed int
+	err := d.bolt.Update(func(tx *bolt.Tx) error {
+		requests := tx.Bucket(bucketRequests)
+		n := metaCount(tx, requestCountKey)
+
+		type entry struct {
+			key []byte
+			res types.Response
+		}
+		var old []entry
+		c := requests.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var res types.Response
+			if err := json.Unmarshal(v, &res); err != nil {
+				return fmt.Errorf("failed to parse request: %w", err)
+			}
+			tooMany := d.maxRequests > 0 && n-len(old) > d.maxRequests
+			if res.Timestamp >= cutoff && !tooMany {
+				break
+			}
+			old = append(old, entry{append([]byte{}, k...), res})
+		}
+		for _, e := range old {
+			if err := remove(tx, e.key, e.res); err != nil {
+				return err
+			}
+		}
+		removed = len(old)
+		return nil
+	})
+	return removed, err
+}
+
+// NormalizeIdentifier turns a full fingerprint into the hash that is indexed, for the kinds that are indexed by hash
+func NormalizeIdentifier(kind, value string) string {
+	switch kind {
+	case JA3, PeetPrint, Akamai:
+		if _, err := hex.DecodeString(value); err != nil || len(value) != 32 {
+			return utils.GetMD5Hash(value)
+		}
+	}
+	return value
+}
+
+// Search returns the top identifiers of every other kind seen together with value
+func (d *DB) Search(kind, value string, top int) (*SearchResult, error) {
+	value = NormalizeIdentifier(kind, value)
+	res := &SearchResult{By: value, Kind: kind, SeenWith: map[string]map[string]int{}}
+
+	err := d.bolt.View(func(tx *bolt.Tx) error {
+		res.TotalCount = metaCount(tx, requestCountKey)
+		index := tx.Bucket(bucketIndex).Bucket([]byte(kind))
+		if index == nil {
+			return fmt.Errorf("unknown identifier kind %q", kind)
+		}
+		b := index.Bucket([]byte(value))
+		if b == nil {
+			return ErrNotFound
+		}
+		if v := b.Get(countKey); len(v) == 8 {
+			res.Count = int(binary.BigEndian.Uint64(v))
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			otherKind, otherValue, ok := bytes.Cut(k, []byte{0})
+			if !ok || len(v) != 8 {
+				return nil
+			}
+			m, ok := res.SeenWith[string(otherKind)]
+			if !ok {
+				m = map[string]int{}
+				res.SeenWith[string(otherKind)] = m
+			}
+			m[string(otherValue)] = int(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, m := range res.SeenWith {
+		res.SeenWith[k] = utils.SortByVal(m, top)
+	}
+	return res, nil
+}
+
+// newID returns a random ID of n characters from idAlphabet. Random bytes that don't map to every
+// character equally often are skipped, so all characters are equally likely.
+func newID(n int) (string, error) {
+	limit := 256 - 256%len(idAlphabet)
+	id := make([]byte, 0, n)
+	b := make([]byte, n)
+	for len(id) < n {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) < limit && len(id) < n {
+				id = append(id, idAlphabet[int(c)%len(idAlphabet)])
+			}
+		}
+	}
+	return string(id), nil
+}
+
+// SaveSnapshot stores a result under a new short ID, which is set as its SnapshotID. Bodies are
+// limited like those of stored requests.
+func (d *DB) SaveSnapshot(res *types.Response) error {
+	snapshot := d.stored(*res)
+	err := d.bolt.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(bucketSnapshots)
+		for {
+			id, err := newID(snapshotIDLength)
+			if err != nil {
+				return err
+			}
+			if snapshots.Get([]byte(id)) == nil {
+				snapshot.SnapshotID = id
+				break
+			}
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to marshal snapshot: %w", err)
+		}
+		if err := snapshots.Put([]byte(snapshot.SnapshotID), data); err != nil {
+			return err
+		}
+		return addSnapshotOrder(tx, time.Now(), snapshot.SnapshotID)
+	})
+	if err != nil {
+		return err
+	}
+	res.SnapshotID = snapshot.SnapshotID
+	return nil
+}
+
+// addSnapshotOrder adds a snapshot after the ones saved before it, and counts it
+func addSnapshotOrder(tx *bolt.Tx, saved time.Time, id string) error {
+	order := tx.Bucket(bucketSnapshotOrder)
+	seq, err := order.NextSequence()
+	if err != nil {
+		return err
+	}
+	value := append(binary.BigEndian.AppendUint64(nil, uint64(saved.UnixMilli())), id...)
+	if err := order.Put(binary.BigEndian.AppendUint64(nil, seq), value); err != nil {
+		return err
+	}
+	return addMetaCount(tx, snapshotCountKey, 1)
+}
+
+// orderSnapshots creates the order of snapshots saved before it was kept, by the time of their request
+func orderSnapshots(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucket(bucketSnapshotOrder); err != nil {
+		return err
+	}
+	type snapshot struct {
+		id        string
+		timestamp int64
+	}
+	var existing []snapshot
+	err := tx.Bucket(bucketSnapshots).ForEach(func(k, v []byte) error {
+		var res types.Response
+		if err := json.Unmarshal(v, &res); err != nil {
+			return fmt.Errorf("failed to parse snapshot: %w", err)
+		}
+		existing = append(existing, snapshot{string(k), res.Timestamp})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(existing, func(a, b snapshot) int { return cmp.Compare(a.timestamp, b.timestamp) })
+	for _, s := range existing {
+		if err := addSnapshotOrder(tx, time.UnixMilli(s.timestamp), s.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneSnapshots removes the snapshots that were saved before the maximum age, and the oldest ones above
+// the maximum number of snapshots. It returns how many were removed.
+func (d *DB) PruneSnapshots(now time.Time) (int, error) {
+	cutoff := now.Add(-d.maxAge).UnixMilli()
+	var removed int
+	err := d.bolt.Update(func(tx *bolt.Tx) error {
+		n := metaCount(tx, snapshotCountKey)
+		c := tx.Bucket(bucketSnapshotOrder).Cursor()
+		snapshots := tx.Bucket(bucketSnapshots)
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if len(v) < 8 {
+				return fmt.Errorf("invalid snapshot order entry %x", k)
+			}
+			saved, id := int64(binary.BigEndian.Uint64(v)), slices.Clone(v[8:])
+			if saved >= cutoff && n-removed <= d.maxSnapshots {
+				break
+			}
+			if err := snapshots.Delete(id); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return addMetaCount(tx, snapshotCountKey, -removed)
+	})
+	return removed, err
+}
+
+// GetSnapshot returns a saved snapshot
+func (d *DB) GetSnapshot(id string) (types.Response, error) {
+	var res types.Response
+	err := d.bolt.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketSnapshots).Get([]byte(id))
+		if data == nil {
+			return ErrSnapshotNotFound
+		}
+		return json.Unmarshal(data, &res)
+	})
+	return res, err
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTest(t *testing.T, retention *types.DatabaseRetention) *DB {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "test.db"), retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func request(ts time.Time, ja4 string) types.Response {
+	return types.Response{
+		Timestamp: ts.UnixMilli(),
+		UserAgent: "test",
+		TLS:       &types.TLSDetails{JA4: ja4},
+	}
+}
+
+func TestSaveGet(t *testing.T) {
+	d := openTest(t, nil)
+	id, err := d.Save(request(time.Now(), "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != requestIDLength {
+		t.Errorf("id = %q, want %d random characters", id, requestIDLength)
+	}
+	res, err := d.Get(id)
+	if err != nil || res.RequestID != id || res.TLS.JA4 != "a" {
+		t.Errorf("Get(%q) = %+v, %v", id, res, err)
+	}
+	if _, err := d.Get("1"); !errors.Is(err, ErrRequestNotFound) {
+		t.Errorf("Get(1) = %v, want ErrRequestNotFound", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	d := openTest(t, &types.DatabaseRetention{MaxAgeHours: 1, MaxRequests: 2})
+	var ids []string
+	for _, r := range []types.Response{
+		request(now.Add(-2*time.Hour), "old"),
+		request(now.Add(-3*time.Minute), "a"),
+		request(now.Add(-2*time.Minute), "b"),
+		request(now.Add(-time.Minute), "b"),
+	} {
+		id, err := d.Save(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	removed, err := d.Prune(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("removed %d requests, want 2", removed)
+	}
+	if n, _ := d.Count(); n != 2 {
+		t.Errorf("Count() = %d, want 2", n)
+	}
+	for i, id := range ids {
+		_, err := d.Get(id)
+		if kept := err == nil; kept != (i >= 2) {
+			t.Errorf("request %d kept = %v", i, kept)
+		}
+	}
+
+	if _, err := d.Search(JA4, "old", 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Search(old) = %v, want ErrNotFound", err)
+	}
+	res, err := d.Search(UserAgent, "test", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 2 || res.SeenWith[JA4]["b"] != 2 || res.SeenWith[JA4]["a"] != 0 {
+		t.Errorf("Search(test) = %+v", res)
+	}
+}
+
+func TestSaveCapsBody(t *testing.T) {
+	d := openTest(t, &types.DatabaseRetention{MaxBody: 10})
+	body := &types.RequestBody{Size: 100, Text: strings.Repeat("x", 100), Decoded: map[string]any{"a": 1}}
+	res := request(time.Now(), "a")
+	res.Http1 = &types.Http1Details{Body: body}
+
+	id, err := d.Save(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := d.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := stored.Http1.Body
+	if len(b.Text) != 10 || b.Decoded != nil || !b.Truncated || b.Size != 100 {
+		t.Errorf("stored body = %+v", b)
+	}
+	if len(body.Text) != 100 || body.Decoded == nil {
+		t.Error("the body of the response was changed")
+	}
+}
+
+func TestCountWithoutMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := d.Save(request(time.Now(), "a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A database written before the count was kept has no meta bucket
+	if err := d.bolt.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(bucketMeta) }); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, err := d.Count(); err != nil || n != 3 {
+		t.Errorf("Count() = %d, %v, want 3", n, err)
+	}
+}
+
+func TestSaveCapsDataFrames(t *testing.T) {
+	d := openTest(t, &types.DatabaseRetention{MaxBody: 10})
+	frames := []types.ParsedFrame{
+		{Type: "HEADERS"},
+		{Type: "DATA", Payload: []byte("123456")},
+		{Type: "DATA", Payload: []byte("7890abcdef")},
+		{Type: "DATA", Payload: []byte("gh")},
+	}
+	res := request(time.Now(), "a")
+	res.Http2 = &types.Http2Details{SendFrames: frames}
+
+	id, err := d.Save(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := d.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads []string
+	for _, f := range stored.Http2.SendFrames {
+		payloads = append(payloads, string(f.Payload))
+	}
+	if want := []string{"", "123456", "7890", ""}; !slices.Equal(payloads, want) {
+		t.Errorf("payloads = %q, want %q", payloads, want)
+	}
+	if string(frames[2].Payload) != "7890abcdef" {
+		t.Error("the frames of the response were changed")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	d := openTest(t, &types.DatabaseRetention{MaxAgeHours: 1, MaxSnapshots: 2, MaxBody: 10})
+	var ids []string
+	for i := 0; i < 3; i++ {
+		res := request(time.Now(), "a")
+		res.Http3 = &types.Http3Details{Body: &types.RequestBody{Size: 100, Text: strings.Repeat("x", 100)}}
+		if err := d.SaveSnapshot(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Http3.Body.Size != 100 || len(res.Http3.Body.Text) != 100 {
+			t.Fatal("the body of the response was changed")
+		}
+		ids = append(ids, res.SnapshotID)
+	}
+	snapshot, err := d.GetSnapshot(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := snapshot.Http3.Body; len(b.Text) != 10 || !b.Truncated || snapshot.SnapshotID != ids[0] {
+		t.Errorf("snapshot = %+v, body = %+v", snapshot, b)
+	}
+
+	// Only the newest two are kept, and all of them expire after an hour
+	if removed, err := d.PruneSnapshots(time.Now()); err != nil || removed != 1 {
+		t.Errorf("PruneSnapshots() = %d, %v, want 1", removed, err)
+	}
+	if _, err := d.GetSnapshot(ids[0]); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("GetSnapshot(oldest) = %v, want ErrSnapshotNotFound", err)
+	}
+	if removed, err := d.PruneSnapshots(time.Now().Add(2 * time.Hour)); err != nil || removed != 2 {
+		t.Errorf("PruneSnapshots() = %d, %v, want 2", removed, err)
+	}
+	for _, id := range ids {
+		if _, err := d.GetSnapshot(id); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("GetSnapshot(%s) = %v, want ErrSnapshotNotFound", id, err)
+		}
+	}
+}
+
+func TestSnapshotsWithoutOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, ts := range []time.Time{now.Add(-time.Hour), now.Add(-24 * 40 * time.Hour), now} {
+		res := request(ts, "a")
+		if err := d.SaveSnapshot(&res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Snapshots saved before their order was kept are only in the snapshots bucket
+	err = d.bolt.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketSnapshotOrder); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMeta).Delete(snapshotCountKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// Opening orders them by their timestamp and removes the one older than 30 days
+	d, err = Open(path, &types.DatabaseRetention{MaxSnapshots: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var timestamps []int64
+	err = d.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshots).ForEach(func(_, v []byte) error {
+			var res types.Response
+			err := json.Unmarshal(v, &res)
+			timestamps = append(timestamps, res.Timestamp)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 1 || timestamps[0] != now.UnixMilli() {
+		t.Errorf("kept snapshots from %v, want only the newest", timestamps)
+	}
+}
+
+func TestNewIDUniform(t *testing.T) {
+	counts := map[rune]int{}
+	const ids = 20000
+	for i := 0; i < ids; i++ {
+		id, err := newID(snapshotIDLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != snapshotIDLength {
+			t.Fatalf("id %q has length %d", id, len(id))
+		}
+		for _, c := range id {
+			counts[c]++
+		}
+	}
+	// Every character is expected ids*length/len(idAlphabet) (about 2807) times, the biased mapping
+	// gave the first 28 characters 5 of every 4 of the others
+	want := float64(ids*snapshotIDLength) / float64(len(idAlphabet))
+	for _, c := range idAlphabet {
+		if n := float64(counts[c]); n < want*0.9 || n > want*1.1 {
+			t.Errorf("%q was picked %v times, want about %v", c, n, want)
+		}
+	}
+}
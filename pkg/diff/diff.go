@@ -0,0 +1,258 @@
+package diff
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/clients"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Fields are the compared parts of a fingerprint, each a list of values in the order they were sent
+type Fields map[string][]string
+
+// fieldOrder is the order the fields are reported in
+var fieldOrder = []string{
+	"tls.ja4",
+	"tls.version",
+	"tls.supported_versions",
+	"tls.ciphers",
+	"tls.extensions",
+	"tls.groups",
+	"tls.point_formats",
+	"tls.signature_algorithms",
+	"tls.alpn",
+	"tls.psk_key_exchange_modes",
+	"tls.cert_compression",
+	"h2.settings",
+	"h2.window_update",
+	"h2.priority",
+	"h2.pseudo_header_order",
+	"h3.settings",
+	"h3.pseudo_header_order",
+	"http.header_order",
+	"quic.fingerprint",
+	"tcp.ttl",
+	"tcp.window",
+	"tcp.options_order",
+}
+
+func split(s, sep string) []string {
+	if s == "" || s == "-" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+// isHash reports whether a known client lists the hash instead of the full fingerprint
+func isHash(fp string) bool {
+	_, err := hex.DecodeString(fp)
+	return err == nil && len(fp) == 32
+}
+
+func (f Fields) set(field string, values []string) {
+	if len(values) > 0 {
+		f[field] = values
+	}
+}
+
+// addJA3 splits "version,ciphers,extensions,groups,point formats"
+func (f Fields) addJA3(ja3 string) {
+	parts := strings.Split(ja3, ",")
+	if len(parts) != 5 {
+		return
+	}
+	f.set("tls.version", split(parts[0], "-"))
+	f.set("tls.ciphers", split(parts[1], "-"))
+	f.set("tls.extensions", split(parts[2], "-"))
+	f.set("tls.groups", split(parts[3], "-"))
+	f.set("tls.point_formats", split(parts[4], "-"))
+}
+
+// addPeetPrint splits "versions|protocols|groups|signature algorithms|psk mode|certificate compression|ciphers|extensions",
+// ciphers, groups and extensions are taken from the JA3 fingerprint, which keeps their order
+func (f Fields) addPeetPrint(peetprint string) {
+	parts := strings.Split(peetprint, "|")
+	if len(parts) != 8 {
+		return
+	}
+	f.set("tls.supported_versions", split(parts[0], "-"))
+	f.set("tls.alpn", split(parts[1], "-"))
+	f.set("tls.signature_algorithms", split(parts[3], "-"))
+	f.set("tls.psk_key_exchange_modes", split(parts[4], "-"))
+	f.set("tls.cert_compression", split(parts[5], "-"))
+}
+
+// addAkamai splits "settings|window update|priority|pseudo-header order"
+func (f Fields) addAkamai(akamai string) {
+	parts := strings.Split(akamai, "|")
+	if len(parts) != 4 {
+		return
+	}
+	f.set("h2.settings", split(parts[0], ";"))
+	f.set("h2.window_update", split(parts[1], ","))
+	f.set("h2.priority", split(parts[2], ","))
+	f.set("h2.pseudo_header_order", split(parts[3], ","))
+}
+
+// headerNames returns the names of the regular headers, in "name: value" form
+func headerNames(headers []string) []string {
+	var names []string
+	for _, h := range headers {
+		if strings.HasPrefix(h, ":") {
+			continue
+		}
+		name, _, _ := strings.Cut(h, ":")
+		names = append(names, name)
+	}
+	return names
+}
+
+// FromResponse returns the fields of a request, as returned by /api/all
+func FromResponse(res types.Response) Fields {
+	f := Fields{}
+	if res.TLS != nil {
+		f.set("tls.ja4", split(res.TLS.JA4, "_"))
+		f.addJA3(res.TLS.JA3)
+		f.addPeetPrint(res.TLS.PeetPrint)
+	}
+	if res.Http1 != nil {
+		f.set("http.header_order", split(res.Http1.HeaderOrder, ","))
+	}
+	if res.Http2 != nil {
+		f.addAkamai(res.Http2.AkamaiFingerprint)
+		for _, frame := range res.Http2.SendFrames {
+			if frame.Type == "HEADERS" {
+				f.set("http.header_order", headerNames(frame.Headers))
+				break
+			}
+		}
+	}
+	if res.Http3 != nil {
+		var settings []string
+		for _, s := range res.Http3.Settings {
+			settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Value))
+		}
+		f.set("h3.settings", settings)
+		f.set("h3.pseudo_header_order", split(trackmehttp.GetHTTP3HeaderOrder(res.Http3.Headers), ","))
+		f.set("http.header_order", headerNames(res.Http3.Headers))
+		if res.Http3.QUIC != nil {
+			f.set("quic.fingerprint", split(res.Http3.QUIC.Fingerprint, "|"))
+		}
+	}
+	if res.TCPIP.IP.TTL > 0 {
+		f.set("tcp.ttl", []string{strconv.Itoa(res.TCPIP.IP.TTL)})
+	}
+	if res.TCPIP.TCP.Window > 0 {
+		f.set("tcp.window", []string{strconv.Itoa(res.TCPIP.TCP.Window)})
+	}
+	f.set("tcp.options_order", split(res.TCPIP.TCP.OptionsOrder, ","))
+	return f
+}
+
+// FromKnownClient returns the fields of a known client. Clients can list several fingerprints of
+// each kind, the one closest to current is used. Fingerprints that are only listed as hashes are skipped.
+func FromKnownClient(c clients.KnownClient, current Fields) Fields {
+	f := Fields{}
+	closest := func(fps []string, add func(Fields, string)) {
+		var best Fields
+		bestDiffs := -1
+		for _, fp := range fps {
+			if isHash(fp) {
+				continue
+			}
+			candidate := Fields{}
+			add(candidate, fp)
+			if d := Compare(current, candidate, ""); bestDiffs < 0 || d.Differences < bestDiffs {
+				best, bestDiffs = candidate, d.Differences
+			}
+		}
+		for k, v := range best {
+			f[k] = v
+		}
+	}
+	closest(c.JA4, func(f Fields, fp string) { f.set("tls.ja4", split(fp, "_")) })
+	closest(c.JA3, Fields.addJA3)
+	closest(c.PeetPrint, Fields.addPeetPrint)
+	closest(c.Akamai, Fields.addAkamai)
+	closest(c.QUIC, func(f Fields, fp string) { f.set("quic.fingerprint", split(fp, "|")) })
+	return f
+}
+
+// compareValues fills in the values that are missing from or were added to current, counting duplicates
+func compareValues(d *types.FieldDiff) {
+	counts := map[string]int{}
+	for _, v := range d.Reference {
+		counts[v]++
+	}
+	for _, v := range d.Current {
+		if counts[v] > 0 {
+			counts[v]--
+		} else {
+			d.Extra = append(d.Extra, v)
+		}
+	}
+	for _, v := range d.Reference {
+		if counts[v] > 0 {
+			counts[v]--
+			d.Missing = append(d.Missing, v)
+		}
+	}
+	d.OrderChanged = len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// Compare returns the field level differences of current and reference
+func Compare(current, reference Fields, against string) *types.FingerprintDiff {
+	d := &types.FingerprintDiff{Against: against, Fields: []types.FieldDiff{}}
+	for _, field := range fieldOrder {
+		cur, hasCur := current[field]
+		ref, hasRef := reference[field]
+		if !hasCur && !hasRef {
+			continue
+		}
+		if hasCur != hasRef {
+			d.Skipped = append(d.Skipped, field)
+			continue
+		}
+		fd := types.FieldDiff{Field: field, Current: cur, Reference: ref, Equal: slices.Equal(cur, ref)}
+		if !fd.Equal {
+			compareValues(&fd)
+			d.Differences++
+		}
+		d.Fields = append(d.Fields, fd)
+	}
+	d.Identical = d.Differences == 0
+	return d
+}
+
+// Format returns the differing fields as text
+func Format(d *types.FingerprintDiff) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Compared with %s: %d of %d fields differ\n", d.Against, d.Differences, len(d.Fields))
+	for _, f := range d.Fields {
+		if f.Equal {
+			continue
+		}
+		if f.OrderChanged {
+			fmt.Fprintf(&b, "\n%s: order changed\n", f.Field)
+		} else {
+			fmt.Fprintf(&b, "\n%s: values changed\n", f.Field)
+			if len(f.Missing) > 0 {
+				fmt.Fprintf(&b, "  missing:   %s\n", strings.Join(f.Missing, " "))
+			}
+			if len(f.Extra) > 0 {
+				fmt.Fprintf(&b, "  extra:     %s\n", strings.Join(f.Extra, " "))
+			}
+		}
+		fmt.Fprintf(&b, "  current:   %s\n", strings.Join(f.Current, " "))
+		fmt.Fprintf(&b, "  reference: %s\n", strings.Join(f.Reference, " "))
+	}
+	if len(d.Skipped) > 0 {
+		fmt.Fprintf(&b, "\nNot compared (only one side has them): %s\n", strings.Join(d.Skipped, ", "))
+	}
+	return b.String()
+}
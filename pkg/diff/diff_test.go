@@ -0,0 +1,162 @@
+package diff
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/clients"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   []string
+		reference []string
+		missing   []string
+		extra     []string
+		order     bool
+	}{
+		{name: "equal", current: []string{"a", "b"}, reference: []string{"a", "b"}},
+		{name: "order changed", current: []string{"b", "a"}, reference: []string{"a", "b"}, order: true},
+		{name: "missing", current: []string{"a"}, reference: []string{"a", "b"}, missing: []string{"b"}},
+		{name: "extra", current: []string{"a", "c", "b"}, reference: []string{"a", "b"}, extra: []string{"c"}},
+		{name: "duplicate", current: []string{"a", "a"}, reference: []string{"a"}, extra: []string{"a"}},
+		{name: "replaced", current: []string{"a", "c"}, reference: []string{"b", "a"}, missing: []string{"b"}, extra: []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Compare(Fields{"tls.ciphers": tt.current}, Fields{"tls.ciphers": tt.reference}, "ref")
+			if len(d.Fields) != 1 {
+				t.Fatalf("fields = %+v", d.Fields)
+			}
+			f := d.Fields[0]
+			equal := !tt.order && tt.missing == nil && tt.extra == nil
+			differences := 1
+			if equal {
+				differences = 0
+			}
+			if f.Equal != equal || d.Identical != equal || d.Differences != differences {
+				t.Errorf("equal = %v, identical = %v, differences = %d", f.Equal, d.Identical, d.Differences)
+			}
+			if f.OrderChanged != tt.order || !slices.Equal(f.Missing, tt.missing) || !slices.Equal(f.Extra, tt.extra) {
+				t.Errorf("order changed = %v, missing = %v, extra = %v", f.OrderChanged, f.Missing, f.Extra)
+			}
+		})
+	}
+}
+
+func TestCompareSkipped(t *testing.T) {
+	current := Fields{"tls.ciphers": {"a"}, "h2.settings": {"1:65536"}, "tcp.ttl": {"64"}}
+	reference := Fields{"tls.ciphers": {"a"}, "quic.fingerprint": {"CRYPTO"}, "tcp.ttl": {"128"}}
+	d := Compare(current, reference, "ref")
+	if !slices.Equal(d.Skipped, []string{"h2.settings", "quic.fingerprint"}) {
+		t.Errorf("skipped = %v", d.Skipped)
+	}
+	var fields []string
+	for _, f := range d.Fields {
+		fields = append(fields, f.Field)
+	}
+	if !slices.Equal(fields, []string{"tls.ciphers", "tcp.ttl"}) || d.Differences != 1 {
+		t.Errorf("fields = %v, differences = %d", fields, d.Differences)
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	res := types.Response{
+		TLS: &types.TLSDetails{
+			JA4:       "t13d1516h2_8daaf6152771_e5627efa2ab1",
+			JA3:       "771,4865-4866,0-23-65281,29-23,0",
+			PeetPrint: "772-771|2-1.1|29-23|1027-2052|1|2|4865-4866|0-23",
+		},
+		Http2: &types.Http2Details{
+			AkamaiFingerprint: "1:65536;4:6291456|15663105|0|m,a,s,p",
+			SendFrames: []types.ParsedFrame{
+				{Type: "SETTINGS"},
+				{Type: "HEADERS", Headers: []string{":method: GET", "user-agent: test", "accept: */*"}},
+			},
+		},
+	}
+	res.TCPIP.IP.TTL = 64
+	f := FromResponse(res)
+	want := Fields{
+		"tls.ja4":                    {"t13d1516h2", "8daaf6152771", "e5627efa2ab1"},
+		"tls.version":                {"771"},
+		"tls.ciphers":                {"4865", "4866"},
+		"tls.extensions":             {"0", "23", "65281"},
+		"tls.groups":                 {"29", "23"},
+		"tls.point_formats":          {"0"},
+		"tls.supported_versions":     {"772", "771"},
+		"tls.alpn":                   {"2", "1.1"},
+		"tls.signature_algorithms":   {"1027", "2052"},
+		"tls.psk_key_exchange_modes": {"1"},
+		"tls.cert_compression":       {"2"},
+		"h2.settings":                {"1:65536", "4:6291456"},
+		"h2.window_update":           {"15663105"},
+		"h2.priority":                {"0"},
+		"h2.pseudo_header_order":     {"m", "a", "s", "p"},
+		"http.header_order":          {"user-agent", "accept"},
+		"tcp.ttl":                    {"64"},
+	}
+	for field, values := range want {
+		if !slices.Equal(f[field], values) {
+			t.Errorf("%s = %v, want %v", field, f[field], values)
+		}
+	}
+	for field := range f {
+		if _, ok := want[field]; !ok {
+			t.Errorf("unexpected field %s = %v", field, f[field])
+		}
+	}
+
+	if f := FromResponse(types.Response{TLS: &types.TLSDetails{JA3: "771,4865"}}); len(f) != 0 {
+		t.Errorf("fields of an invalid JA3 = %v", f)
+	}
+}
+
+func TestFromKnownClient(t *testing.T) {
+	current := Fields{"tls.ja4": {"t13d1516h2", "8daaf6152771", "e5627efa2ab1"}}
+	c := clients.KnownClient{
+		JA4: []string{
+			"t13d1517h2_8daaf6152771_b1ff8ab2d16f",
+			"t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		JA3: []string{"773f6e5ff4a1d2b61d31ca1b2d8dde4e"},
+	}
+	f := FromKnownClient(c, current)
+	if !slices.Equal(f["tls.ja4"], current["tls.ja4"]) {
+		t.Errorf("tls.ja4 = %v, want the closest fingerprint", f["tls.ja4"])
+	}
+	if _, ok := f["tls.ciphers"]; ok {
+		t.Error("a JA3 hash was split into fields")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	d := Compare(
+		Fields{"tls.ciphers": {"b", "a"}, "tls.groups": {"29", "4588"}, "tcp.ttl": {"64"}, "h2.settings": {"1:1"}},
+		Fields{"tls.ciphers": {"a", "b"}, "tls.groups": {"29", "23"}, "tcp.ttl": {"64"}},
+		"chrome",
+	)
+	want := `Compared with chrome: 2 of 3 fields differ
+
+tls.ciphers: order changed
+  current:   b a
+  reference: a b
+
+tls.groups: values changed
+  missing:   23
+  extra:     4588
+  current:   29 4588
+  reference: 29 23
+
+Not compared (only one side has them): h2.settings
+`
+	if got := Format(d); got != want {
+		t.Errorf("Format() =\n%s\nwant\n%s", got, want)
+	}
+	if got := Format(Compare(Fields{}, Fields{}, "self")); !strings.HasPrefix(got, "Compared with self: 0 of 0 fields differ") {
+		t.Errorf("Format() = %q", got)
+	}
+}
@@ -0,0 +1,136 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// MaxBodySize is the amount of body data that is kept and decoded, larger bodies are truncated
+const MaxBodySize = 1 << 20
+
+// maxPartValue is the maximum size of a multipart value that is returned as text
+const maxPartValue = 4096
+
+// DecodeBody builds the body details of a request and decodes it according to its content type
+func DecodeBody(contentType string, body []byte, size int) *types.RequestBody {
+	b := &types.RequestBody{
+		Size:        size,
+		ContentType: contentType,
+		Truncated:   size > len(body),
+		Raw:         body,
+	}
+	if size == 0 {
+		return b
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var decoded interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&decoded); err == nil {
+			b.Encoding = "json"
+			b.Decoded = decoded
+			return b
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			b.Encoding = "form"
+			b.Decoded = values
+			return b
+		}
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if parts, err := decodeMultipart(body, params["boundary"]); err == nil {
+			b.Encoding = "multipart"
+			b.Decoded = parts
+			return b
+		}
+	}
+
+	if utf8.Valid(body) {
+		b.Encoding = "text"
+		b.Text = string(body)
+	} else {
+		b.Encoding = "base64"
+		b.Base64 = base64.StdEncoding.EncodeToString(body)
+	}
+	return b
+}
+
+func decodeMultipart(body []byte, boundary string) ([]types.MultipartPart, error) {
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	parts := []types.MultipartPart{}
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		part := types.MultipartPart{
+			Name:        p.FormName(),
+			FileName:    p.FileName(),
+			ContentType: p.Header.Get("Content-Type"),
+			Size:        len(data),
+		}
+		if part.FileName == "" && len(data) <= maxPartValue && utf8.Valid(data) {
+			part.Value = string(data)
+		}
+		parts = append(parts, part)
+	}
+}
+
+// GetHTTP2Body reassembles the body of a stream from its DATA frames
+func GetHTTP2Body(frames []types.ParsedFrame, stream uint32, contentType string) *types.RequestBody {
+	var body []byte
+	var dataFrames []types.DataFrameInfo
+	size, padding := 0, 0
+
+	for _, frame := range frames {
+		if frame.Type != "DATA" || frame.Stream != stream {
+			continue
+		}
+		dataFrames = append(dataFrames, types.DataFrameInfo{
+			Length:    frame.Length,
+			Data:      len(frame.Payload),
+			Padding:   frame.Padding,
+			EndStream: hasFlag(frame, "EndStream (0x1)"),
+		})
+		size += len(frame.Payload)
+		padding += frame.Padding
+		if room := MaxBodySize - len(body); room > 0 {
+			if len(frame.Payload) > room {
+				body = append(body, frame.Payload[:room]...)
+			} else {
+				body = append(body, frame.Payload...)
+			}
+		}
+	}
+	if dataFrames == nil {
+		return nil
+	}
+
+	b := DecodeBody(contentType, body, size)
+	b.DataFrames = dataFrames
+	b.Padding = padding
+	return b
+}
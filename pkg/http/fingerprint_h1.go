@@ -0,0 +1,133 @@
+package http
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// splitHTTP1Lines splits a request head into its lines and their line endings ("CRLF" or "LF")
+func splitHTTP1Lines(head []byte) ([]string, []string) {
+	var lines, endings []string
+	for len(head) > 0 {
+		i := bytes.IndexByte(head, '\n')
+		if i == -1 {
+			lines = append(lines, string(head))
+			endings = append(endings, "")
+			break
+		}
+		line := head[:i]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			lines = append(lines, string(line[:len(line)-1]))
+			endings = append(endings, "CRLF")
+		} else {
+			lines = append(lines, string(line))
+			endings = append(endings, "LF")
+		}
+		head = head[i+1:]
+	}
+	return lines, endings
+}
+
+// ParseHTTP1HeaderFields parses the header fields of a raw request head exactly as they were sent,
+// and flags the formatting anomalies that normal HTTP/1 clients don't produce
+func ParseHTTP1HeaderFields(head []byte) ([]types.Http1HeaderField, []string) {
+	fields := []types.Http1HeaderField{}
+	anomalies := []string{}
+	flagged := map[string]bool{}
+	flag := func(anomaly string) {
+		if !flagged[anomaly] {
+			flagged[anomaly] = true
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	lines, endings := splitHTTP1Lines(head)
+	var crlf, lf bool
+	for i, line := range lines {
+		switch endings[i] {
+		case "CRLF":
+			crlf = true
+		case "LF":
+			lf = true
+		}
+		// The request line is handled by parseHTTP1, the headers end with the empty line
+		if i == 0 {
+			continue
+		}
+		if line == "" {
+			break
+		}
+
+		// obs-fold: the line continues the value of the previous header
+		// https://www.rfc-editor.org/rfc/rfc9112#section-5.2
+		if line[0] == ' ' || line[0] == '\t' {
+			flag("obs_fold")
+			if len(fields) > 0 {
+				f := &fields[len(fields)-1]
+				f.Value += " " + strings.TrimSpace(line)
+				f.Folded = true
+			}
+			continue
+		}
+
+		f := types.Http1HeaderField{LineEnding: endings[i]}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			flag("missing_colon")
+			f.Name = line
+			fields = append(fields, f)
+			continue
+		}
+		f.Name = strings.TrimRight(name, " \t")
+		f.BeforeColon = name[len(f.Name):]
+		trimmed := strings.TrimLeft(value, " \t")
+		f.AfterColon = value[:len(value)-len(trimmed)]
+		f.Value = strings.TrimRight(trimmed, " \t")
+		f.Trailing = trimmed[len(f.Value):]
+
+		if f.BeforeColon != "" {
+			flag("whitespace_before_colon")
+		}
+		if f.Trailing != "" {
+			flag("trailing_whitespace")
+		}
+		fields = append(fields, f)
+	}
+
+	if lf {
+		flag("bare_lf")
+		if crlf {
+			flag("mixed_line_endings")
+		}
+	}
+
+	seen := map[string]bool{}
+	hasHost := false
+	for _, f := range fields {
+		name := strings.ToLower(f.Name)
+		if name == "host" {
+			hasHost = true
+		}
+		if seen[name] {
+			flag("duplicate_header: " + name)
+		}
+		seen[name] = true
+	}
+	if !hasHost {
+		flag("missing_host")
+	}
+	return fields, anomalies
+}
+
+// GetHTTP1HeaderOrder is the order of the header names, with the casing the client used
+func GetHTTP1HeaderOrder(fields []types.Http1HeaderField) (string, string) {
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		names = append(names, f.Name)
+	}
+	order := strings.Join(names, ",")
+	return order, utils.GetMD5Hash(order)
+}
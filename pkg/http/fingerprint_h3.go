@@ -23,7 +23,64 @@ func GetHTTP3SettingName(id uint64) string {
 		return "SETTINGS_H3_DATAGRAM"
 	default:
 		// Check if it's a GREASE value (0x1f * N + 0x21)
-		if (id-0x21)%0x1f == 0 {
+		if isHTTP3Grease(id) {
+			return "GREASE"
+		}
+		return fmt.Sprintf("UNKNOWN_%d", id)
+	}
+}
+
+// isHTTP3Grease checks for the reserved 0x1f * N + 0x21 values used for frame types, stream types and settings
+func isHTTP3Grease(id uint64) bool {
+	return id >= 0x21 && (id-0x21)%0x1f == 0
+}
+
+// GetHTTP3FrameName returns the name of an HTTP/3 frame type
+// https://www.rfc-editor.org/rfc/rfc9114#section-11.2.1
+func GetHTTP3FrameName(id uint64) string {
+	switch id {
+	case 0x0:
+		return "DATA"
+	case 0x1:
+		return "HEADERS"
+	case 0x3:
+		return "CANCEL_PUSH"
+	case 0x4:
+		return "SETTINGS"
+	case 0x5:
+		return "PUSH_PROMISE"
+	case 0x7:
+		return "GOAWAY"
+	case 0xd:
+		return "MAX_PUSH_ID"
+	case 0xf0700:
+		return "PRIORITY_UPDATE"
+	case 0xf0701:
+		return "PRIORITY_UPDATE_PUSH"
+	case 0x2, 0x6, 0x8, 0x9:
+		// HTTP/2 frame types without an HTTP/3 equivalent
+		return fmt.Sprintf("RESERVED_H2_%d", id)
+	default:
+		if isHTTP3Grease(id) {
+			return "GREASE"
+		}
+		return fmt.Sprintf("UNKNOWN_%d", id)
+	}
+}
+
+// GetHTTP3StreamTypeName returns the name of a unidirectional stream type
+func GetHTTP3StreamTypeName(id uint64) string {
+	switch id {
+	case 0x0:
+		return "CONTROL"
+	case 0x1:
+		return "PUSH"
+	case 0x2:
+		return "QPACK_ENCODER"
+	case 0x3:
+		return "QPACK_DECODER"
+	default:
+		if isHTTP3Grease(id) {
 			return "GREASE"
 		}
 		return fmt.Sprintf("UNKNOWN_%d", id)
@@ -0,0 +1,205 @@
+package http
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// quicIntegerParameters are the transport parameters whose value is part of the fingerprint, the others
+// (like connection IDs) differ between connections so only their ID is
+var quicIntegerParameters = map[uint64]bool{
+	0x01: true, // max_idle_timeout
+	0x03: true, // max_udp_payload_size
+	0x04: true, // initial_max_data
+	0x05: true, // initial_max_stream_data_bidi_local
+	0x06: true, // initial_max_stream_data_bidi_remote
+	0x07: true, // initial_max_stream_data_uni
+	0x08: true, // initial_max_streams_bidi
+	0x09: true, // initial_max_streams_uni
+	0x0a: true, // ack_delay_exponent
+	0x0b: true, // max_ack_delay
+	0x0e: true, // active_connection_id_limit
+	0x20: true, // max_datagram_frame_size
+}
+
+// GetQUICTransportParameters returns the transport parameters of the quic_transport_parameters extension
+// (as hex) sorted by ID, "id:value" for the ones in quicIntegerParameters and "GREASE" for reserved IDs.
+// greaseLength is the encoded size of the reserved ones, clients give them a random length.
+func GetQUICTransportParameters(data string) (entries []string, greaseLength int) {
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, 0
+	}
+	type param struct {
+		id    uint64
+		entry string
+	}
+	var params []param
+	for len(b) > 0 {
+		start := b
+		id, n := readQUICVarint(b)
+		if n == 0 {
+			break
+		}
+		b = b[n:]
+		length, n := readQUICVarint(b)
+		if n == 0 || uint64(len(b)-n) < length {
+			break
+		}
+		value := b[n : n+int(length)]
+		size := len(start) - len(b) + n + int(length)
+		b = b[n+int(length):]
+
+		switch {
+		case id%31 == 27:
+			params = append(params, param{id, "GREASE"})
+			greaseLength += size
+		case quicIntegerParameters[id]:
+			v, _ := readQUICVarint(value)
+			params = append(params, param{id, fmt.Sprintf("%d:%d", id, v)})
+		default:
+			params = append(params, param{id, fmt.Sprint(id)})
+		}
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		gi, gj := params[i].entry == "GREASE", params[j].entry == "GREASE"
+		if gi || gj {
+			return gj && !gi
+		}
+		return params[i].id < params[j].id
+	})
+	entries = []string{}
+	for _, p := range params {
+		entries = append(entries, p.entry)
+	}
+	return entries, greaseLength
+}
+
+// readQUICVarint reads a variable-length integer (RFC 9000, section 16), n is 0 if b is too short
+func readQUICVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// cryptoRanges are the received parts of the CRYPTO stream, sorted and merged
+type cryptoRanges [][2]int64
+
+// contains reports whether [start, end) was received already
+func (r cryptoRanges) contains(start, end int64) bool {
+	for _, rg := range r {
+		if start >= rg[0] && end <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r cryptoRanges) add(start, end int64) cryptoRanges {
+	r = append(r, [2]int64{start, end})
+	sort.Slice(r, func(i, j int) bool { return r[i][0] < r[j][0] })
+	merged := r[:1]
+	for _, rg := range r[1:] {
+		last := &merged[len(merged)-1]
+		if rg[0] <= last[1] {
+			last[1] = max(last[1], rg[1])
+		} else {
+			merged = append(merged, rg)
+		}
+	}
+	return merged
+}
+
+func (r cryptoRanges) length() int64 {
+	var n int64
+	for _, rg := range r {
+		n += rg[1] - rg[0]
+	}
+	return n
+}
+
+// isACKOnly reports whether a packet only acknowledges packets of the server
+func isACKOnly(p types.QUICInitialPacket) bool {
+	for _, f := range p.Frames {
+		if f != "ACK" {
+			return false
+		}
+	}
+	return true
+}
+
+// GetQUICFingerprint marks retransmitted Initial packets, fills in the crypto frame statistics and
+// summarizes what doesn't change between connections of a client:
+//
+//	frame-types|transport-parameters|crypto-length
+//
+// frame-types are the sorted frame types of the first Initial packet, retransmitted and ACK-only packets
+// are skipped. transportParameters is the quic_transport_parameters extension as hex, see
+// GetQUICTransportParameters. crypto-length is the size of the CRYPTO data, the ClientHello, without the
+// GREASE transport parameters.
+func GetQUICFingerprint(d *types.QUICDetails, transportParameters string) {
+	var greaseLength int
+	d.TransportParameters, greaseLength = GetQUICTransportParameters(transportParameters)
+	d.CryptoPackets, d.CryptoFrames, d.CryptoReordered = 0, 0, false
+
+	var received cryptoRanges
+	var end int64
+	var first *types.QUICInitialPacket
+	for i := range d.InitialPackets {
+		p := &d.InitialPackets[i]
+		p.Retransmitted = false
+		newData := false
+		for _, c := range p.Crypto {
+			if received.contains(c.Offset, c.Offset+c.Length) {
+				continue
+			}
+			newData = true
+			d.CryptoFrames++
+			// Retransmitted data ends before end, only skipping ahead means the frames were reordered
+			if c.Offset > end {
+				d.CryptoReordered = true
+			}
+			end = max(end, c.Offset+c.Length)
+			received = received.add(c.Offset, c.Offset+c.Length)
+		}
+		if len(p.Crypto) > 0 && !newData {
+			p.Retransmitted = true
+			continue
+		}
+		if newData {
+			d.CryptoPackets++
+		}
+		if !isACKOnly(*p) && (first == nil || p.PacketNumber < first.PacketNumber) {
+			first = p
+		}
+	}
+	d.CryptoLength = received.length()
+
+	var frames []string
+	if first != nil {
+		frames = slices.Clone(first.Frames)
+		slices.Sort(frames)
+		frames = slices.Compact(frames)
+	}
+	d.Fingerprint = strings.Join([]string{
+		strings.Join(frames, ","),
+		strings.Join(d.TransportParameters, "-"),
+		fmt.Sprint(d.CryptoLength - int64(greaseLength)),
+	}, "|")
+	d.FingerprintHash = utils.GetMD5Hash(d.Fingerprint)
+}
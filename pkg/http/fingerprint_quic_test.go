@@ -0,0 +1,69 @@
+package http
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestGetQUICTransportParameters(t *testing.T) {
+	// max_idle_timeout 30000, GREASE (0x1b) with 3 bytes, initial_source_connection_id, max_udp_payload_size 1472
+	data := "010480007530" + "1b03aabbcc" + "0f0401020304" + "030245c0"
+	entries, greaseLength := GetQUICTransportParameters(data)
+	want := []string{"1:30000", "3:1472", "15", "GREASE"}
+	if !slices.Equal(entries, want) {
+		t.Errorf("entries = %v, want %v", entries, want)
+	}
+	if greaseLength != 5 {
+		t.Errorf("greaseLength = %d, want 5", greaseLength)
+	}
+
+	entries, _ = GetQUICTransportParameters("0104")
+	if len(entries) != 0 {
+		t.Errorf("truncated parameters = %v, want none", entries)
+	}
+}
+
+func TestGetQUICFingerprint(t *testing.T) {
+	packets := func() []types.QUICInitialPacket {
+		return []types.QUICInitialPacket{
+			{PacketNumber: 0, Frames: []string{"CRYPTO", "PING", "CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 500, Length: 700}, {Offset: 0, Length: 500}}},
+			{PacketNumber: 1, Frames: []string{"CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 1200, Length: 300}}},
+			{PacketNumber: 2, Frames: []string{"ACK"}},
+		}
+	}
+	d := &types.QUICDetails{InitialPackets: packets()}
+	GetQUICFingerprint(d, "010480007530")
+	if d.Fingerprint != "CRYPTO,PING|1:30000|1500" {
+		t.Errorf("fingerprint = %q", d.Fingerprint)
+	}
+	if !d.CryptoReordered || d.CryptoPackets != 2 || d.CryptoFrames != 3 || d.CryptoLength != 1500 {
+		t.Errorf("crypto = reordered %v, packets %d, frames %d, length %d", d.CryptoReordered, d.CryptoPackets, d.CryptoFrames, d.CryptoLength)
+	}
+
+	// A retransmission of the first packet doesn't change the fingerprint or the statistics
+	retransmitted := packets()
+	retransmitted = append(retransmitted, types.QUICInitialPacket{
+		PacketNumber: 3, Frames: []string{"ACK", "CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 0, Length: 1200}},
+	})
+	r := &types.QUICDetails{InitialPackets: retransmitted}
+	GetQUICFingerprint(r, "010480007530")
+	if r.Fingerprint != d.Fingerprint || r.CryptoFrames != d.CryptoFrames || r.CryptoPackets != d.CryptoPackets {
+		t.Errorf("retransmission changed the fingerprint to %q", r.Fingerprint)
+	}
+	if !r.InitialPackets[3].Retransmitted || r.InitialPackets[1].Retransmitted {
+		t.Error("wrong packet marked as retransmitted")
+	}
+
+	// In order data isn't reordered, even when it is retransmitted
+	inOrder := &types.QUICDetails{InitialPackets: []types.QUICInitialPacket{
+		{PacketNumber: 0, Frames: []string{"CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 0, Length: 1000}}},
+		{PacketNumber: 1, Frames: []string{"CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 0, Length: 1000}}},
+		{PacketNumber: 2, Frames: []string{"CRYPTO"}, Crypto: []types.QUICCryptoFrame{{Offset: 800, Length: 400}}},
+	}}
+	GetQUICFingerprint(inOrder, "")
+	if inOrder.CryptoReordered || inOrder.CryptoLength != 1200 {
+		t.Errorf("reordered = %v, length = %d", inOrder.CryptoReordered, inOrder.CryptoLength)
+	}
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"unicode"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// HTTP2PingData is the opaque data of the n-th PING sent by the server
+func HTTP2PingData(n int) [8]byte {
+	data := [8]byte{'t', 'r', 'a', 'c', 'k', 'm', 'e'}
+	data[7] = byte(n)
+	return data
+}
+
+// GetHTTP2Pings matches the client's PING ACKs with the PINGs we sent, and collects the PINGs the client sent itself.
+func GetHTTP2Pings(frames []types.ParsedFrame, sent []types.Http2Ping) *types.Http2PingDetails {
+	details := &types.Http2PingDetails{
+		Sent:        sent,
+		ClientPings: []types.Http2ClientPing{},
+	}
+	if details.Sent == nil {
+		details.Sent = []types.Http2Ping{}
+	}
+	seenHeaders := false
+
+	for i, frame := range frames {
+		switch frame.Type {
+		case "HEADERS":
+			seenHeaders = true
+		case "PING":
+			data := hex.EncodeToString(frame.Payload)
+			if !hasFlag(frame, "Ack (0x1)") {
+				details.ClientPings = append(details.ClientPings, types.Http2ClientPing{
+					Index:        i,
+					Data:         data,
+					AfterHeaders: seenHeaders,
+				})
+				continue
+			}
+			for j := range details.Sent {
+				ping := &details.Sent[j]
+				if ping.Acked || ping.Data != data {
+					continue
+				}
+				ping.Acked = true
+				ping.AckIndex = i
+				ping.RTTMs = float64(frame.ReceivedAt.Sub(ping.SentAt).Microseconds()) / 1000
+				if details.MinRTTMs == 0 || ping.RTTMs < details.MinRTTMs {
+					details.MinRTTMs = ping.RTTMs
+				}
+				break
+			}
+		}
+	}
+
+	details.ClientPingPattern = getPingPattern(frames)
+	return details
+}
+
+// getPingPattern classifies the opaque data the client uses for its own PINGs
+func getPingPattern(frames []types.ParsedFrame) string {
+	var payloads [][]byte
+	for _, frame := range frames {
+		if frame.Type == "PING" && !hasFlag(frame, "Ack (0x1)") && len(frame.Payload) == 8 {
+			payloads = append(payloads, frame.Payload)
+		}
+	}
+	if len(payloads) == 0 {
+		return ""
+	}
+
+	zero, constant, counter, ascii := true, true, true, true
+	for i, p := range payloads {
+		v := binary.BigEndian.Uint64(p)
+		if v != 0 {
+			zero = false
+		}
+		if !bytes.Equal(p, payloads[0]) {
+			constant = false
+		}
+		if i > 0 && v != binary.BigEndian.Uint64(payloads[i-1])+1 {
+			counter = false
+		}
+		for _, b := range p {
+			if b > unicode.MaxASCII || !unicode.IsPrint(rune(b)) {
+				ascii = false
+			}
+		}
+	}
+	// A single PING can only look like a counter if its value is small
+	if len(payloads) == 1 && binary.BigEndian.Uint64(payloads[0]) > 0xffff {
+		counter = false
+	}
+
+	switch {
+	case zero:
+		return "zero"
+	case ascii:
+		return "ascii"
+	case counter:
+		return "counter"
+	case constant:
+		return "constant"
+	default:
+		return "random"
+	}
+}
@@ -0,0 +1,424 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	errQPACKBlockedTimeout = errors.New("timed out waiting for QPACK dynamic table entries")
+	errQPACKTooManyBlocked = errors.New("too many blocked QPACK streams")
+)
+
+// qpackEntryOverhead is added to the length of name and value for the size of a dynamic table entry
+const qpackEntryOverhead = 32
+
+// QPACKDecoder decodes field sections that refer to the dynamic table the client builds with the
+// instructions on its encoder stream. It is safe for concurrent use.
+// https://www.rfc-editor.org/rfc/rfc9204#section-3.2
+type QPACKDecoder struct {
+	maxCapacity uint64
+	maxBlocked  int
+
+	mu       sync.Mutex
+	capacity uint64
+	size     uint64
+	// entries are the dynamic table, oldest first
+	entries []qpack.HeaderField
+	// inserted is the insert count, acked the known received count of the client
+	inserted uint64
+	acked    uint64
+	blocked  int
+	// updated is closed and replaced after every insert
+	updated chan struct{}
+}
+
+// NewQPACKDecoder returns a decoder for the SETTINGS_QPACK_MAX_TABLE_CAPACITY and
+// SETTINGS_QPACK_BLOCKED_STREAMS the server sent
+func NewQPACKDecoder(maxCapacity uint64, maxBlocked int) *QPACKDecoder {
+	return &QPACKDecoder{maxCapacity: maxCapacity, maxBlocked: maxBlocked, updated: make(chan struct{})}
+}
+
+// qpackReader is a field section or the encoder stream
+type qpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readQPACKIntFrom reads a prefixed integer whose first byte was already read
+// https://www.rfc-editor.org/rfc/rfc7541#section-5.1
+func readQPACKIntFrom(r io.ByteReader, first byte, n uint8) (uint64, error) {
+	max := uint64(1)<<n - 1
+	i := uint64(first) & max
+	if i < max {
+		return i, nil
+	}
+	for m := uint(0); m < 63; m += 7 {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, errQPACKTruncated
+		} else if err != nil {
+			return 0, err
+		}
+		i += uint64(c&0x7f) << m
+		if c&0x80 == 0 {
+			return i, nil
+		}
+	}
+	return 0, errors.New("QPACK integer overflow")
+}
+
+// readQPACKStringFrom reads a string literal with an n-bit length prefix whose first byte was already read
+func readQPACKStringFrom(r qpackReader, first byte, n uint8, maxLength uint64) (string, error) {
+	l, err := readQPACKIntFrom(r, first, n)
+	if err != nil {
+		return "", err
+	}
+	if l > maxLength {
+		return "", fmt.Errorf("QPACK string of %d bytes too long", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", errQPACKTruncated
+		}
+		return "", err
+	}
+	if first&(1<<n) != 0 {
+		return hpack.HuffmanDecodeToString(b)
+	}
+	return string(b), nil
+}
+
+// readQPACKValue reads a value string, it starts on a byte of its own
+func readQPACKValue(r qpackReader, maxLength uint64) (string, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return "", errQPACKTruncated
+	}
+	return readQPACKStringFrom(r, first, 7, maxLength)
+}
+
+func staticEntry(i uint64) (qpack.HeaderField, error) {
+	if i >= uint64(len(qpackStaticTable)) {
+		return qpack.HeaderField{}, fmt.Errorf("invalid QPACK static index %d", i)
+	}
+	return qpackStaticTable[i], nil
+}
+
+// entry returns the dynamic table entry with an absolute index, the caller holds mu
+func (d *QPACKDecoder) entry(abs uint64) (qpack.HeaderField, error) {
+	first := d.inserted - uint64(len(d.entries))
+	if abs < first || abs >= d.inserted {
+		return qpack.HeaderField{}, fmt.Errorf("invalid QPACK dynamic index %d", abs)
+	}
+	return d.entries[abs-first], nil
+}
+
+// evict drops the oldest entries until size fits, the caller holds mu
+func (d *QPACKDecoder) evict(size uint64) {
+	for d.size > size && len(d.entries) > 0 {
+		e := d.entries[0]
+		d.size -= uint64(len(e.Name)+len(e.Value)) + qpackEntryOverhead
+		d.entries = d.entries[1:]
+	}
+}
+
+func (d *QPACKDecoder) insert(f qpack.HeaderField) error {
+	size := uint64(len(f.Name)+len(f.Value)) + qpackEntryOverhead
+	if size > d.capacity {
+		return fmt.Errorf("QPACK entry of %d bytes exceeds the capacity of %d", size, d.capacity)
+	}
+	d.evict(d.capacity - size)
+	d.entries = append(d.entries, f)
+	d.size += size
+	d.inserted++
+	close(d.updated)
+	d.updated = make(chan struct{})
+	return nil
+}
+
+// ReadEncoderStream applies the instructions of the encoder stream until it ends. ack is called with the
+// Insert Count Increment whenever the instructions received so far are applied.
+// https://www.rfc-editor.org/rfc/rfc9204#section-4.3
+func (d *QPACKDecoder) ReadEncoderStream(r *bufio.Reader, ack func(increment uint64)) error {
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := d.readEncoderInstruction(r, b); err != nil {
+			return err
+		}
+		if r.Buffered() > 0 {
+			continue
+		}
+		d.mu.Lock()
+		increment := d.inserted - d.acked
+		d.acked = d.inserted
+		d.mu.Unlock()
+		if increment > 0 {
+			ack(increment)
+		}
+	}
+}
+
+func (d *QPACKDecoder) readEncoderInstruction(r qpackReader, b byte) error {
+	switch {
+	case b&0x80 != 0: // 1Txxxxxx: insert with name reference
+		i, err := readQPACKIntFrom(r, b, 6)
+		if err != nil {
+			return err
+		}
+		value, err := readQPACKValue(r, d.maxCapacity)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var name qpack.HeaderField
+		if b&0x40 != 0 {
+			name, err = staticEntry(i)
+		} else if i < d.inserted {
+			name, err = d.entry(d.inserted - 1 - i)
+		} else {
+			err = fmt.Errorf("invalid QPACK relative index %d", i)
+		}
+		if err != nil {
+			return err
+		}
+		return d.insert(qpack.HeaderField{Name: name.Name, Value: value})
+	case b&0xc0 == 0x40: // 01Hxxxxx: insert with literal name
+		name, err := readQPACKStringFrom(r, b, 5, d.maxCapacity)
+		if err != nil {
+			return err
+		}
+		value, err := readQPACKValue(r, d.maxCapacity)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.insert(qpack.HeaderField{Name: name, Value: value})
+	case b&0xe0 == 0x20: // 001xxxxx: set dynamic table capacity
+		capacity, err := readQPACKIntFrom(r, b, 5)
+		if err != nil {
+			return err
+		}
+		if capacity > d.maxCapacity {
+			return fmt.Errorf("QPACK capacity %d exceeds the maximum of %d", capacity, d.maxCapacity)
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.capacity = capacity
+		d.evict(capacity)
+		return nil
+	default: // 000xxxxx: duplicate
+		i, err := readQPACKIntFrom(r, b, 5)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if i >= d.inserted {
+			return fmt.Errorf("invalid QPACK relative index %d", i)
+		}
+		e, err := d.entry(d.inserted - 1 - i)
+		if err != nil {
+			return err
+		}
+		return d.insert(e)
+	}
+}
+
+// requiredInsertCount decodes the Required Insert Count of a field section prefix, the caller holds mu
+// https://www.rfc-editor.org/rfc/rfc9204#section-4.5.1.1
+func (d *QPACKDecoder) requiredInsertCount(encoded uint64) (uint64, error) {
+	if encoded == 0 {
+		return 0, nil
+	}
+	maxEntries := d.maxCapacity / qpackEntryOverhead
+	fullRange := 2 * maxEntries
+	if encoded > fullRange {
+		return 0, errors.New("invalid QPACK required insert count")
+	}
+	maxValue := d.inserted + maxEntries
+	ric := maxValue/fullRange*fullRange + encoded - 1
+	if ric > maxValue {
+		if ric <= fullRange {
+			return 0, errors.New("invalid QPACK required insert count")
+		}
+		ric -= fullRange
+	}
+	if ric == 0 {
+		return 0, errors.New("invalid QPACK required insert count")
+	}
+	return ric, nil
+}
+
+// Decode decodes a field section, waiting up to timeout for the dynamic table entries it needs.
+// It returns whether the section has to be acknowledged on the decoder stream and whether it was blocked.
+func (d *QPACKDecoder) Decode(block []byte, timeout time.Duration) ([]qpack.HeaderField, bool, bool, error) {
+	r := bytes.NewReader(block)
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, false, false, errQPACKTruncated
+	}
+	encoded, err := readQPACKIntFrom(r, first, 8)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if first, err = r.ReadByte(); err != nil {
+		return nil, false, false, errQPACKTruncated
+	}
+	delta, err := readQPACKIntFrom(r, first, 7)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ric, err := d.requiredInsertCount(encoded)
+	if err != nil {
+		return nil, false, false, err
+	}
+	base := ric + delta
+	if first&0x80 != 0 {
+		if delta >= ric {
+			return nil, false, false, errors.New("invalid QPACK base")
+		}
+		base = ric - delta - 1
+	}
+	blocked := ric > d.inserted
+	if blocked {
+		if err := d.waitForInserts(ric, timeout); err != nil {
+			return nil, false, true, err
+		}
+	}
+
+	// dynamic checks an absolute index against the required insert count
+	dynamic := func(abs uint64, ok bool) (qpack.HeaderField, error) {
+		if !ok || abs >= ric {
+			return qpack.HeaderField{}, errors.New("invalid QPACK dynamic reference")
+		}
+		return d.entry(abs)
+	}
+	var fields []qpack.HeaderField
+	for r.Len() > 0 {
+		b, _ := r.ReadByte()
+		var f qpack.HeaderField
+		switch {
+		case b&0x80 != 0: // 1Txxxxxx: indexed field line
+			var i uint64
+			if i, err = readQPACKIntFrom(r, b, 6); err != nil {
+				break
+			}
+			if b&0x40 != 0 {
+				f, err = staticEntry(i)
+			} else {
+				f, err = dynamic(base-1-i, i < base)
+			}
+		case b&0xc0 == 0x40: // 01NTxxxx: literal field line with name reference
+			var i uint64
+			if i, err = readQPACKIntFrom(r, b, 4); err != nil {
+				break
+			}
+			if b&0x10 != 0 {
+				f, err = staticEntry(i)
+			} else {
+				f, err = dynamic(base-1-i, i < base)
+			}
+			if err == nil {
+				f.Value, err = readQPACKValue(r, uint64(len(block)))
+			}
+		case b&0xe0 == 0x20: // 001NHxxx: literal field line with literal name
+			if f.Name, err = readQPACKStringFrom(r, b, 3, uint64(len(block))); err == nil {
+				f.Value, err = readQPACKValue(r, uint64(len(block)))
+			}
+		case b&0xf0 == 0x10: // 0001xxxx: indexed field line with post-base index
+			var i uint64
+			if i, err = readQPACKIntFrom(r, b, 4); err == nil {
+				f, err = dynamic(base+i, true)
+			}
+		default: // 0000Nxxx: literal field line with post-base name reference
+			var i uint64
+			if i, err = readQPACKIntFrom(r, b, 3); err != nil {
+				break
+			}
+			if f, err = dynamic(base+i, true); err == nil {
+				f.Value, err = readQPACKValue(r, uint64(len(block)))
+			}
+		}
+		if err != nil {
+			return nil, false, blocked, err
+		}
+		fields = append(fields, f)
+	}
+	if ric > d.acked {
+		d.acked = ric
+	}
+	return fields, ric > 0, blocked, nil
+}
+
+// waitForInserts waits until the insert count reaches ric, the caller holds mu
+func (d *QPACKDecoder) waitForInserts(ric uint64, timeout time.Duration) error {
+	if d.blocked >= d.maxBlocked {
+		return errQPACKTooManyBlocked
+	}
+	d.blocked++
+	defer func() { d.blocked-- }()
+	deadline := time.After(timeout)
+	for d.inserted < ric {
+		updated := d.updated
+		d.mu.Unlock()
+		select {
+		case <-updated:
+			d.mu.Lock()
+		case <-deadline:
+			d.mu.Lock()
+			return errQPACKBlockedTimeout
+		}
+	}
+	return nil
+}
+
+// Inserts returns the capacity the client set for the dynamic table and its insert count
+func (d *QPACKDecoder) Inserts() (uint64, uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.capacity, d.inserted
+}
+
+// appendQPACKInt appends a prefixed integer, flags are the bits above the n-bit prefix
+func appendQPACKInt(b []byte, n uint8, flags byte, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(b, flags|byte(i))
+	}
+	b = append(b, flags|byte(max))
+	for i -= max; i >= 0x80; i >>= 7 {
+		b = append(b, byte(i&0x7f)|0x80)
+	}
+	return append(b, byte(i))
+}
+
+// AppendQPACKSectionAck appends a Section Acknowledgment for a request stream to the decoder stream
+// https://www.rfc-editor.org/rfc/rfc9204#section-4.4
+func AppendQPACKSectionAck(b []byte, streamID uint64) []byte {
+	return appendQPACKInt(b, 7, 0x80, streamID)
+}
+
+// AppendQPACKInsertCountIncrement appends an Insert Count Increment to the decoder stream
+func AppendQPACKInsertCountIncrement(b []byte, increment uint64) []byte {
+	return appendQPACKInt(b, 6, 0x00, increment)
+}
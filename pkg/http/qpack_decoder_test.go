@@ -0,0 +1,257 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"golang.org/x/net/http2/hpack"
+)
+
+// literal appends a string literal with an n-bit length prefix, Huffman encoded if huffman is set
+func literal(b []byte, n uint8, flags byte, s string, huffman bool) []byte {
+	if huffman {
+		return append(appendQPACKInt(b, n, flags|1<<n, hpack.HuffmanEncodeLength(s)), hpack.AppendHuffmanString(nil, s)...)
+	}
+	return append(appendQPACKInt(b, n, flags, uint64(len(s))), s...)
+}
+
+// testEncoderStream sets the capacity to 220 and inserts x-a: 1, :authority: example.com and a duplicate of x-a: 1
+func testEncoderStream() []byte {
+	b := appendQPACKInt(nil, 5, 0x20, 220)
+	b = literal(literal(b, 5, 0x40, "x-a", true), 7, 0, "1", false)
+	b = literal(appendQPACKInt(b, 6, 0xc0, 0), 7, 0, "example.com", true)
+	return appendQPACKInt(b, 5, 0x00, 1)
+}
+
+func newTestDecoder(t *testing.T, maxBlocked int) *QPACKDecoder {
+	t.Helper()
+	d := NewQPACKDecoder(220, maxBlocked)
+	var acked uint64
+	if err := d.ReadEncoderStream(bufio.NewReader(bytes.NewReader(testEncoderStream())), func(i uint64) { acked += i }); err != nil {
+		t.Fatal(err)
+	}
+	if acked != 3 {
+		t.Fatalf("acknowledged %d inserts, want 3", acked)
+	}
+	return d
+}
+
+func TestQPACKDecodeStatic(t *testing.T) {
+	want := []qpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":scheme", Value: "https"},
+		{Name: "user-agent", Value: "test"},
+		{Name: "x-custom", Value: "value"},
+	}
+	var block bytes.Buffer
+	enc := qpack.NewEncoder(&block)
+	for _, f := range want {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fields, ack, blocked, err := NewQPACKDecoder(0, 0).Decode(block.Bytes(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+	if ack || blocked {
+		t.Errorf("ack = %v, blocked = %v for a section without dynamic references", ack, blocked)
+	}
+}
+
+func TestQPACKDecodeDynamic(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+		want  []qpack.HeaderField
+		err   bool
+	}{
+		{
+			// Required Insert Count 3 encoded as 3 % 12 + 1, base 3
+			name:  "relative indices",
+			block: literal(literal([]byte{0x04, 0x00, 0x80, 0xd1, 0x41, 0x01, 'b'}, 3, 0x20, "x-b", false), 7, 0, "2", false),
+			want: []qpack.HeaderField{
+				{Name: "x-a", Value: "1"},
+				{Name: ":method", Value: "GET"},
+				{Name: ":authority", Value: "b"},
+				{Name: "x-b", Value: "2"},
+			},
+		},
+		{
+			// base 1 = 3 - 1 - 1
+			name:  "post-base indices",
+			block: []byte{0x04, 0x81, 0x10, 0x11, 0x00, 0x01, 'c'},
+			want: []qpack.HeaderField{
+				{Name: ":authority", Value: "example.com"},
+				{Name: "x-a", Value: "1"},
+				{Name: ":authority", Value: "c"},
+			},
+		},
+		{
+			name:  "index above the required insert count",
+			block: []byte{0x03, 0x00, 0x10},
+			err:   true,
+		},
+		{
+			name:  "invalid static index",
+			block: []byte{0x00, 0x00, 0xff, 0x30},
+			err:   true,
+		},
+		{
+			name:  "negative base",
+			block: []byte{0x04, 0x83, 0x10},
+			err:   true,
+		},
+		{
+			name:  "required insert count out of range",
+			block: []byte{0x0e, 0x00},
+			err:   true,
+		},
+		{
+			name:  "truncated value",
+			block: []byte{0x00, 0x00, 0x5f, 0x01, 0x05, 'a'},
+			err:   true,
+		},
+		{
+			name:  "truncated prefix",
+			block: []byte{0x04},
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, _, _, err := newTestDecoder(t, 1).Decode(tt.block, time.Second)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Decode() = %v, want an error", fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(fields, tt.want) {
+				t.Errorf("fields = %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestQPACKDecodeBlocked(t *testing.T) {
+	// Required Insert Count 4 refers to an entry that isn't inserted yet
+	block := []byte{0x05, 0x00, 0x80}
+
+	d := newTestDecoder(t, 1)
+	if _, _, blocked, err := d.Decode(block, 10*time.Millisecond); !blocked || !errors.Is(err, errQPACKBlockedTimeout) {
+		t.Errorf("Decode() = blocked %v, %v, want errQPACKBlockedTimeout", blocked, err)
+	}
+	if _, _, _, err := newTestDecoder(t, 0).Decode(block, time.Second); !errors.Is(err, errQPACKTooManyBlocked) {
+		t.Errorf("Decode() = %v, want errQPACKTooManyBlocked", err)
+	}
+
+	type result struct {
+		fields  []qpack.HeaderField
+		blocked bool
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		fields, _, blocked, err := d.Decode(block, 5*time.Second)
+		done <- result{fields, blocked, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	insert := literal(literal([]byte{}, 5, 0x40, "x-late", false), 7, 0, "yes", false)
+	if err := d.ReadEncoderStream(bufio.NewReader(bytes.NewReader(insert)), func(uint64) {}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !r.blocked || len(r.fields) != 1 || r.fields[0].Name != "x-late" {
+		t.Errorf("Decode() = %v, blocked %v", r.fields, r.blocked)
+	}
+}
+
+func TestQPACKEncoderStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   []byte
+		capacity uint64
+		inserted uint64
+		err      bool
+	}{
+		{name: "inserts", stream: testEncoderStream(), capacity: 220, inserted: 3},
+		{name: "capacity above the maximum", stream: appendQPACKInt(nil, 5, 0x20, 221), err: true},
+		{name: "insert without capacity", stream: literal(literal(nil, 5, 0x40, "x-a", false), 7, 0, "1", false), err: true},
+		{name: "invalid static name", stream: append(appendQPACKInt([]byte{0x3f, 0xa0, 0x01}, 6, 0xc0, 200), 0x00), err: true},
+		{name: "invalid duplicate", stream: []byte{0x3f, 0xa0, 0x01, 0x00}, err: true},
+		{name: "truncated", stream: []byte{0x3f, 0xa0, 0x01, 0x43, 'x'}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewQPACKDecoder(220, 1)
+			err := d.ReadEncoderStream(bufio.NewReader(bytes.NewReader(tt.stream)), func(uint64) {})
+			if tt.err {
+				if err == nil {
+					t.Fatal("ReadEncoderStream() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capacity, inserted := d.Inserts(); capacity != tt.capacity || inserted != tt.inserted {
+				t.Errorf("Inserts() = %d, %d, want %d, %d", capacity, inserted, tt.capacity, tt.inserted)
+			}
+		})
+	}
+}
+
+func TestQPACKEviction(t *testing.T) {
+	// Each entry takes 32 + 4 bytes, two fit into a capacity of 80
+	d := NewQPACKDecoder(80, 1)
+	stream := appendQPACKInt(nil, 5, 0x20, 80)
+	for _, name := range []string{"x-a", "x-b", "x-c"} {
+		stream = literal(literal(stream, 5, 0x40, name, false), 7, 0, "1", false)
+	}
+	if err := d.ReadEncoderStream(bufio.NewReader(bytes.NewReader(stream)), func(uint64) {}); err != nil {
+		t.Fatal(err)
+	}
+	// Required Insert Count 3 encoded as 3 % 4 + 1, base 3, relative index 2 is the evicted x-a
+	if _, _, _, err := d.Decode([]byte{0x04, 0x00, 0x82}, time.Second); err == nil {
+		t.Error("the evicted entry was decoded")
+	}
+	fields, _, _, err := d.Decode([]byte{0x04, 0x00, 0x81}, time.Second)
+	if err != nil || len(fields) != 1 || fields[0].Name != "x-b" {
+		t.Errorf("Decode() = %v, %v, want x-b", fields, err)
+	}
+}
+
+func TestQPACKStaticTable(t *testing.T) {
+	if len(qpackStaticTable) != 99 {
+		t.Fatalf("the static table has %d entries, want 99", len(qpackStaticTable))
+	}
+	for i, want := range map[uint64]qpack.HeaderField{
+		0:  {Name: ":authority"},
+		17: {Name: ":method", Value: "GET"},
+		31: {Name: "accept-encoding", Value: "gzip, deflate, br"},
+		98: {Name: "x-frame-options", Value: "sameorigin"},
+	} {
+		if got, err := staticEntry(i); err != nil || got != want {
+			t.Errorf("staticEntry(%d) = %v, %v, want %v", i, got, err, want)
+		}
+	}
+	if _, err := staticEntry(99); err == nil {
+		t.Error("staticEntry(99) succeeded")
+	}
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+var errQPACKTruncated = errors.New("truncated QPACK field section")
+
+// readQPACKInt reads a prefixed integer with an n-bit prefix
+func readQPACKInt(n uint8, b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, errQPACKTruncated
+	}
+	r := bytes.NewReader(b[1:])
+	i, err := readQPACKIntFrom(r, b[0], n)
+	return i, b[len(b)-r.Len():], err
+}
+
+// skipQPACKString skips a string literal with an n-bit length prefix and returns whether it is Huffman encoded
+func skipQPACKString(n uint8, b []byte) (bool, []byte, error) {
+	if len(b) == 0 {
+		return false, b, errQPACKTruncated
+	}
+	huffman := b[0]&(1<<n) != 0
+	l, b, err := readQPACKInt(n, b)
+	if err != nil {
+		return false, b, err
+	}
+	if uint64(len(b)) < l {
+		return false, b, errQPACKTruncated
+	}
+	return huffman, b[l:], nil
+}
+
+// GetQPACKDetails describes how the client encoded each field line of a HEADERS frame.
+// names are the decoded header names, in the same order as the field lines.
+// https://www.rfc-editor.org/rfc/rfc9204#section-4.5
+func GetQPACKDetails(block []byte, names []string) (*types.QPACKDetails, error) {
+	d := &types.QPACKDetails{Fields: []types.QPACKField{}}
+
+	var err error
+	if d.RequiredInsertCount, block, err = readQPACKInt(8, block); err != nil {
+		return nil, err
+	}
+	if len(block) == 0 {
+		return nil, errQPACKTruncated
+	}
+	d.DeltaBaseSign = block[0]&0x80 != 0
+	if d.DeltaBase, block, err = readQPACKInt(7, block); err != nil {
+		return nil, err
+	}
+
+	for len(block) > 0 {
+		f := types.QPACKField{}
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // 1Txxxxxx: indexed field line
+			f.Static = b&0x40 != 0
+			f.Representation = "indexed"
+			f.Index, block, err = readQPACKInt(6, block)
+		case b&0xc0 == 0x40: // 01NTxxxx: literal field line with name reference
+			f.NeverIndexed = b&0x20 != 0
+			f.Static = b&0x10 != 0
+			f.Representation = "literal_name_ref"
+			if f.Index, block, err = readQPACKInt(4, block); err == nil {
+				f.ValueHuffman, block, err = skipQPACKString(7, block)
+			}
+		case b&0xe0 == 0x20: // 001NHxxx: literal field line with literal name
+			f.NeverIndexed = b&0x10 != 0
+			f.Representation = "literal"
+			if f.NameHuffman, block, err = skipQPACKString(3, block); err == nil {
+				f.ValueHuffman, block, err = skipQPACKString(7, block)
+			}
+		case b&0xf0 == 0x10: // 0001xxxx: indexed field line with post-base index
+			f.Representation = "indexed_post_base"
+			f.Index, block, err = readQPACKInt(4, block)
+		default: // 0000Nxxx: literal field line with post-base name reference
+			f.NeverIndexed = b&0x08 != 0
+			f.Representation = "literal_post_base_name_ref"
+			if f.Index, block, err = readQPACKInt(3, block); err == nil {
+				f.ValueHuffman, block, err = skipQPACKString(7, block)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(d.Fields) < len(names) {
+			f.Name = names[len(d.Fields)]
+		}
+		d.Fields = append(d.Fields, f)
+	}
+
+	d.Fingerprint = getQPACKFingerprint(d.Fields)
+	d.FingerprintHash = utils.GetMD5Hash(d.Fingerprint)
+	return d, nil
+}
+
+// getQPACKFingerprint encodes the representation of every field line:
+// "S<index>" / "D<index>" for indexed lines (static / dynamic table), "N<index>" / "Nd<index>" for
+// literals with a name reference, "L" for literal names and "P<index>" / "Pn<index>" for post-base references.
+// "h" marks a Huffman encoded value, "H" a Huffman encoded name and "!" the never-indexed bit.
+func getQPACKFingerprint(fields []types.QPACKField) string {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		var p string
+		switch f.Representation {
+		case "indexed":
+			if f.Static {
+				p = fmt.Sprintf("S%d", f.Index)
+			} else {
+				p = fmt.Sprintf("D%d", f.Index)
+			}
+		case "literal_name_ref":
+			if f.Static {
+				p = fmt.Sprintf("N%d", f.Index)
+			} else {
+				p = fmt.Sprintf("Nd%d", f.Index)
+			}
+		case "literal":
+			p = "L"
+		case "indexed_post_base":
+			p = fmt.Sprintf("P%d", f.Index)
+		case "literal_post_base_name_ref":
+			p = fmt.Sprintf("Pn%d", f.Index)
+		}
+		if f.NameHuffman {
+			p += "H"
+		}
+		if f.ValueHuffman {
+			p += "h"
+		}
+		if f.NeverIndexed {
+			p += "!"
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, ",")
+}
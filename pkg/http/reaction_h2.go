@@ -0,0 +1,76 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func hasFlag(frame types.ParsedFrame, flag string) bool {
+	for _, f := range frame.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHTTP2ClientReaction describes how the client reacted to the server's SETTINGS, WINDOW_UPDATE and PING.
+// Only frames sent by the client are passed in, in the order they were received.
+func GetHTTP2ClientReaction(frames []types.ParsedFrame) *types.Http2ClientReaction {
+	r := &types.Http2ClientReaction{
+		SettingsAckIndex:    -1,
+		ConnectionWindow:    65535,
+		InitialStreamWindow: 65535,
+	}
+	headersIndex := -1
+
+	for i, frame := range frames {
+		switch frame.Type {
+		case "SETTINGS":
+			if hasFlag(frame, "Ack (0x1)") {
+				if !r.SettingsAck {
+					r.SettingsAck = true
+					r.SettingsAckIndex = i
+				}
+				continue
+			}
+			for _, setting := range frame.Settings {
+				parts := strings.Split(setting, " = ")
+				if len(parts) == 2 && parts[0] == "INITIAL_WINDOW_SIZE" {
+					if v, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+						r.InitialStreamWindow = v
+					}
+				}
+			}
+		case "HEADERS":
+			if headersIndex == -1 {
+				headersIndex = i
+			}
+		case "PING":
+			if hasFlag(frame, "Ack (0x1)") {
+				r.PingAck = true
+			}
+		case "WINDOW_UPDATE":
+			r.WindowUpdates = append(r.WindowUpdates, types.Http2WindowUpdate{
+				Index:     i,
+				Stream:    frame.Stream,
+				Increment: frame.Increment,
+				AfterAck:  r.SettingsAck,
+			})
+			if frame.Stream == 0 {
+				r.ConnectionWindow += int64(frame.Increment)
+			}
+		}
+		if !r.SettingsAck {
+			r.FramesBeforeAck = append(r.FramesBeforeAck, frame.Type)
+		}
+	}
+
+	r.AckBeforeHeaders = r.SettingsAck && (headersIndex == -1 || r.SettingsAckIndex < headersIndex)
+	if !r.SettingsAck {
+		r.FramesBeforeAck = nil
+	}
+	return r
+}
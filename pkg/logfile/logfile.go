@@ -0,0 +1,199 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// backupTimeFormat is the time in the name of rotated files, it sorts like the times
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// Writer appends to a file and rotates it, see types.LogRotation. It is safe for concurrent use, every
+// Write ends up in a single file.
+type Writer struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open opens path for appending, rotation is nil to never rotate it
+func Open(path string, rotation *types.LogRotation) (*Writer, error) {
+	w := &Writer{path: path}
+	if rotation != nil {
+		w.maxSize = int64(rotation.MaxSizeMB) << 20
+		w.maxAge = time.Duration(rotation.MaxAgeHours) * time.Hour
+		w.maxBackups = rotation.MaxBackups
+		w.compress = rotation.Compress
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size, w.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Path returns the file that is written to
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// Write appends p, the file is rotated before if p doesn't fit or it is too old
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize
+	tooOld := w.maxAge > 0 && time.Since(w.opened) >= w.maxAge
+	if w.size > 0 && (tooBig || tooOld) {
+		if err := w.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", w.path, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the file, compression of rotated files may still be running
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate renames the file to a backup and opens a new one
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	ext := filepath.Ext(w.path)
+	backup := strings.TrimSuffix(w.path, ext) + "-" + time.Now().Format(backupTimeFormat) + ext
+	if err := os.Rename(w.path, backup); err != nil {
+		// Keep appending to the old file rather than losing lines
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go w.finishRotation(backup)
+	return nil
+}
+
+// finishRotation compresses a backup and removes the oldest ones, it runs after the new file is open so
+// writes don't wait for it
+func (w *Writer) finishRotation(backup string) {
+	if w.compress {
+		if err := compress(backup); err != nil {
+			slog.Error("failed to compress rotated log", "file", backup, "error", err)
+		}
+	}
+	if w.maxBackups <= 0 {
+		return
+	}
+	backups, err := w.backups()
+	if err != nil {
+		slog.Error("failed to list rotated logs", "file", w.path, "error", err)
+		return
+	}
+	for len(backups) > w.maxBackups {
+		for _, file := range []string{backups[0], backups[0] + ".gz"} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				slog.Error("failed to remove rotated log", "file", file, "error", err)
+			}
+		}
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated files without ".gz", oldest first. A file that is being compressed exists
+// with and without it, so it is only returned once.
+func (w *Writer) backups() ([]string, error) {
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(w.path, ext) + "-"
+	matches, err := filepath.Glob(globEscape(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		m = strings.TrimSuffix(m, ".gz")
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	return slices.Compact(backups), nil
+}
+
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(s)
+}
+
+// compress replaces file with file.gz
+func compress(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(file+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file + ".gz")
+		return err
+	}
+	return os.Remove(file)
+}
@@ -0,0 +1,179 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// waitFor polls cond, rotated files are compressed and removed in the background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func readGzip(t *testing.T, file string) string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "requests.log")
+	w, err := Open(path, &types.LogRotation{MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// MaxSizeMB can't go below a megabyte
+	w.maxSize = 10
+
+	compressed := func(n int) func() bool {
+		return func() bool {
+			gz, _ := filepath.Glob(filepath.Join(dir, "requests-*.log.gz"))
+			plain, _ := filepath.Glob(filepath.Join(dir, "requests-*.log"))
+			return len(gz) == n && len(plain) == 0
+		}
+	}
+	for i, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		// Backups are named by the millisecond they were rotated at
+		time.Sleep(2 * time.Millisecond)
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the rotated files", compressed(min(i, 2)))
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	for i, want := range []string{"line 2\n", "line 3\n"} {
+		if got := readGzip(t, backups[i]+".gz"); got != want {
+			t.Errorf("backup %d = %q, want %q", i, got, want)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "line 4\n" {
+		t.Errorf("current file = %q, %v", data, err)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "requests.log")
+	w, err := Open(path, &types.LogRotation{MaxAgeHours: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"old\n", "new\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		w.opened = w.opened.Add(-time.Hour)
+	}
+	backups, err := w.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v, want 1", backups)
+	}
+	// Without compress the backup stays as it is
+	if data, err := os.ReadFile(backups[0]); err != nil || string(data) != "old\n" {
+		t.Errorf("backup = %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new\n" {
+		t.Errorf("current file = %q, %v", data, err)
+	}
+}
+
+func TestNoRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	w, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := w.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close() = %v, want os.ErrClosed", err)
+	}
+
+	// Opening it again appends and keeps counting the size
+	w, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.size != 15 {
+		t.Errorf("size = %d, want 15", w.size)
+	}
+	if backups, err := w.backups(); err != nil || len(backups) != 0 {
+		t.Errorf("backups = %v, %v", backups, err)
+	}
+}
+
+func TestBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"requests-2024-01-02T00-00-00.000.log.gz",
+		"requests-2024-01-01T00-00-00.000.log",
+		// Being compressed
+		"requests-2024-01-03T00-00-00.000.log",
+		"requests-2024-01-03T00-00-00.000.log.gz",
+		"requests-other.log",
+		"requests.log",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &Writer{path: filepath.Join(dir, "requests.log")}
+	backups, err := w.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "requests-2024-01-01T00-00-00.000.log"),
+		filepath.Join(dir, "requests-2024-01-02T00-00-00.000.log"),
+		filepath.Join(dir, "requests-2024-01-03T00-00-00.000.log"),
+	}
+	if !slices.Equal(backups, want) {
+		t.Errorf("backups = %v, want %v", backups, want)
+	}
+}
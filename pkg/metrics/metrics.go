@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is written in the Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// The metrics of TrackMe, labels with values chosen by clients are bounded
+var (
+	Connections       = NewCounterVec("trackme_connections_total", "Connections by protocol (h1, h2, h3).", "protocol")
+	HandshakeFailures = NewCounterVec("trackme_tls_handshake_failures_total", "Failed TLS handshakes by reason.", "reason")
+	Timeouts          = NewCounterVec("trackme_connection_timeouts_total", "Connections closed because they took too long.")
+	Panics            = NewCounterVec("trackme_panics_recovered_total", "Panics recovered in connection handlers.")
+	TCPPackets        = NewCounterVec("trackme_tcp_packets_total", "Packets stored by the TCP sniffer.")
+	RateLimited       = NewCounterVec("trackme_rate_limited_total", "Requests rejected by a rate limit, by its key.", "key")
+	RequestDuration   = NewHistogramVec("trackme_request_duration_seconds", "Time to route a request, by route and protocol.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "route", "protocol")
+	JA4s = NewTopK("trackme_ja4_requests", "Requests by the most common JA4 fingerprints since the start, the rest are \"other\".", "ja4", 20, 5000)
+)
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// labelPairs formats names and values as {name="value",...}, extra is appended as is
+func labelPairs(names, values []string, extra string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// CounterVec is a counter for each combination of label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	n      uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter of the label values, given in the order of the labels
+func (c *CounterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.Join(values, "\x00")
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: values}
+		c.values[key] = v
+	}
+	v.n++
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := c.values[k]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelPairs(c.labels, v.labels, ""), v.n)
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are scraped
+type GaugeFunc struct {
+	name, help string
+	f          func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// HistogramVec is a histogram for each combination of label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Observe adds a value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\x00")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := h.values[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, v.labels, `le="`+formatFloat(upper)+`"`), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, v.labels, `le="+Inf"`), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, v.labels, ""), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, v.labels, ""), v.count)
+	}
+}
+
+// TopK counts values, but only exposes the k most common ones. At most tracked values are counted on
+// their own, once there are that many new values are only counted as "other". It is a gauge, because
+// the "other" count drops when a value enters the top k.
+type TopK struct {
+	name, help, label string
+	k, tracked        int
+
+	mu     sync.Mutex
+	counts map[string]uint64
+	other  uint64
+}
+
+func NewTopK(name, help, label string, k, tracked int) *TopK {
+	t := &TopK{name: name, help: help, label: label, k: k, tracked: tracked, counts: map[string]uint64{}}
+	register(t)
+	return t
+}
+
+// Add counts one occurrence of value
+func (t *TopK) Add(value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[value]; ok || len(t.counts) < t.tracked {
+		t.counts[value]++
+	} else {
+		t.other++
+	}
+}
+
+func (t *TopK) write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	values := make([]string, 0, len(t.counts))
+	for v := range t.counts {
+		values = append(values, v)
+	}
+	slices.SortFunc(values, func(a, b string) int {
+		return cmp.Or(cmp.Compare(t.counts[b], t.counts[a]), strings.Compare(a, b))
+	})
+
+	writeHeader(w, t.name, t.help, "gauge")
+	other := t.other
+	for i, v := range values {
+		if i >= t.k {
+			other += t.counts[v]
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %d\n", t.name, labelPairs([]string{t.label}, []string{v}, ""), t.counts[v])
+	}
+	fmt.Fprintf(w, "%s%s %d\n", t.name, labelPairs([]string{t.label}, []string{"other"}, ""), other)
+}
+
+// Handler serves all metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		metrics := append([]metric{}, registry...)
+		registryMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
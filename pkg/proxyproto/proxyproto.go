@@ -0,0 +1,354 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoHeader = errors.New("proxy protocol: connection from a trusted proxy without a header")
+)
+
+const (
+	// headerTimeout is how long a trusted proxy has to send the header
+	headerTimeout = 10 * time.Second
+	// v1MaxLength is the longest v1 header, including "\r\n"
+	v1MaxLength = 107
+)
+
+var tlvNames = map[byte]string{
+	0x01: "ALPN",
+	0x02: "AUTHORITY",
+	0x03: "CRC32C",
+	0x04: "NOOP",
+	0x05: "UNIQUE_ID",
+	0x20: "SSL",
+	0x21: "SSL_VERSION",
+	0x22: "SSL_CN",
+	0x23: "SSL_CIPHER",
+	0x24: "SSL_SIG_ALG",
+	0x25: "SSL_KEY_ALG",
+	0x30: "NETNS",
+	0xE0: "GCP",
+	0xEA: "AWS",
+	0xEE: "AZURE",
+}
+
+// Listener reads a PROXY protocol header from connections of trusted sources
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// NewListener wraps l, only connections from trusted are expected to start with a header
+func NewListener(l net.Listener, trusted []netip.Prefix) *Listener {
+	return &Listener{Listener: l, trusted: trusted}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !utils.PrefixesContain(l.trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Conn is a connection from a trusted proxy. Its header is read by the first Read, RemoteAddr or
+// Header, so Accept doesn't wait for it.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	header     *types.ProxyProtocolDetails
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		if err := c.Conn.SetReadDeadline(time.Now().Add(headerTimeout)); err != nil {
+			c.err = err
+			return
+		}
+		c.header, c.err = ReadHeader(c.r)
+		if c.err != nil {
+			return
+		}
+		c.header.ProxyAddress = c.Conn.RemoteAddr().String()
+		if c.header.SourceAddress != "" {
+			if ap, err := netip.ParseAddrPort(c.header.SourceAddress); err == nil {
+				c.remoteAddr = net.TCPAddrFromAddrPort(ap)
+			}
+		}
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the proxy's if it had none
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// Header returns the PROXY protocol header, nil if it couldn't be read
+func (c *Conn) Header() *types.ProxyProtocolDetails {
+	c.readHeader()
+	return c.header
+}
+
+// ReadHeader reads a v1 or v2 header from r
+func ReadHeader(r *bufio.Reader) (*types.ProxyProtocolDetails, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, v1Signature):
+		return readV1(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// readV1 reads a text header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (*types.ProxyProtocolDetails, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("proxy protocol: v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	d := &types.ProxyProtocolDetails{Version: 1, Command: "PROXY"}
+	if len(fields) < 2 {
+		return nil, errors.New("proxy protocol: v1 header without protocol")
+	}
+	d.Protocol = fields[1]
+	switch d.Protocol {
+	case "UNKNOWN":
+		return d, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxy protocol: unknown v1 protocol %q", d.Protocol)
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("proxy protocol: v1 header needs 6 fields")
+	}
+
+	src, err := parseV1Address(fields[2], fields[4], d.Protocol == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Address(fields[3], fields[5], d.Protocol == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	d.SourceAddress, d.DestinationAddress = src.String(), dst.String()
+	return d, nil
+}
+
+func parseV1Address(ip, port string, ipv4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("proxy protocol: %w", err)
+	}
+	if addr.Is4() != ipv4 {
+		return netip.AddrPort{}, fmt.Errorf("proxy protocol: %s doesn't match the protocol", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("proxy protocol: invalid port %q", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// readV2 reads a binary header: the signature, version and command, family and protocol, the length of
+// the rest, the addresses and TLVs
+func readV2(r *bufio.Reader) (*types.ProxyProtocolDetails, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", header[12]>>4)
+	}
+	header = append(header, make([]byte, binary.BigEndian.Uint16(header[14:16]))...)
+	if _, err := io.ReadFull(r, header[16:]); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	d := &types.ProxyProtocolDetails{Version: 2}
+	switch header[12] & 0x0f {
+	case 0:
+		d.Command = "LOCAL"
+	case 1:
+		d.Command = "PROXY"
+	default:
+		return nil, fmt.Errorf("proxy protocol: unknown command %d", header[12]&0x0f)
+	}
+
+	family, transport := header[13]>>4, header[13]&0x0f
+	payload := header[16:]
+	var addrLength int
+	switch family {
+	case 0:
+		d.Protocol = "UNKNOWN"
+	case 1:
+		d.Protocol, addrLength = "TCP4", 12
+	case 2:
+		d.Protocol, addrLength = "TCP6", 36
+	case 3:
+		d.Protocol, addrLength = "UNIX", 216
+	default:
+		return nil, fmt.Errorf("proxy protocol: unknown address family %d", family)
+	}
+	if transport == 2 && family != 3 {
+		d.Protocol = "UDP" + d.Protocol[3:]
+	}
+	if len(payload) < addrLength {
+		return nil, errors.New("proxy protocol: header too short for its addresses")
+	}
+
+	// The addresses of LOCAL connections are ignored, they are the balancer's own
+	if d.Command == "PROXY" && (family == 1 || family == 2) {
+		ipLength := addrLength/2 - 2
+		src, _ := netip.AddrFromSlice(payload[:ipLength])
+		dst, _ := netip.AddrFromSlice(payload[ipLength : 2*ipLength])
+		d.SourceAddress = netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[2*ipLength:])).String()
+		d.DestinationAddress = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2*ipLength+2:])).String()
+	}
+
+	tlvs, err := parseTLVs(payload[addrLength:])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCRC32C(header, 16+addrLength); err != nil {
+		return nil, err
+	}
+	d.TLVs = tlvs
+	return d, nil
+}
+
+// splitTLVs calls f with the type, offset and value of every TLV in b
+func splitTLVs(b []byte, f func(t byte, offset int, value []byte) error) error {
+	for offset := 0; offset < len(b); {
+		if len(b)-offset < 3 {
+			return errors.New("proxy protocol: truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(b[offset+1:]))
+		if len(b)-offset-3 < length {
+			return errors.New("proxy protocol: truncated TLV")
+		}
+		if err := f(b[offset], offset+3, b[offset+3:offset+3+length]); err != nil {
+			return err
+		}
+		offset += 3 + length
+	}
+	return nil
+}
+
+func parseTLVs(b []byte) ([]types.ProxyTLV, error) {
+	var tlvs []types.ProxyTLV
+	err := splitTLVs(b, func(t byte, _ int, value []byte) error {
+		tlv := types.ProxyTLV{Type: int(t), Name: tlvNames[t], Value: formatValue(value)}
+		switch t {
+		case 0x20:
+			// PP2_TYPE_SSL: client flags, the certificate verification result and sub-TLVs
+			if len(value) < 5 {
+				return errors.New("proxy protocol: SSL TLV too short")
+			}
+			tlv.Value = fmt.Sprintf("client=0x%02x verify=%d", value[0], binary.BigEndian.Uint32(value[1:5]))
+			sub, err := parseTLVs(value[5:])
+			if err != nil {
+				return err
+			}
+			tlv.SubTLVs = sub
+		case 0xE0:
+			// Google Cloud: the Private Service Connect connection ID
+			if len(value) == 8 {
+				tlv.Value = strconv.FormatUint(binary.BigEndian.Uint64(value), 10)
+			}
+		case 0xEA:
+			// AWS: subtype 0x01 is the VPC endpoint ID
+			if len(value) > 1 && value[0] == 0x01 {
+				tlv.Value = string(value[1:])
+			}
+		case 0xEE:
+			// Azure: subtype 0x01 is the Private Link ID
+			if len(value) == 5 && value[0] == 0x01 {
+				tlv.Value = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(value[1:])), 10)
+			}
+		}
+		tlvs = append(tlvs, tlv)
+		return nil
+	})
+	return tlvs, err
+}
+
+// checkCRC32C verifies the CRC32C TLV, computed over the whole header with the checksum set to zero
+func checkCRC32C(header []byte, tlvStart int) error {
+	return splitTLVs(header[tlvStart:], func(t byte, offset int, value []byte) error {
+		if t != 0x03 || len(value) != 4 {
+			return nil
+		}
+		want := binary.BigEndian.Uint32(value)
+		zeroed := bytes.Clone(header)
+		copy(zeroed[tlvStart+offset:], []byte{0, 0, 0, 0})
+		if crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)) != want {
+			return errors.New("proxy protocol: CRC32C mismatch")
+		}
+		return nil
+	})
+}
+
+func formatValue(b []byte) string {
+	for _, r := range string(b) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,178 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// v2 builds a v2 header from the version/command byte, the family/protocol byte and the rest
+func v2(command, family byte, rest []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, command, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(rest)))
+	return append(h, rest...)
+}
+
+// tcp4 are the addresses 192.0.2.1:56324 -> 198.51.100.1:443
+var tcp4 = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+// withCRC appends a CRC32C TLV with the right checksum, or a wrong one
+func withCRC(command, family byte, addrs []byte, valid bool) []byte {
+	rest := append(bytes.Clone(addrs), 0x03, 0x00, 0x04, 0, 0, 0, 0)
+	h := v2(command, family, rest)
+	sum := crc32.Checksum(h, crc32.MakeTable(crc32.Castagnoli))
+	if !valid {
+		sum++
+	}
+	binary.BigEndian.PutUint32(h[len(h)-4:], sum)
+	return h
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // "version command protocol source destination"
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), want: "1 PROXY TCP4 192.0.2.1:56324 198.51.100.1:443"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), want: "1 PROXY TCP6 [2001:db8::1]:56324 [2001:db8::2]:443"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n"), want: "1 PROXY UNKNOWN  "},
+		{name: "v1 mismatched family", input: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"), wantErr: true},
+		{name: "v1 bad port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n"), wantErr: true},
+		{name: "v1 missing fields", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1\r\n"), wantErr: true},
+		{name: "v1 without CRLF", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), wantErr: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.0.2.1 198."), wantErr: true},
+		{name: "v1 too long", input: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), wantErr: true},
+		{name: "v2 tcp4", input: v2(0x21, 0x11, tcp4), want: "2 PROXY TCP4 192.0.2.1:56324 198.51.100.1:443"},
+		{name: "v2 udp4", input: v2(0x21, 0x12, tcp4), want: "2 PROXY UDP4 192.0.2.1:56324 198.51.100.1:443"},
+		{name: "v2 local", input: v2(0x20, 0x11, tcp4), want: "2 LOCAL TCP4  "},
+		{name: "v2 local unspec", input: v2(0x20, 0x00, nil), want: "2 LOCAL UNKNOWN  "},
+		{name: "v2 valid crc", input: withCRC(0x21, 0x11, tcp4, true), want: "2 PROXY TCP4 192.0.2.1:56324 198.51.100.1:443"},
+		{name: "v2 bad crc", input: withCRC(0x21, 0x11, tcp4, false), wantErr: true},
+		{name: "v2 truncated header", input: v2(0x21, 0x11, tcp4)[:20], wantErr: true},
+		{name: "v2 truncated signature", input: v2Signature[:8], wantErr: true},
+		{name: "v2 short addresses", input: v2(0x21, 0x11, tcp4[:8]), wantErr: true},
+		{name: "v2 truncated TLV", input: v2(0x21, 0x11, append(bytes.Clone(tcp4), 0x01, 0x00, 0x05, 'h')), wantErr: true},
+		{name: "v2 bad version", input: v2(0x31, 0x11, tcp4), wantErr: true},
+		{name: "v2 bad command", input: v2(0x22, 0x11, tcp4), wantErr: true},
+		{name: "no header", input: []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ReadHeader() = %+v, want an error", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join([]string{
+				strconv.Itoa(d.Version), d.Command, d.Protocol, d.SourceAddress, d.DestinationAddress,
+			}, " ")
+			if got != tt.want {
+				t.Errorf("ReadHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHeaderTLVs(t *testing.T) {
+	rest := append(bytes.Clone(tcp4), 0x01, 0x00, 0x02, 'h', '2')
+	rest = append(rest, 0xEA, 0x00, 0x04, 0x01, 'v', 'p', 'c')
+	d, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2(0x21, 0x11, rest))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.TLVs) != 2 || d.TLVs[0].Name != "ALPN" || d.TLVs[0].Value != "h2" || d.TLVs[1].Value != "vpc" {
+		t.Errorf("TLVs = %+v", d.TLVs)
+	}
+}
+
+// accept makes a connection to a Listener that trusts trusted, writes data and returns the accepted connection
+func accept(t *testing.T, trusted string, data []byte) net.Conn {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	l := NewListener(tcp, []netip.Prefix{netip.MustParsePrefix(trusted)})
+
+	client, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	t.Run("trusted", func(t *testing.T) {
+		conn := accept(t, "127.0.0.0/8", []byte(header+"hello"))
+		if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+			t.Errorf("RemoteAddr() = %s, want the source from the header", got)
+		}
+		if h := conn.(*Conn).Header(); h == nil || !strings.HasPrefix(h.ProxyAddress, "127.0.0.1:") {
+			t.Errorf("Header() = %+v", h)
+		}
+		if data, _ := io.ReadAll(conn); string(data) != "hello" {
+			t.Errorf("read %q after the header, want hello", data)
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		conn := accept(t, "10.0.0.0/8", []byte(header+"hello"))
+		if _, ok := conn.(*Conn); ok {
+			t.Fatal("the header of an untrusted source was read")
+		}
+		if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Errorf("RemoteAddr() = %s, want the real address", got)
+		}
+		if data, _ := io.ReadAll(conn); string(data) != header+"hello" {
+			t.Errorf("read %q, want the header as data", data)
+		}
+	})
+
+	t.Run("trusted without header", func(t *testing.T) {
+		conn := accept(t, "127.0.0.0/8", []byte("GET / HTTP/1.1\r\n\r\n"))
+		if _, err := conn.Read(make([]byte, 10)); !errors.Is(err, ErrNoHeader) {
+			t.Errorf("Read() = %v, want ErrNoHeader", err)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		conn := accept(t, "127.0.0.0/8", append(v2(0x20, 0x11, tcp4), "hello"...))
+		if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Errorf("RemoteAddr() = %s, want the proxy's own address", got)
+		}
+		if h := conn.(*Conn).Header(); h == nil || h.Command != "LOCAL" {
+			t.Errorf("Header() = %+v, want LOCAL", h)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// accessListReloadInterval is how often the list files are checked for changes
+const accessListReloadInterval = 2 * time.Second
+
+var ErrEntryNotFound = errors.New("entry not found")
+
+// accessList is a set of IP addresses and CIDR ranges from a file, one per line with "#" comments
+type accessList struct {
+	file string
+	// edit is held by add and remove from reading the file until it is reloaded
+	edit sync.Mutex
+
+	mu       sync.RWMutex
+	addrs    map[netip.Addr]bool
+	prefixes []netip.Prefix
+	entries  []string
+	modTime  time.Time
+	size     int64
+}
+
+// formatEntry writes single addresses without their prefix length
+func formatEntry(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// parseEntry returns the entry of a line without its comment, ok is false for empty lines
+func parseEntry(line string) (netip.Prefix, bool, error) {
+	entry, _, _ := strings.Cut(line, "#")
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return netip.Prefix{}, false, nil
+	}
+	prefixes, err := utils.ParsePrefixes([]string{entry})
+	if err != nil {
+		return netip.Prefix{}, false, err
+	}
+	return prefixes[0], true, nil
+}
+
+// load reads the file, a missing file is an empty list. So is a directory, Docker creates one for a bind
+// mount of a missing file.
+func (l *accessList) load() error {
+	info, err := os.Stat(l.file)
+	var data []byte
+	if err == nil && !info.IsDir() {
+		data, err = os.ReadFile(l.file)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	addrs := map[netip.Addr]bool{}
+	var prefixes []netip.Prefix
+	var entries []string
+	for i, line := range strings.Split(string(data), "\n") {
+		prefix, ok, err := parseEntry(line)
+		if err != nil {
+			log.Printf("Ignoring line %d of %s: %v", i+1, l.file, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if prefix.IsSingleIP() {
+			addrs[prefix.Addr()] = true
+		} else {
+			prefixes = append(prefixes, prefix)
+		}
+		entries = append(entries, formatEntry(prefix))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addrs, l.prefixes, l.entries = addrs, prefixes, entries
+	l.modTime, l.size = time.Time{}, 0
+	if info != nil {
+		l.modTime, l.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// changed reports whether the file was modified since it was loaded
+func (l *accessList) changed() bool {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(l.file); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !modTime.Equal(l.modTime) || size != l.size
+}
+
+func (l *accessList) contains(ip netip.Addr) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.addrs[ip] {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *accessList) details() types.AccessListDetails {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return types.AccessListDetails{File: l.file, Entries: append([]string{}, l.entries...)}
+}
+
+// write replaces the file with data through a temporary file in the same directory, so a reload never
+// reads it half written. A bind mounted file (like in docker-compose.yml) can't be replaced, so it is
+// written in place.
+func (l *accessList) write(data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(l.file), filepath.Base(l.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), l.file)
+	if errors.Is(err, syscall.EBUSY) {
+		return os.WriteFile(l.file, data, 0644)
+	}
+	return err
+}
+
+// add appends an entry to the file and reloads it
+func (l *accessList) add(entry string) error {
+	prefix, ok, err := parseEntry(entry)
+	if err != nil || !ok {
+		return fmt.Errorf("invalid entry %q", entry)
+	}
+	l.edit.Lock()
+	defer l.edit.Unlock()
+	data, err := os.ReadFile(l.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, formatEntry(prefix)+"\n"...)
+	if err := l.write(data); err != nil {
+		return err
+	}
+	return l.load()
+}
+
+// remove deletes the lines with an entry from the file and reloads it
+func (l *accessList) remove(entry string) error {
+	prefix, ok, err := parseEntry(entry)
+	if err != nil || !ok {
+		return fmt.Errorf("invalid entry %q", entry)
+	}
+	l.edit.Lock()
+	defer l.edit.Unlock()
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrEntryNotFound
+	} else if err != nil {
+		return err
+	}
+
+	var kept bytes.Buffer
+	removed := false
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if p, ok, err := parseEntry(s.Text()); err == nil && ok && p == prefix {
+			removed = true
+			continue
+		}
+		kept.WriteString(s.Text() + "\n")
+	}
+	if !removed {
+		return ErrEntryNotFound
+	}
+	if err := l.write(kept.Bytes()); err != nil {
+		return err
+	}
+	return l.load()
+}
+
+// accessLists decide which clients are blocked, addresses on the allowlist never are
+type accessLists struct {
+	block accessList
+	allow accessList
+}
+
+// LoadAccessLists reads the blocklist and allowlist and reloads them when their files change
+func (srv *Server) LoadAccessLists() error {
+	a := &srv.State.Access
+	a.block.file, a.allow.file = srv.GetConfig().GetAccessListFiles()
+	for _, l := range []*accessList{&a.block, &a.allow} {
+		if err := l.load(); err != nil {
+			return fmt.Errorf("failed to load %s: %w", l.file, err)
+		}
+	}
+	go func() {
+		for range time.Tick(accessListReloadInterval) {
+			for _, l := range []*accessList{&a.block, &a.allow} {
+				if !l.changed() {
+					continue
+				}
+				if err := l.load(); err != nil {
+					log.Printf("Failed to reload %s: %v", l.file, err)
+				} else {
+					log.Printf("Reloaded %s", l.file)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// IsBlocked reports whether the client at addr is on the blocklist and not on the allowlist
+func (srv *Server) IsBlocked(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	a := &srv.State.Access
+	return a.block.contains(ip) && !a.allow.contains(ip)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestAccessListLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "list")
+	data := "1.2.3.4\n# comment\n10.0.0.0/8 # private\n\nnot an ip\n2001:db8::/32\n::1/128\n"
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &accessList{file: file}
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.2.3.4", "10.0.0.0/8", "2001:db8::/32", "::1"}
+	if got := l.details().Entries; !slices.Equal(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestAccessListMissingOrDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, file := range map[string]string{
+		"missing":   filepath.Join(dir, "missing"),
+		"directory": dir,
+	} {
+		l := &accessList{file: file}
+		if err := l.load(); err != nil {
+			t.Errorf("%s: load() = %v, want an empty list", name, err)
+		}
+		if len(l.details().Entries) != 0 {
+			t.Errorf("%s: entries = %v, want none", name, l.details().Entries)
+		}
+	}
+}
+
+func TestAccessListAddRemove(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "list")
+	l := &accessList{file: file}
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("192.168.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("bogus"); err == nil {
+		t.Error("add(bogus) succeeded")
+	}
+	if len(l.details().Entries) != 1 {
+		t.Errorf("entries = %v, want 1", l.details().Entries)
+	}
+	if err := l.remove("10.0.0.0/8"); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("remove(10.0.0.0/8) = %v, want ErrEntryNotFound", err)
+	}
+	if err := l.remove("192.168.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.details().Entries) != 0 {
+		t.Errorf("entries = %v, want none", l.details().Entries)
+	}
+}
+
+func TestAccessListConcurrentAdd(t *testing.T) {
+	dir := t.TempDir()
+	l := &accessList{file: filepath.Join(dir, "list")}
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.add(fmt.Sprintf("10.0.0.%d", i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(l.details().Entries); got != 50 {
+		t.Errorf("entries = %d, want 50", got)
+	}
+	// Only the list is left, not the temporary files
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("files = %v, %v", files, err)
+	}
+}
+
+func TestIsBlocked(t *testing.T) {
+	srv := NewServer()
+	a := &srv.State.Access
+	a.block.file = filepath.Join(t.TempDir(), "block")
+	a.allow.file = filepath.Join(t.TempDir(), "allow")
+	for _, entry := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		if err := a.block.add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.allow.add("10.1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"10.1.2.3:1234", false},
+		{"[::ffff:10.0.0.1]:1234", true},
+		{"[2001:db8::1]:443", true},
+		{"192.168.1.1:80", false},
+		{"[2001:db9::1]:443", false},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.IsBlocked(addr); got != tt.want {
+			t.Errorf("IsBlocked(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
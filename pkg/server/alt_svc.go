@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// altSvcClient is a client IP that received an Alt-Svc header over TCP
+type altSvcClient struct {
+	via            string
+	advertisedAt   time.Time
+	advertisements int
+	upgradedAt     time.Time
+	requests       int
+}
+
+// altSvcClients tracks which clients received Alt-Svc, so their HTTP/3 requests can be matched to it
+type altSvcClients struct {
+	mu        sync.Mutex
+	clients   map[string]*altSvcClient
+	lastSweep time.Time
+}
+
+func altSvcKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// advertised records that Alt-Svc was sent to addr over the given protocol
+func (a *altSvcClients) advertised(addr, via string, maxAge time.Duration) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.clients == nil {
+		a.clients = map[string]*altSvcClient{}
+	}
+	if now.Sub(a.lastSweep) > time.Minute {
+		for k, c := range a.clients {
+			if now.Sub(c.advertisedAt) > maxAge {
+				delete(a.clients, k)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	key := altSvcKey(addr)
+	c, ok := a.clients[key]
+	if !ok || now.Sub(c.advertisedAt) > maxAge {
+		c = &altSvcClient{via: via, advertisedAt: now}
+		a.clients[key] = c
+	}
+	if c.upgradedAt.IsZero() {
+		c.advertisements++
+	}
+}
+
+// upgraded records an HTTP/3 request from addr, it returns nil if the client never received Alt-Svc
+func (a *altSvcClients) upgraded(addr string, maxAge time.Duration) *types.Http3Upgrade {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.clients[altSvcKey(addr)]
+	if !ok || now.Sub(c.advertisedAt) > maxAge {
+		return nil
+	}
+	if c.upgradedAt.IsZero() {
+		c.upgradedAt = now
+	}
+	c.requests++
+	return &types.Http3Upgrade{
+		AdvertisedVia:  c.via,
+		Advertisements: c.advertisements,
+		DelayMs:        float64(c.upgradedAt.Sub(c.advertisedAt).Microseconds()) / 1000,
+		Requests:       c.requests,
+	}
+}
+
+// altSvcHeader returns the Alt-Svc header value for a response sent over TCP and records the advertisement
+func (srv *Server) altSvcHeader(addr, via string) string {
+	header := srv.GetConfig().AltSvcHeader()
+	if header != "" {
+		srv.State.AltSvc.advertised(addr, via, time.Duration(srv.GetConfig().AltSvcMaxAge())*time.Second)
+	}
+	return header
+}
+
+// getHTTP3Upgrade matches an HTTP/3 request to an earlier Alt-Svc advertisement
+func (srv *Server) getHTTP3Upgrade(addr string) *types.Http3Upgrade {
+	return srv.State.AltSvc.upgraded(addr, time.Duration(srv.GetConfig().AltSvcMaxAge())*time.Second)
+}
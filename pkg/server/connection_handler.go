@@ -1,19 +1,26 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/pagpeter/quic-go/http3"
 	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/metrics"
+	"github.com/pagpeter/trackme/pkg/proxyproto"
 	"github.com/pagpeter/trackme/pkg/tls"
 	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
@@ -24,6 +31,16 @@ import (
 
 const HTTP2_PREAMBLE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
+// requestTimeout is how long a client has to send a request and read the response on a TCP connection,
+// the first one includes the TLS handshake
+const requestTimeout = 15 * time.Second
+
+// isTimeout reports whether err is an expired deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func cloudflareHTTPDate() string {
 	return time.Now().UTC().Format(http.TimeFormat)
 }
@@ -40,43 +57,53 @@ func parseHeaderValue(header, prefix string) string {
 	return parts[1]
 }
 
-func parseHTTP1(request []byte) types.Response {
-	// Split the request into lines
-	lines := strings.Split(string(request), "\r\n")
-	if len(lines) == 0 {
-		return types.Response{
-			Timestamp:   time.Now().UnixMilli(),
-			HTTPVersion: "--",
-			Method:      "--",
-			Path:        "--",
-		}
+// parseHTTP1 parses the request line and headers of a request head, as read by readHTTP1Head
+func parseHTTP1(head []byte) types.Response {
+	// Split the head into lines, tolerating bare LF line endings
+	lines := strings.Split(string(head), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
 	}
 
 	// Split the first line into the method, path and http version
+	invalid := types.Response{
+		Timestamp:   time.Now().UnixMilli(),
+		HTTPVersion: "--",
+		Method:      "--",
+		Path:        "--",
+	}
 	firstLine := strings.Split(lines[0], " ")
+	if len(firstLine) != 3 {
+		return invalid
+	}
 
-	// Split the headers into an array
+	// The headers are everything between the request line and the empty line
 	var headers []string
-	var userAgent string
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			headers = append(headers, line)
-			if strings.HasPrefix(strings.ToLower(line), "user-agent") {
-				if val := parseHeaderValue(line, ""); val != "" {
-					userAgent = strings.TrimSpace(val)
-				}
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		// An obs-fold line continues the value of the previous header, it is joined with a space so it
+		// can't pass for a header of its own (RFC 9112, section 5.2)
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return invalid
 			}
+			headers[len(headers)-1] += " " + strings.TrimSpace(line)
+			continue
 		}
+		headers = append(headers, line)
 	}
-
-	if len(firstLine) != 3 {
-		return types.Response{
-			Timestamp:   time.Now().UnixMilli(),
-			HTTPVersion: "--",
-			Method:      "--",
-			Path:        "--",
+	var userAgent string
+	for _, h := range headers {
+		if val := parseHeaderValueFold(h, "user-agent"); val != "" {
+			userAgent = val
 		}
 	}
+
+	fields, anomalies := trackmehttp.ParseHTTP1HeaderFields(head)
+	headerOrder, headerOrderHash := trackmehttp.GetHTTP1HeaderOrder(fields)
+
 	return types.Response{
 		Timestamp:   time.Now().UnixMilli(),
 		HTTPVersion: firstLine[2],
@@ -84,15 +111,65 @@ func parseHTTP1(request []byte) types.Response {
 		Method:      firstLine[0],
 		UserAgent:   userAgent,
 		Http1: &types.Http1Details{
-			Headers: headers,
+			Headers:         headers,
+			RawHead:         string(head),
+			RawHeadB64:      base64.StdEncoding.EncodeToString(head),
+			HeaderFields:    fields,
+			Anomalies:       anomalies,
+			HeaderOrder:     headerOrder,
+			HeaderOrderHash: headerOrderHash,
 		},
 	}
 }
 
-func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
+func hasEndStream(frame types.ParsedFrame) bool {
+	return len(frame.Flags) > 0 && frame.Flags[0] == "EndStream (0x1)"
+}
+
+// formatSetting renders a setting as "NAME = value", the format used in ParsedFrame.Settings
+func formatSetting(s http2.Setting) string {
+	setting := fmt.Sprintf("%q", s)
+	setting = strings.Replace(setting, "\"", "", -1)
+	setting = strings.Replace(setting, "[", "", -1)
+	setting = strings.Replace(setting, "]", "", -1)
+
+	// SETTINGS_NO_RFC7540_PRIORITIES
+	// https://www.rfc-editor.org/rfc/rfc9218.html#section-2.1
+	// https://github.com/golang/go/issues/69917
+	// TODO: when net/http2 is updated to support it, remove this as it won't be needed (this is ugly code too)
+	if strings.HasPrefix(setting, "UNKNOWN_SETTING_9 = ") {
+		setting = strings.ReplaceAll(setting, "UNKNOWN_SETTING_9", "NO_RFC7540_PRIORITIES")
+	}
+	return setting
+}
+
+// parseHTTP2SettingsHeader decodes the HTTP2-Settings header sent with "Upgrade: h2c"
+// https://www.rfc-editor.org/rfc/rfc7540#section-3.2.1
+func parseHTTP2SettingsHeader(value string) ([]string, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings header: %w", err)
+	}
+	if len(payload)%6 != 0 {
+		return nil, fmt.Errorf("invalid HTTP2-Settings length %d", len(payload))
+	}
+	settings := []string{}
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, formatSetting(http2.Setting{
+			ID:  http2.SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Val: binary.BigEndian.Uint32(payload[i+2:]),
+		}))
+	}
+	return settings, nil
+}
+
+func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame, headerTableSize uint32) {
 	for {
 		frame, err := f.ReadFrame()
 		if err != nil {
+			if isTimeout(err) {
+				metrics.Timeouts.Inc()
+			}
 			r := "ERROR_CLOSE"
 			if strings.HasSuffix(err.Error(), "unknown certificate") {
 				r = "ERROR"
@@ -101,7 +178,7 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 			return
 		}
 
-		p := types.ParsedFrame{}
+		p := types.ParsedFrame{ReceivedAt: time.Now()}
 		p.Type = frame.Header().Type.String()
 		p.Stream = frame.Header().StreamID
 		p.Length = frame.Header().Length
@@ -111,27 +188,15 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 		case *http2.SettingsFrame:
 			p.Settings = []string{}
 			frame.ForeachSetting(func(s http2.Setting) error {
-				setting := fmt.Sprintf("%q", s)
-				setting = strings.Replace(setting, "\"", "", -1)
-				setting = strings.Replace(setting, "[", "", -1)
-				setting = strings.Replace(setting, "]", "", -1)
-
-				// SETTINGS_NO_RFC7540_PRIORITIES
-				// https://www.rfc-editor.org/rfc/rfc9218.html#section-2.1
-				// https://github.com/golang/go/issues/69917
-				// TODO: when net/http2 is updated to support it, remove this as it won't be needed (this is ugly code too)
-				if strings.HasPrefix(setting, "UNKNOWN_SETTING_9 = ") {
-					setting = strings.ReplaceAll(setting, "UNKNOWN_SETTING_9", "NO_RFC7540_PRIORITIES")
-				}
-
-				p.Settings = append(p.Settings, setting)
+				p.Settings = append(p.Settings, formatSetting(s))
 				return nil
 			})
 		case *http2.HeadersFrame:
-			d := hpack.NewDecoder(4096, func(hf hpack.HeaderField) {})
+			d := hpack.NewDecoder(headerTableSize, func(hf hpack.HeaderField) {})
 			d.SetEmitEnabled(true)
 			h2Headers, err := d.DecodeFull(frame.HeaderBlockFragment())
 			if err != nil {
+				c <- types.ParsedFrame{Type: "ERROR_CLOSE"}
 				return
 			}
 
@@ -152,9 +217,16 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 				}
 			}
 		case *http2.DataFrame:
-			p.Payload = frame.Data()
+			// The framer reuses its buffer for the next frame
+			p.Payload = append([]byte(nil), frame.Data()...)
+			if frame.Header().Flags.Has(http2.FlagDataPadded) {
+				// Pad Length field + padding
+				p.Padding = int(frame.Header().Length) - len(p.Payload) - 1
+			}
 		case *http2.WindowUpdateFrame:
 			p.Increment = frame.Increment
+		case *http2.PingFrame:
+			p.Payload = append([]byte(nil), frame.Data[:]...)
 		case *http2.PriorityFrame:
 			prio := types.Priority{}
 			p.Priority = &prio
@@ -168,33 +240,58 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 			p.GoAway = &types.GoAway{}
 			p.GoAway.LastStreamID = frame.LastStreamID
 			p.GoAway.ErrCode = uint32(frame.ErrCode)
-			p.GoAway.DebugData = frame.DebugData()
+			p.GoAway.DebugData = append([]byte(nil), frame.DebugData()...)
 		}
 
 		c <- p
 	}
 }
 
-func (srv *Server) HandleTLSConnection(conn net.Conn) error {
-	// Read the first line of the request
-	// We only read the first line to determine if the connection is HTTP1 or HTTP2
-	// If we know that it isnt HTTP2, we can read the rest of the request and then start processing it
-	// If we know that it is HTTP2, we start the HTTP2 handler
-
-	l := len([]byte(HTTP2_PREAMBLE))
-	request := make([]byte, l)
-
-	_, err := conn.Read(request)
-	if err != nil {
-		if strings.HasSuffix(err.Error(), "unknown certificate") && srv.IsLocal() {
-			// Local development error - don't close connection
-			return nil
+// handshakeFailureReason describes why a TLS handshake failed, the number of values is bounded for metrics
+func handshakeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	}
+	msg := err.Error()
+	// Alerts sent by the client like "remote error: tls: bad certificate", or by us like "local error: tls: bad record MAC"
+	if _, alert, ok := strings.Cut(msg, "remote error: tls: "); ok {
+		return "alert_" + strings.ReplaceAll(alert, " ", "_")
+	}
+	if _, alert, ok := strings.Cut(msg, "local error: tls: "); ok {
+		return "local_alert_" + strings.ReplaceAll(alert, " ", "_")
+	}
+	for substr, reason := range map[string]string{
+		"does not look like a TLS handshake":  "not_tls",
+		"unsupported versions":                "unsupported_version",
+		"no cipher suite supported":           "no_shared_cipher",
+		"no ECDHE curve supported":            "no_shared_group",
+		"client didn't provide a certificate": "no_certificate",
+	} {
+		if strings.Contains(msg, substr) {
+			return reason
 		}
-		return fmt.Errorf("failed to read request: %w", err)
 	}
+	return "other"
+}
 
-	hs := conn.(*utls.Conn).ClientHello
+// getProxyDetails returns the PROXY protocol header of a connection, nil if it didn't come from a trusted proxy
+func getProxyDetails(conn net.Conn) *types.ProxyProtocolDetails {
+	if tlsConn, ok := conn.(*utls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if proxyConn, ok := conn.(*proxyproto.Conn); ok {
+		return proxyConn.Header()
+	}
+	return nil
+}
 
+// getTLSDetails fingerprints a ClientHello, given as hex
+func getTLSDetails(conn *utls.Conn, hs string) (*types.TLSDetails, tls.ClientHello, error) {
 	parsedClientHello := tls.ParseClientHello(hs)
 	JA3Data := tls.CalculateJA3(parsedClientHello)
 	peetfp, peetprintHash := tls.CalculatePeetPrint(parsedClientHello, JA3Data)
@@ -202,15 +299,16 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) error {
 	// Convert raw bytes to hex and base64
 	rawBytes, err := hex.DecodeString(hs)
 	if err != nil {
-		return fmt.Errorf("failed to decode hex: %w", err)
+		return nil, parsedClientHello, fmt.Errorf("failed to decode hex: %w", err)
 	}
 	rawB64 := base64.StdEncoding.EncodeToString(rawBytes)
 
-	tlsDetails := types.TLSDetails{
+	state := conn.ConnectionState()
+	return &types.TLSDetails{
 		Ciphers:          JA3Data.ReadableCiphers,
 		Extensions:       parsedClientHello.Extensions,
 		RecordVersion:    JA3Data.Version,
-		NegotiatedVesion: fmt.Sprintf("%v", conn.(*utls.Conn).ConnectionState().Version),
+		NegotiatedVesion: fmt.Sprintf("%v", state.Version),
 		JA3:              JA3Data.JA3,
 		JA3Hash:          JA3Data.JA3Hash,
 		PeetPrint:        peetfp,
@@ -219,39 +317,185 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) error {
 		ClientRandom:     parsedClientHello.ClientRandom,
 		RawBytes:         hs,
 		RawB64:           rawB64,
+
+		ClientCertificates: tls.GetCertificateDetails(state.PeerCertificates),
+	}, parsedClientHello, nil
+}
+
+func (srv *Server) HandleTLSConnection(conn net.Conn) error {
+	// Peek at the start of the request to determine if the connection is HTTP1 or HTTP2
+	// If we know that it isnt HTTP2, we read and answer the HTTP/1 requests one after the other
+	// If we know that it is HTTP2, we start the HTTP2 handler
+	tlsConn := conn.(*utls.Conn)
+	srv.State.Handshakes.register(tlsConn)
+	defer srv.State.Handshakes.unregister(tlsConn)
+
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	isHTTP2, err := isHTTP2Preface(r)
+	if err != nil {
+		if !tlsConn.ConnectionState().HandshakeComplete {
+			metrics.HandshakeFailures.Inc(handshakeFailureReason(err))
+		}
+		if isTimeout(err) {
+			metrics.Timeouts.Inc()
+		}
+		if strings.HasSuffix(err.Error(), "unknown certificate") && srv.IsLocal() {
+			// Local development error - don't close connection
+			return nil
+		}
+		return fmt.Errorf("failed to read request: %w", err)
 	}
 
-	// Check if the first line is HTTP/2
-	if string(request) == HTTP2_PREAMBLE {
-		srv.handleHTTP2(conn, &tlsDetails)
-	} else {
-		// Read the rest of the request
-		r2 := make([]byte, 1024-l)
-		_, err := conn.Read(r2)
-		if err != nil {
-			return fmt.Errorf("failed to read HTTP/1 request: %w", err)
+	// After a HelloRetryRequest, the fingerprints are those of the first ClientHello
+	p := srv.State.Handshakes.unregister(tlsConn)
+	hs := tlsConn.ClientHello
+	if p != nil && p.clientHello != "" {
+		hs = p.clientHello
+	}
+	tlsDetails, parsedClientHello, err := getTLSDetails(tlsConn, hs)
+	if err != nil {
+		return err
+	}
+	tlsDetails.Tracking = srv.trackConnection(p, parsedClientHello, tlsDetails)
+	tlsDetails.SNI = srv.State.VirtualHosts.getSNIDetails(tlsConn.ConnectionState().ServerName)
+	if tlsDetails.HelloRetry, err = getHelloRetry(p, parsedClientHello); err != nil {
+		return err
+	}
+
+	if isHTTP2 {
+		metrics.Connections.Inc("h2")
+		if _, err := r.Discard(len(HTTP2_PREAMBLE)); err != nil {
+			return fmt.Errorf("failed to read HTTP/2 preface: %w", err)
+		}
+		srv.handleHTTP2(conn, r, tlsDetails, nil)
+		return nil
+	}
+
+	metrics.Connections.Inc("h1")
+	return srv.serveHTTP1(conn, r, func(req types.Response) (bool, error) {
+		req.TLS = tlsDetails
+		srv.respondToHTTP1(conn, req)
+		return true, nil
+	})
+}
+
+// HandlePlainConnection handles a connection on the cleartext HTTP port. Depending on the config it
+// serves h2c (prior knowledge or "Upgrade: h2c"), plain HTTP/1 fingerprints, or redirects to HTTPRedirect.
+func (srv *Server) HandlePlainConnection(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	isHTTP2, err := isHTTP2Preface(r)
+	if err != nil {
+		if isTimeout(err) {
+			metrics.Timeouts.Inc()
 		}
-		// Append it to the first line
-		request = append(request, r2...)
+		return fmt.Errorf("failed to read request: %w", err)
+	}
 
-		// Parse and handle the request
-		details := parseHTTP1(request)
-		details.IP = conn.RemoteAddr().String()
-		details.TLS = &tlsDetails
-		srv.respondToHTTP1(conn, details)
+	if isHTTP2 && srv.GetConfig().EnableH2C {
+		metrics.Connections.Inc("h2")
+		if _, err := r.Discard(len(HTTP2_PREAMBLE)); err != nil {
+			return fmt.Errorf("failed to read HTTP/2 preface: %w", err)
+		}
+		srv.handleHTTP2(conn, r, nil, nil)
+		return nil
 	}
+
+	metrics.Connections.Inc("h1")
+	return srv.serveHTTP1(conn, r, func(req types.Response) (bool, error) {
+		if srv.GetConfig().EnableH2C && isH2CUpgrade(req) {
+			return false, srv.upgradeToH2C(conn, r, req)
+		}
+		if srv.GetConfig().ServePlainH1 {
+			srv.respondToHTTP1(conn, req)
+			return true, nil
+		}
+		srv.redirectHTTP1(conn)
+		return false, nil
+	})
+}
+
+// isH2CUpgrade checks for "Upgrade: h2c" together with the mandatory HTTP2-Settings header
+func isH2CUpgrade(req types.Response) bool {
+	if req.Http1 == nil {
+		return false
+	}
+	var upgrade, settings bool
+	for _, h := range req.Http1.Headers {
+		if strings.EqualFold(parseHeaderValueFold(h, "upgrade"), "h2c") {
+			upgrade = true
+		}
+		if parseHeaderValueFold(h, "http2-settings") != "" {
+			settings = true
+		}
+	}
+	return upgrade && settings
+}
+
+// parseHeaderValueFold returns the value of an HTTP/1 header line if its name matches case-insensitively
+func parseHeaderValueFold(header, name string) string {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) < 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), name) {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// upgradeToH2C switches the connection to HTTP/2 and answers the upgraded request on stream 1
+// https://www.rfc-editor.org/rfc/rfc7540#section-3.2
+func (srv *Server) upgradeToH2C(conn net.Conn, r *bufio.Reader, req types.Response) error {
+	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")); err != nil {
+		return fmt.Errorf("failed to write upgrade response: %w", err)
+	}
+
+	preface := make([]byte, len([]byte(HTTP2_PREAMBLE)))
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return fmt.Errorf("failed to read h2c preface: %w", err)
+	}
+	if string(preface) != HTTP2_PREAMBLE {
+		return fmt.Errorf("invalid h2c preface")
+	}
+
+	srv.handleHTTP2(conn, r, nil, &req)
 	return nil
 }
 
+// redirectHTTP1 sends the same redirect StartRedirectServer would
+func (srv *Server) redirectHTTP1(conn net.Conn) {
+	res := "HTTP/1.1 301 Moved Permanently\r\n"
+	res += "Location: " + srv.GetConfig().HTTPRedirect + "\r\n"
+	res += "Content-Length: 0\r\n"
+	res += "Date: " + cloudflareHTTPDate() + "\r\n"
+	res += "Connection: close\r\n"
+	res += "\r\n"
+
+	if _, err := conn.Write([]byte(res)); err != nil {
+		log.Println("Error writing redirect:", err)
+	}
+	if err := conn.Close(); err != nil {
+		log.Println("Error closing HTTP/1 connection:", err)
+	}
+}
+
+// respondToHTTP1 answers a request, the connection is only closed if the client doesn't keep it alive
 func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
+	keepAlive := resp.Http1 != nil && resp.Http1.KeepAlive
 	var isAdmin bool
 	var res []byte
 	var ctype = "text/plain"
+	status, retryAfter := http.StatusOK, ""
 	if resp.Method != "OPTIONS" {
 		var err error
 		res, ctype, err = Router(resp.Path, resp, srv)
 		if err != nil {
-			log.Println("Router error:", err)
+			if status, retryAfter = routerStatus(err); retryAfter == "" {
+				log.Println("Router error:", err)
+			}
 			res = []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error()))
 			ctype = "application/json"
 		}
@@ -268,7 +512,10 @@ func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
 		}
 	}
 
-	res1 := "HTTP/1.1 200 OK\r\n"
+	res1 := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if retryAfter != "" {
+		res1 += "Retry-After: " + retryAfter + "\r\n"
+	}
 	res1 += "Content-Length: " + fmt.Sprintf("%v\r\n", len(res))
 	res1 += "Content-Type: " + ctype + "; charset=utf-8\r\n"
 	res1 += "Date: " + cloudflareHTTPDate() + "\r\n"
@@ -280,64 +527,177 @@ func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
 		res1 += "Access-Control-Allow-Headers: *\r\n"
 	}
 	res1 += "Server: cloudflare\r\n"
-	res1 += "Alt-Svc: h3=\":443\"; ma=86400\r\n"
+	if altSvc := srv.altSvcHeader(resp.IP, resp.HTTPVersion); altSvc != "" {
+		res1 += "Alt-Svc: " + altSvc + "\r\n"
+	}
+	if keepAlive {
+		res1 += "Connection: keep-alive\r\n"
+	} else {
+		res1 += "Connection: close\r\n"
+	}
 	res1 += "\r\n"
-	res1 += string(res)
-	res1 += "\r\n\r\n"
+	if resp.Method != "HEAD" {
+		res1 += string(res)
+	}
 
 	if _, err := conn.Write([]byte(res1)); err != nil {
 		log.Println("Error writing HTTP/1 data:", err)
 		return
 	}
+	if keepAlive {
+		return
+	}
 	if err := conn.Close(); err != nil {
 		log.Println("Error closing HTTP/1 connection:", err)
 	}
 }
 
 // https://stackoverflow.com/questions/52002623/golang-tcp-server-how-to-write-http2-data
-func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails) {
+// upgrade is set when the connection was switched from HTTP/1.1 using "Upgrade: h2c". The upgraded
+// request is then answered on stream 1 and the client doesn't send a HEADERS frame for it.
+func (srv *Server) handleHTTP2(conn net.Conn, r io.Reader, tlsFingerprint *types.TLSDetails, upgrade *types.Response) {
+	// The connection is always closed in the end, also when writing to it failed
+	defer func() {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Error closing HTTP/2 connection:", err)
+		}
+	}()
+	// The connection is closed once the deadline passes, whatever state the request is in
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		log.Println("Error setting HTTP/2 deadline:", err)
+		return
+	}
 	// make a new framer to encode/decode frames
-	fr := http2.NewFramer(conn, conn)
+	fr := http2.NewFramer(conn, r)
 	c := make(chan types.ParsedFrame)
 	var frames []types.ParsedFrame
 
-	// Same settings that google uses
-	if err := fr.WriteSettings(
-		http2.Setting{
-			ID: http2.SettingInitialWindowSize, Val: 1048576,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxConcurrentStreams, Val: 100,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxHeaderListSize, Val: 65536,
-		},
-	); err != nil {
+	// The server profile decides which SETTINGS etc. we send first, the default one mimics google
+	profileName, profile := srv.GetConfig().GetHTTP2Profile()
+	if err := fr.WriteSettings(profile.HTTP2Settings()...); err != nil {
 		log.Println("Error writing settings:", err)
 		return
 	}
+	if profile.WindowUpdate != 0 {
+		if err := fr.WriteWindowUpdate(0, profile.WindowUpdate); err != nil {
+			log.Println("Error writing window update:", err)
+			return
+		}
+	}
+	// The PINGs are sent one after the other, so each one measures the round-trip time on its own
+	var pings []types.Http2Ping
+	sendPing := func() error {
+		data := trackmehttp.HTTP2PingData(len(pings))
+		pings = append(pings, types.Http2Ping{Data: hex.EncodeToString(data[:]), SentAt: time.Now()})
+		return fr.WritePing(false, data)
+	}
+	if profile.Pings() > 0 {
+		if err := sendPing(); err != nil {
+			log.Println("Error writing ping:", err)
+			return
+		}
+	}
 
 	var frame types.ParsedFrame
 	var headerFrame types.ParsedFrame
 	var isAdmin bool
 
-	go parseHTTP2(fr, c)
+	go parseHTTP2(fr, c, profile.DecoderTableSize())
+	// closed is set once parseHTTP2 sent its read error and returned, until then it has to be drained
+	// so it doesn't block forever after the connection is closed
+	closed := false
+	defer func() {
+		if !closed {
+			go collectHTTP2Frames(c, 0, nil)
+		}
+	}()
 
+	// After an upgrade there is no request on the h2 connection, so we only wait for the
+	// client's SETTINGS and whatever it sends right after it (WINDOW_UPDATE, PRIORITY, ...)
+	var settingsDone <-chan time.Time
+	if upgrade != nil {
+		headerFrame.Stream = 1
+	}
+
+	// Once the request is complete we wait a bit for the ACKs of our SETTINGS (and PING), so
+	// the client's reaction to them can be included in the response
+	var requestDone, settingsAcked bool
+	pingsAcked := profile.Pings() == 0
+	var ackTimeout <-chan time.Time
+
+collect:
 	for {
-		frame = <-c
-		if frame.Type == "ERROR_CLOSE" {
-			if err := conn.Close(); err != nil {
-				log.Println("Error closing connection:", err)
+		select {
+		case frame = <-c:
+		case <-settingsDone:
+			settingsDone = nil
+			requestDone = true
+			ackTimeout = time.After(time.Second)
+			if settingsAcked && pingsAcked {
+				break collect
 			}
-			return
-		} else if frame.Type == "ERROR" {
+			continue
+		case <-ackTimeout:
+			break collect
+		}
+		if frame.Type == "ERROR_CLOSE" || frame.Type == "ERROR" {
+			closed = true
 			return
 		}
 		frames = append(frames, frame)
-		if frame.Type == "HEADERS" {
+
+		isAck := len(frame.Flags) > 0 && frame.Flags[0] == "Ack (0x1)"
+		switch frame.Type {
+		case "HEADERS":
 			headerFrame = frame
+		case "SETTINGS":
+			if isAck {
+				settingsAcked = true
+				break
+			}
+			if profile.SendSettingsAck {
+				if err := fr.WriteSettingsAck(); err != nil {
+					log.Println("Error writing settings ack:", err)
+				}
+			}
+			if upgrade != nil && settingsDone == nil && !requestDone {
+				settingsDone = time.After(100 * time.Millisecond)
+			}
+		case "PING":
+			if !isAck {
+				if err := fr.WritePing(true, [8]byte(frame.Payload)); err != nil {
+					log.Println("Error writing ping ack:", err)
+				}
+				break
+			}
+			if len(pings) > 0 && hex.EncodeToString(frame.Payload) == pings[len(pings)-1].Data {
+				if len(pings) < profile.Pings() {
+					if err := sendPing(); err != nil {
+						log.Println("Error writing ping:", err)
+					}
+				} else {
+					pingsAcked = true
+				}
+			}
+		case "DATA":
+			// Give the flow control credit back, so larger bodies don't stall
+			if frame.Length > 0 {
+				if err := fr.WriteWindowUpdate(0, frame.Length); err != nil {
+					log.Println("Error writing window update:", err)
+				}
+				if !hasEndStream(frame) {
+					if err := fr.WriteWindowUpdate(frame.Stream, frame.Length); err != nil {
+						log.Println("Error writing window update:", err)
+					}
+				}
+			}
+		}
+
+		if !requestDone && hasEndStream(frame) {
+			requestDone = true
+			ackTimeout = time.After(time.Second)
 		}
-		if len(frame.Flags) > 0 && frame.Flags[0] == "EndStream (0x1)" {
+		if requestDone && settingsAcked && pingsAcked {
 			break
 		}
 	}
@@ -346,6 +706,7 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 	var path string
 	var method string
 	var userAgent string
+	var contentType string
 	key, isKeySet := srv.GetAdmin()
 
 	for _, h := range headerFrame.Headers {
@@ -358,12 +719,17 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 		if val := parseHeaderValue(h, "user-agent"); val != "" {
 			userAgent = val
 		}
+		if val := parseHeaderValue(h, "content-type"); val != "" {
+			contentType = val
+		}
 		if isKeySet && strings.HasPrefix(h, key) {
 			isAdmin = true
 		}
 	}
 
 	resp := types.Response{
+		// The response flow is logged after the response, with the same ID
+		LogID:       newLogID(),
 		Timestamp:   time.Now().UnixMilli(),
 		IP:          conn.RemoteAddr().String(),
 		HTTPVersion: "h2",
@@ -374,17 +740,49 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 			SendFrames:            frames,
 			AkamaiFingerprint:     trackmehttp.GetAkamaiFingerprint(frames),
 			AkamaiFingerprintHash: utils.GetMD5Hash(trackmehttp.GetAkamaiFingerprint(frames)),
+			Cleartext:             tlsFingerprint == nil,
+			ServerProfile:         profileName,
+			ClientReaction:        trackmehttp.GetHTTP2ClientReaction(frames),
+			Body:                  trackmehttp.GetHTTP2Body(frames, headerFrame.Stream, contentType),
+			Ping:                  trackmehttp.GetHTTP2Pings(frames, pings),
 		},
-		TLS: tlsFingerprint,
+		TLS:           tlsFingerprint,
+		ProxyProtocol: getProxyDetails(conn),
+	}
+
+	if upgrade != nil {
+		resp.Path = upgrade.Path
+		resp.Method = upgrade.Method
+		resp.UserAgent = upgrade.UserAgent
+		resp.Http1 = upgrade.Http1
+		resp.Http2.Upgraded = true
+		if upgrade.Http1 != nil {
+			for _, h := range upgrade.Http1.Headers {
+				if isKeySet && strings.HasPrefix(h, key) {
+					isAdmin = true
+				}
+				if val := parseHeaderValueFold(h, "http2-settings"); val != "" {
+					settings, err := parseHTTP2SettingsHeader(val)
+					if err != nil {
+						log.Println("Error parsing HTTP2-Settings:", err)
+						continue
+					}
+					resp.Http2.UpgradeSettings = settings
+				}
+			}
+		}
 	}
 
 	var res []byte
 	var ctype = "text/plain"
-	if method != "OPTIONS" {
+	status, retryAfter := http.StatusOK, ""
+	if resp.Method != "OPTIONS" {
 		var err error
-		res, ctype, err = Router(path, resp, srv)
+		res, ctype, err = Router(resp.Path, resp, srv)
 		if err != nil {
-			log.Println("Router error:", err)
+			if status, retryAfter = routerStatus(err); retryAfter == "" {
+				log.Println("Router error:", err)
+			}
 			res = []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error()))
 			ctype = "application/json"
 		}
@@ -395,14 +793,19 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 	// Prepare HEADERS
 	hbuf := bytes.NewBuffer([]byte{})
 	encoder := hpack.NewEncoder(hbuf)
-	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
+	if retryAfter != "" {
+		encoder.WriteField(hpack.HeaderField{Name: "retry-after", Value: retryAfter})
+	}
 	encoder.WriteField(hpack.HeaderField{Name: "server", Value: "cloudflare"})
 	encoder.WriteField(hpack.HeaderField{Name: "date", Value: cloudflareHTTPDate()})
 	encoder.WriteField(hpack.HeaderField{Name: "cf-cache-status", Value: "DYNAMIC"})
 	encoder.WriteField(hpack.HeaderField{Name: "vary", Value: "Accept-Encoding"})
 	encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(res))})
 	encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: ctype})
-	encoder.WriteField(hpack.HeaderField{Name: "alt-svc", Value: "h3=\":443\"; ma=86400"})
+	if altSvc := srv.altSvcHeader(resp.IP, resp.HTTPVersion); altSvc != "" {
+		encoder.WriteField(hpack.HeaderField{Name: "alt-svc", Value: altSvc})
+	}
 	if isAdmin {
 		encoder.WriteField(hpack.HeaderField{Name: "access-control-allow-origin", Value: "*"})
 		encoder.WriteField(hpack.HeaderField{Name: "access-control-allow-methods", Value: "*"})
@@ -415,140 +818,126 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 		return
 	}
 
-	chunks := utils.SplitBytesIntoChunks(res, 1024)
-	for _, chunk := range chunks {
-		if err := fr.WriteData(headerFrame.Stream, false, chunk); err != nil {
-			log.Println("Error writing data chunk:", err)
-			return
-		}
-	}
-	if err := fr.WriteData(headerFrame.Stream, true, []byte{}); err != nil {
-		log.Println("Error writing final data frame:", err)
-	}
+	var flow *types.Http2ResponseFlow
+	flow, closed = writeHTTP2Data(fr, c, headerFrame.Stream, res, frames)
 	if err := fr.WriteGoAway(headerFrame.Stream, http2.ErrCodeNo, []byte{}); err != nil {
 		log.Println("Error writing GoAway:", err)
 	}
 
-	time.Sleep(time.Millisecond * 500)
-	if err := conn.Close(); err != nil {
-		log.Println("Error closing HTTP/2 connection:", err)
+	// Keep reading for a bit to see the WINDOW_UPDATEs the client sends while receiving the response
+	if !closed {
+		closed = collectHTTP2Frames(c, 500*time.Millisecond, func(frame types.ParsedFrame) {
+			if frame.Type == "WINDOW_UPDATE" {
+				flow.WindowUpdates = append(flow.WindowUpdates, types.Http2WindowUpdate{
+					Index:     len(flow.WindowUpdates),
+					Stream:    frame.Stream,
+					Increment: frame.Increment,
+				})
+			}
+		})
 	}
+	flow.IP = resp.IP
+	flow.LogID = resp.LogID
+	flow.Timestamp = resp.Timestamp
+	srv.logHTTP2ResponseFlow(flow)
 }
 
-// HandleHTTP3 handles HTTP/3 requests
-func (srv *Server) HandleHTTP3() http.Handler {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		h3w, ok := w.(*http3.ResponseWriter)
-		if !ok {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		h3c := h3w.Connection()
-		if h3c == nil {
-			http.Error(w, "No HTTP/3 connection", http.StatusInternalServerError)
-			return
-		}
+// writeHTTP2Data sends the response body in DATA frames without exceeding the client's flow control windows.
+// It returns whether the connection was closed while waiting for a WINDOW_UPDATE.
+func writeHTTP2Data(fr *http2.Framer, c chan types.ParsedFrame, stream uint32, data []byte, frames []types.ParsedFrame) (*types.Http2ResponseFlow, bool) {
+	flow := &types.Http2ResponseFlow{
+		Stream:        stream,
+		ResponseSize:  len(data),
+		WindowUpdates: []types.Http2WindowUpdate{},
+	}
 
-		h3state := h3c.ConnectionState()
-
-		// Extract TLS fingerprint from QUIC ClientHello
-		var tlsDetails *types.TLSDetails
-		if len(h3state.ClientHello) > 0 {
-			clientHelloHex := hex.EncodeToString(h3state.ClientHello)
-			parsedClientHello := tls.ParseClientHello(clientHelloHex)
-			JA3Data := tls.CalculateJA3(parsedClientHello)
-			peetfp, peetprintHash := tls.CalculatePeetPrint(parsedClientHello, JA3Data)
-
-			rawB64 := base64.StdEncoding.EncodeToString(h3state.ClientHello)
-
-			tlsDetails = &types.TLSDetails{
-				Ciphers:          JA3Data.ReadableCiphers,
-				Extensions:       parsedClientHello.Extensions,
-				RecordVersion:    JA3Data.Version,
-				NegotiatedVesion: fmt.Sprintf("%v", h3state.TLS.Version),
-				JA3:              JA3Data.JA3,
-				JA3Hash:          JA3Data.JA3Hash,
-				PeetPrint:        peetfp,
-				PeetPrintHash:    peetprintHash,
-				SessionID:        parsedClientHello.SessionID,
-				ClientRandom:     parsedClientHello.ClientRandom,
-				RawBytes:         clientHelloHex,
-				RawB64:           rawB64,
-			}
+	reaction := trackmehttp.GetHTTP2ClientReaction(frames)
+	connWindow := reaction.ConnectionWindow
+	streamWindow := reaction.InitialStreamWindow
+	for _, wu := range reaction.WindowUpdates {
+		if wu.Stream == stream {
+			streamWindow += int64(wu.Increment)
 		}
+	}
 
-		// Extract settings for fingerprinting
-		var settings []types.Http3SettingPair
-		if h3c.Settings() != nil {
-			for _, pair := range h3c.Settings().RawSettings {
-				settings = append(settings, types.Http3SettingPair{
-					ID:    pair.ID,
-					Name:  trackmehttp.GetHTTP3SettingName(pair.ID),
-					Value: pair.Value,
-				})
+	for len(data) > 0 {
+		n := int64(min(1024, len(data)))
+		n = min(n, connWindow, streamWindow)
+		if n <= 0 {
+			blocked := time.Now()
+			select {
+			case frame := <-c:
+				flow.BlockedMs += time.Since(blocked).Milliseconds()
+				if frame.Type == "ERROR" || frame.Type == "ERROR_CLOSE" {
+					return flow, true
+				}
+				if frame.Type == "WINDOW_UPDATE" {
+					flow.WindowUpdates = append(flow.WindowUpdates, types.Http2WindowUpdate{
+						Index:     len(flow.WindowUpdates),
+						Stream:    frame.Stream,
+						Increment: frame.Increment,
+					})
+					if frame.Stream == 0 {
+						connWindow += int64(frame.Increment)
+					} else if frame.Stream == stream {
+						streamWindow += int64(frame.Increment)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				log.Println("Timed out waiting for HTTP/2 WINDOW_UPDATE")
+				return flow, false
 			}
+			continue
 		}
 
-		// Extract headers in order (pseudo-headers first, then regular headers)
-		var headers []string
-		// Add pseudo-headers in the order they would appear
-		headers = append(headers, fmt.Sprintf(":method: %s", r.Method))
-		headers = append(headers, fmt.Sprintf(":authority: %s", r.Host))
-		headers = append(headers, ":scheme: https")
-		headers = append(headers, fmt.Sprintf(":path: %s", r.URL.RequestURI()))
-		// Add regular headers
-		for name, values := range r.Header {
-			for _, value := range values {
-				headers = append(headers, fmt.Sprintf("%s: %s", strings.ToLower(name), value))
-			}
+		if err := fr.WriteData(stream, false, data[:n]); err != nil {
+			log.Println("Error writing data chunk:", err)
+			return flow, false
 		}
+		data = data[n:]
+		connWindow -= n
+		streamWindow -= n
+		flow.DataFrames++
+	}
 
-		// Generate fingerprint
-		headerOrder := trackmehttp.GetHTTP3HeaderOrder(headers)
-		fingerprint := trackmehttp.GetHTTP3SettingsFingerprint(settings, headerOrder)
-		fingerprintHash := trackmehttp.GetHTTP3FingerprintHash(fingerprint)
-
-		resp := types.Response{
-			Timestamp:   time.Now().UnixMilli(),
-			IP:          r.RemoteAddr,
-			HTTPVersion: "h3",
-			Path:        r.URL.Path,
-			Method:      r.Method,
-			UserAgent:   r.Header.Get("User-Agent"),
-			TLS:         tlsDetails,
-			Http3: &types.Http3Details{
-				Used0RTT:                           h3state.Used0RTT,
-				SupportsDatagrams:                  h3state.SupportsDatagrams,
-				SupportsStreamResetPartialDelivery: h3state.SupportsStreamResetPartialDelivery,
-				Version:                            uint32(h3state.Version),
-				GSO:                                h3state.GSO,
-				Settings:                           settings,
-				AkamaiFingerprint:                  fingerprint,
-				AkamaiFingerprintHash:              fingerprintHash,
-				Headers:                            headers,
-			},
-		}
-
-		res, ctype, err := Router(r.URL.Path, resp, srv)
-		if err != nil {
-			log.Println("Router error:", err)
-			res = []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error()))
-			ctype = "application/json"
-		}
+	if err := fr.WriteData(stream, true, []byte{}); err != nil {
+		log.Println("Error writing final data frame:", err)
+	}
+	flow.DataFrames++
+	return flow, false
+}
 
-		w.Header().Set("Content-Type", ctype)
-		w.Header().Set("Server", "cloudflare")
-		w.Header().Set("Date", cloudflareHTTPDate())
-		w.Header().Set("Cf-Cache-Status", "DYNAMIC")
-		w.Header().Set("Vary", "Accept-Encoding")
-		w.Header().Set("Alt-Svc", `h3=":443"; ma=86400`)
-		if _, err := w.Write(res); err != nil {
-			log.Println("Error writing HTTP/3 response:", err)
+// collectHTTP2Frames passes the frames received within the timeout to fn (0 waits until the connection is closed).
+// It returns whether the connection was closed.
+func collectHTTP2Frames(c chan types.ParsedFrame, timeout time.Duration, fn func(types.ParsedFrame)) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for {
+		select {
+		case frame := <-c:
+			if frame.Type == "ERROR" || frame.Type == "ERROR_CLOSE" {
+				return true
+			}
+			if fn != nil {
+				fn(frame)
+			}
+		case <-deadline:
+			return false
 		}
-	})
+	}
+}
 
-	return mux
+// logHTTP2ResponseFlow logs how the client handled flow control while receiving the response.
+// It happens after the response was sent, so it can only be part of the logs.
+func (srv *Server) logHTTP2ResponseFlow(flow *types.Http2ResponseFlow) {
+	slog.Debug("h2 response flow", "log_id", flow.LogID, "ip", cleanIP(flow.IP), "protocol", "h2",
+		"bytes", flow.ResponseSize, "data_frames", flow.DataFrames, "window_updates", len(flow.WindowUpdates),
+		"blocked_ms", flow.BlockedMs)
+
+	srv.writeRequestLog(struct {
+		Type string `json:"type"`
+		*types.Http2ResponseFlow
+	}{"h2_response_flow", flow})
 }
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseHTTP1ObsFold(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    string
+		headers []string
+		valid   bool
+	}{
+		{
+			name:    "plain",
+			head:    "GET / HTTP/1.1\r\nHost: a\r\nX-A: 1\r\n\r\n",
+			headers: []string{"Host: a", "X-A: 1"},
+			valid:   true,
+		},
+		{
+			name:    "folded value",
+			head:    "GET / HTTP/1.1\r\nHost: a\r\nX-A: 1\r\n  2\r\n\t3\r\n\r\n",
+			headers: []string{"Host: a", "X-A: 1 2 3"},
+			valid:   true,
+		},
+		{
+			name:    "folded header line",
+			head:    "GET / HTTP/1.1\r\nHost: a\r\nX-A: 1\r\n Transfer-Encoding: chunked\r\n\r\n",
+			headers: []string{"Host: a", "X-A: 1 Transfer-Encoding: chunked"},
+			valid:   true,
+		},
+		{
+			name:  "folded first header",
+			head:  "GET / HTTP/1.1\r\n Host: a\r\n\r\n",
+			valid: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := parseHTTP1([]byte(tt.head))
+			if (req.Http1 != nil) != tt.valid {
+				t.Fatalf("valid = %v, want %v", req.Http1 != nil, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			if !slices.Equal(req.Http1.Headers, tt.headers) {
+				t.Errorf("headers = %q, want %q", req.Http1.Headers, tt.headers)
+			}
+			if te := http1HeaderValues(req.Http1.Headers, "transfer-encoding"); len(te) > 0 {
+				t.Errorf("transfer-encoding = %v, want none", te)
+			}
+		})
+	}
+}
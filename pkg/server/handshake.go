@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+// pendingHandshake is what GetConfigForClient learned about a connection, until its handshake is done
+type pendingHandshake struct {
+	conn *utls.Conn
+	// clientHello is the first ClientHello, after a HelloRetryRequest conn.ClientHello holds the second one
+	clientHello string
+	retryGroup  uint16
+
+	link     *trackingLink
+	linkedBy string
+}
+
+// handshakes holds the TLS connections whose handshake is in progress, by their underlying connection
+type handshakes struct {
+	mu      sync.Mutex
+	pending map[net.Conn]*pendingHandshake
+}
+
+// register adds a connection before its handshake
+func (h *handshakes) register(conn *utls.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		h.pending = map[net.Conn]*pendingHandshake{}
+	}
+	h.pending[conn.NetConn()] = &pendingHandshake{conn: conn}
+}
+
+// unregister removes a connection and returns what was learned about it, nil if it wasn't registered
+func (h *handshakes) unregister(conn *utls.Conn) *pendingHandshake {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.pending[conn.NetConn()]
+	delete(h.pending, conn.NetConn())
+	return p
+}
+
+func (h *handshakes) get(rawConn net.Conn) *pendingHandshake {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pending[rawConn]
+}
+
+// forceHelloRetry reports whether connections to serverName get a HelloRetryRequest
+func (srv *Server) forceHelloRetry(serverName string) bool {
+	c := srv.GetConfig()
+	return c.ForceHelloRetry || slices.ContainsFunc(c.HelloRetryServerNames, func(name string) bool {
+		return strings.EqualFold(name, serverName)
+	})
+}
+
+// GetConfigForClient returns the callback for utls.Config.GetConfigForClient. It selects the certificate
+// of the virtual host, gives every connection its own session ticket key (see sessionTracker) and forces
+// a HelloRetryRequest if configured, by only accepting a group the client sent no key share for.
+func (srv *Server) GetConfigForClient(base *utls.Config) func(*utls.ClientHelloInfo) (*utls.Config, error) {
+	return func(chi *utls.ClientHelloInfo) (*utls.Config, error) {
+		p := srv.State.Handshakes.get(chi.Conn)
+		if p == nil {
+			return nil, nil
+		}
+		p.clientHello = p.conn.ClientHello
+		hello := tls.ParseClientHello(p.clientHello)
+
+		config := base.Clone()
+		config.SetSessionTicketKeys(srv.State.Tracking.ticketKeys(p, hello))
+		if h := srv.State.VirtualHosts.get(chi.ServerName); h != nil {
+			config.Certificates = []utls.Certificate{h.utlsCert}
+		}
+		if srv.forceHelloRetry(chi.ServerName) {
+			if group, ok := tls.HelloRetryGroup(hello); ok {
+				config.CurvePreferences = []utls.CurveID{utls.CurveID(group)}
+				p.retryGroup = group
+			}
+		}
+		return config, nil
+	}
+}
+
+// getHelloRetry fingerprints the second ClientHello of a connection that got a HelloRetryRequest, nil if it didn't
+func getHelloRetry(p *pendingHandshake, first tls.ClientHello) (*types.TLSHelloRetry, error) {
+	if p == nil || p.retryGroup == 0 || p.conn.ClientHello == p.clientHello {
+		return nil, nil
+	}
+	details, retry, err := getTLSDetails(p.conn, p.conn.ClientHello)
+	if err != nil {
+		return nil, err
+	}
+	details.JA4 = tls.CalculateJa4(details)
+	details.JA4_r = tls.CalculateJa4_r(details)
+
+	r := tls.CompareHelloRetry(first, retry)
+	r.Group = types.GetCurveNameByID(p.retryGroup)
+	r.ClientHello = details
+	return r, nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/metrics"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const (
+	// maxHTTP1HeadSize limits the request line and headers
+	maxHTTP1HeadSize = 64 << 10
+	// maxRequestBodySize limits the request body, only the first trackmehttp.MaxBodySize bytes of it are kept
+	maxRequestBodySize = 32 << 20
+	// maxHTTP1Requests is the number of requests answered on one keep-alive connection
+	maxHTTP1Requests = 100
+	// http1IdleTimeout is how long a keep-alive connection may wait for the next request
+	http1IdleTimeout = 5 * time.Second
+)
+
+var (
+	errHTTP1HeadTooLarge = errors.New("request head too large")
+	errHTTP1BodyTooLarge = errors.New("request body too large")
+	errHTTP1Malformed    = errors.New("malformed request")
+)
+
+// isHTTP2Preface checks if the connection starts with the HTTP/2 preface. It only waits for as
+// many bytes as needed, so short HTTP/1 requests don't block it.
+func isHTTP2Preface(r *bufio.Reader) (bool, error) {
+	for n := 1; n <= len(HTTP2_PREAMBLE); n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		if b[n-1] != HTTP2_PREAMBLE[n-1] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(line) == 1 || (len(line) == 2 && line[0] == '\r')
+}
+
+// readHTTP1Head reads the request line and the headers, including the empty line ending them
+func readHTTP1Head(r *bufio.Reader) ([]byte, error) {
+	var head []byte
+	var read int
+	partial := false
+	for {
+		line, err := r.ReadSlice('\n')
+		read += len(line)
+		if read > maxHTTP1HeadSize {
+			return nil, errHTTP1HeadTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			// The line is longer than the buffer, the rest follows with the next read
+			head = append(head, line...)
+			partial = true
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && read > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if !partial && isEmptyLine(line) {
+			// Empty lines before the request line are ignored (RFC 9112, section 2.2)
+			if len(head) == 0 {
+				continue
+			}
+			return append(head, line...), nil
+		}
+		head = append(head, line...)
+		partial = false
+	}
+}
+
+// readHTTP1Line reads a line of a chunked body without its line ending
+func readHTTP1Line(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errHTTP1Malformed
+	}
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readBodyData reads n bytes of body data, keeping at most trackmehttp.MaxBodySize bytes in total
+func readBodyData(r *bufio.Reader, n int64, body []byte) ([]byte, error) {
+	keep := min(n, int64(max(trackmehttp.MaxBodySize-len(body), 0)))
+	start := len(body)
+	body = append(body, make([]byte, keep)...)
+	if _, err := io.ReadFull(r, body[start:]); err != nil {
+		return body, err
+	}
+	if _, err := io.CopyN(io.Discard, r, n-keep); err != nil {
+		return body, err
+	}
+	return body, nil
+}
+
+// readHTTP1ChunkedBody decodes a chunked body and returns the data, its total size and the size of each chunk
+// https://www.rfc-editor.org/rfc/rfc9112#section-7.1
+func readHTTP1ChunkedBody(r *bufio.Reader) ([]byte, int, []int, error) {
+	var body []byte
+	var size int
+	chunks := []int{}
+	for {
+		line, err := readHTTP1Line(r)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		sizeField, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || n < 0 {
+			return nil, 0, nil, errHTTP1Malformed
+		}
+		if n == 0 {
+			break
+		}
+		size += int(n)
+		if size > maxRequestBodySize {
+			return nil, 0, nil, errHTTP1BodyTooLarge
+		}
+		chunks = append(chunks, int(n))
+		if body, err = readBodyData(r, n, body); err != nil {
+			return nil, 0, nil, err
+		}
+		if line, err := readHTTP1Line(r); err != nil || line != "" {
+			return nil, 0, nil, errHTTP1Malformed
+		}
+	}
+
+	// Skip the trailer section
+	for {
+		line, err := readHTTP1Line(r)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if line == "" {
+			return body, size, chunks, nil
+		}
+	}
+}
+
+// http1HeaderValues returns all values of a header, with comma separated lists split up
+func http1HeaderValues(headers []string, name string) []string {
+	var values []string
+	for _, h := range headers {
+		if val := parseHeaderValueFold(h, name); val != "" {
+			for _, v := range strings.Split(val, ",") {
+				values = append(values, strings.ToLower(strings.TrimSpace(v)))
+			}
+		}
+	}
+	return values
+}
+
+// http1KeepAlive decides if the connection stays open after the response
+func http1KeepAlive(req types.Response) bool {
+	connection := http1HeaderValues(req.Http1.Headers, "connection")
+	has := func(token string) bool {
+		for _, v := range connection {
+			if v == token {
+				return true
+			}
+		}
+		return false
+	}
+	switch req.HTTPVersion {
+	case "HTTP/1.1":
+		return !has("close")
+	case "HTTP/1.0":
+		return has("keep-alive")
+	}
+	return false
+}
+
+// readHTTP1Request reads one complete request, including its body
+// https://www.rfc-editor.org/rfc/rfc9112#section-6.3
+func readHTTP1Request(r *bufio.Reader) (types.Response, error) {
+	head, err := readHTTP1Head(r)
+	if err != nil {
+		return types.Response{}, err
+	}
+	req := parseHTTP1(head)
+	if req.Http1 == nil {
+		return req, errHTTP1Malformed
+	}
+	req.Http1.KeepAlive = http1KeepAlive(req)
+
+	// Keep the parameters (boundary etc.) and their case
+	var contentType string
+	for _, h := range req.Http1.Headers {
+		if val := parseHeaderValueFold(h, "content-type"); val != "" {
+			contentType = val
+			break
+		}
+	}
+
+	if te := http1HeaderValues(req.Http1.Headers, "transfer-encoding"); len(te) > 0 {
+		if te[len(te)-1] != "chunked" {
+			return req, errHTTP1Malformed
+		}
+		body, size, chunks, err := readHTTP1ChunkedBody(r)
+		if err != nil {
+			return req, err
+		}
+		req.Http1.Chunked = true
+		req.Http1.ChunkSizes = chunks
+		req.Http1.Body = trackmehttp.DecodeBody(contentType, body, size)
+		return req, nil
+	}
+
+	if cl := http1HeaderValues(req.Http1.Headers, "content-length"); len(cl) > 0 {
+		n, err := strconv.ParseInt(cl[0], 10, 64)
+		if err != nil || n < 0 {
+			return req, errHTTP1Malformed
+		}
+		for _, v := range cl[1:] {
+			if v != cl[0] {
+				return req, errHTTP1Malformed
+			}
+		}
+		if n > maxRequestBodySize {
+			return req, errHTTP1BodyTooLarge
+		}
+		body, err := readBodyData(r, n, nil)
+		if err != nil {
+			return req, err
+		}
+		req.Http1.Body = trackmehttp.DecodeBody(contentType, body, int(n))
+	}
+	return req, nil
+}
+
+// writeHTTP1Error answers a request that couldn't be read, the connection is closed afterwards
+func writeHTTP1Error(conn net.Conn, err error) {
+	status := "400 Bad Request"
+	switch {
+	case errors.Is(err, errHTTP1HeadTooLarge):
+		status = "431 Request Header Fields Too Large"
+	case errors.Is(err, errHTTP1BodyTooLarge):
+		status = "413 Content Too Large"
+	case !errors.Is(err, errHTTP1Malformed):
+		// The client went away or timed out, there is nobody to answer
+		return
+	}
+
+	res := "HTTP/1.1 " + status + "\r\n"
+	res += "Content-Length: 0\r\n"
+	res += "Date: " + cloudflareHTTPDate() + "\r\n"
+	res += "Connection: close\r\n"
+	res += "\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		log.Println("Error writing HTTP/1 error:", err)
+	}
+}
+
+// serveHTTP1 reads the requests of a connection one after the other, so every request on a
+// keep-alive connection (pipelined or not) gets its own fingerprint. handle answers a request and
+// returns false if it closed or took over the connection.
+func (srv *Server) serveHTTP1(conn net.Conn, r *bufio.Reader, handle func(types.Response) (bool, error)) error {
+	for i := 0; i < maxHTTP1Requests; i++ {
+		pipelined := i > 0 && r.Buffered() > 0
+		if i > 0 && !pipelined {
+			// A client that doesn't start another request within the idle timeout is done with the connection
+			if err := conn.SetDeadline(time.Now().Add(http1IdleTimeout)); err != nil {
+				return fmt.Errorf("failed to set idle deadline: %w", err)
+			}
+			if _, err := r.Peek(1); err != nil {
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing HTTP/1 connection:", err)
+				}
+				return nil
+			}
+		}
+		// Every request gets the full timeout, the first one already had it for the TLS handshake
+		if i > 0 {
+			if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+				return fmt.Errorf("failed to set request deadline: %w", err)
+			}
+		}
+
+		req, err := readHTTP1Request(r)
+		if err != nil {
+			if isTimeout(err) {
+				metrics.Timeouts.Inc()
+			}
+			writeHTTP1Error(conn, err)
+			return fmt.Errorf("failed to read HTTP/1 request: %w", err)
+		}
+
+		req.IP = conn.RemoteAddr().String()
+		req.ProxyProtocol = getProxyDetails(conn)
+		req.Http1.RequestIndex = i
+		req.Http1.Pipelined = pipelined
+		if i == maxHTTP1Requests-1 {
+			req.Http1.KeepAlive = false
+		}
+
+		cont, err := handle(req)
+		if err != nil || !cont || !req.Http1.KeepAlive {
+			return err
+		}
+	}
+	return nil
+}
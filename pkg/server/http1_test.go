@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestReadHTTP1Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		body    string
+		chunks  []int
+		err     error
+		rest    string // what is left for the next request
+		keepAlv bool
+	}{
+		{
+			name:    "no body",
+			input:   "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			keepAlv: true,
+		},
+		{
+			name:    "content-length",
+			input:   "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET",
+			body:    "hello",
+			rest:    "GET",
+			keepAlv: true,
+		},
+		{
+			name:    "chunked with trailers",
+			input:   "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n1\r\n!\r\n0\r\nX-Trailer: 1\r\nX-Other: 2\r\n\r\nnext",
+			body:    "hello!",
+			chunks:  []int{5, 1},
+			rest:    "next",
+			keepAlv: true,
+		},
+		{
+			name:    "transfer-encoding wins over content-length",
+			input:   "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nnext",
+			body:    "abc",
+			chunks:  []int{3},
+			rest:    "next",
+			keepAlv: true,
+		},
+		{
+			name:    "same content-length twice",
+			input:   "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nhi",
+			body:    "hi",
+			keepAlv: true,
+		},
+		{
+			name:  "conflicting content-length",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nhi!",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "conflicting content-length list",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2, 3\r\n\r\nhi!",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "negative content-length",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "chunked not last",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, gzip\r\n\r\n",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "bad chunk size",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "chunk without CRLF",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcX\r\n0\r\n\r\n",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "truncated body",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\nhi",
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "body too large",
+			input: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999\r\n\r\n",
+			err:   errHTTP1BodyTooLarge,
+		},
+		{
+			name:  "head too large",
+			input: "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", maxHTTP1HeadSize) + "\r\n\r\n",
+			err:   errHTTP1HeadTooLarge,
+		},
+		{
+			name:  "invalid request line",
+			input: "GARBAGE\r\n\r\n",
+			err:   errHTTP1Malformed,
+		},
+		{
+			name:  "connection close",
+			input: "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n",
+		},
+		{
+			name:  "HTTP/1.0",
+			input: "GET / HTTP/1.0\r\n\r\n",
+		},
+		{
+			name:    "HTTP/1.0 keep-alive",
+			input:   "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+			keepAlv: true,
+		},
+		{
+			name:    "empty lines before the request",
+			input:   "\r\n\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+			keepAlv: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			req, err := readHTTP1Request(r)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Http1.KeepAlive != tt.keepAlv {
+				t.Errorf("keep-alive = %v, want %v", req.Http1.KeepAlive, tt.keepAlv)
+			}
+			var body string
+			if req.Http1.Body != nil {
+				body = req.Http1.Body.Text
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if len(tt.chunks) > 0 && !slices.Equal(req.Http1.ChunkSizes, tt.chunks) {
+				t.Errorf("chunks = %v, want %v", req.Http1.ChunkSizes, tt.chunks)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+// serve runs serveHTTP1 on one end of a pipe and returns the other end and the requests it handled
+func serve(t *testing.T) (net.Conn, chan types.Response, <-chan error) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	requests := make(chan types.Response, maxHTTP1Requests+1)
+	done := make(chan error, 1)
+	srv := NewServer()
+	go func() {
+		done <- srv.serveHTTP1(server, bufio.NewReader(server), func(req types.Response) (bool, error) {
+			requests <- req
+			_, err := server.Write([]byte("ok"))
+			return true, err
+		})
+		server.Close()
+	}()
+	return client, requests, done
+}
+
+func TestServeHTTP1Pipelining(t *testing.T) {
+	client, requests, done := serve(t)
+	go client.Write([]byte("GET /a HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\nHost: a\r\n\r\nGET /c HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(requests)
+
+	var paths []string
+	for req := range requests {
+		if req.Http1.RequestIndex != len(paths) {
+			t.Errorf("%s has index %d", req.Path, req.Http1.RequestIndex)
+		}
+		if pipelined := req.Http1.RequestIndex > 0; req.Http1.Pipelined != pipelined {
+			t.Errorf("%s pipelined = %v, want %v", req.Path, req.Http1.Pipelined, pipelined)
+		}
+		paths = append(paths, req.Path)
+	}
+	if !slices.Equal(paths, []string{"/a", "/b", "/c"}) {
+		t.Errorf("paths = %v", paths)
+	}
+}
+
+func TestServeHTTP1KeepAliveLimit(t *testing.T) {
+	client, requests, done := serve(t)
+	go func() {
+		for i := 0; i < maxHTTP1Requests+5; i++ {
+			if _, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(io.Discard, client)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the connection wasn't closed after the last request")
+	}
+	if n := len(requests); n != maxHTTP1Requests {
+		t.Errorf("answered %d requests, want %d", n, maxHTTP1Requests)
+	}
+	var last types.Response
+	for len(requests) > 0 {
+		last = <-requests
+	}
+	if last.Http1.KeepAlive {
+		t.Error("the last request allows keep-alive")
+	}
+}
+
+func TestServeHTTP1Malformed(t *testing.T) {
+	client, requests, done := serve(t)
+	go client.Write([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab"))
+	response, _ := io.ReadAll(client)
+	if !strings.HasPrefix(string(response), "HTTP/1.1 400 Bad Request\r\n") {
+		t.Errorf("response = %q, want 400", response)
+	}
+	if err := <-done; !errors.Is(err, errHTTP1Malformed) {
+		t.Errorf("err = %v, want errHTTP1Malformed", err)
+	}
+	if len(requests) != 0 {
+		t.Error("the malformed request was handled")
+	}
+}
@@ -0,0 +1,619 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/quic-go"
+	"github.com/pagpeter/quic-go/quicvarint"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/metrics"
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/quic-go/qpack"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9114#section-6.2
+const (
+	http3StreamControl      = 0x00
+	http3StreamQPACKEncoder = 0x02
+	http3StreamQPACKDecoder = 0x03
+)
+
+// https://www.rfc-editor.org/rfc/rfc9114#section-7.2
+const (
+	http3FrameData               = 0x00
+	http3FrameHeaders            = 0x01
+	http3FrameCancelPush         = 0x03
+	http3FrameSettings           = 0x04
+	http3FrameGoAway             = 0x07
+	http3FrameMaxPushID          = 0x0d
+	http3FramePriorityUpdate     = 0xf0700
+	http3FramePriorityUpdatePush = 0xf0701
+)
+
+// https://www.rfc-editor.org/rfc/rfc9114#section-8.1
+const (
+	http3ErrNoError           = 0x100
+	http3ErrInternalError     = 0x102
+	http3ErrStreamCreation    = 0x103
+	http3ErrFrameUnexpected   = 0x105
+	http3ErrFrameError        = 0x106
+	http3ErrRequestIncomplete = 0x10d
+	http3ErrMessageError      = 0x10e
+	qpackErrDecompression     = 0x200
+	qpackErrEncoderStream     = 0x201
+)
+
+// https://www.rfc-editor.org/rfc/rfc9204#section-5
+const (
+	http3SettingQPACKMaxTableCapacity = 0x01
+	http3SettingQPACKBlockedStreams   = 0x07
+	http3SettingEnableConnectProtocol = 0x08
+
+	// The dynamic table size and blocked streams the client may use, like Chrome's own limits
+	qpackMaxTableCapacity = 4096
+	qpackBlockedStreams   = 16
+)
+
+const (
+	// maxHTTP3FrameSize limits HEADERS frames and control stream frames
+	maxHTTP3FrameSize = 64 << 10
+	// http3SettingsTimeout is how long a request waits for the client's SETTINGS
+	http3SettingsTimeout = 500 * time.Millisecond
+	// http3RequestTimeout is how long the client has to send the complete request
+	http3RequestTimeout = 10 * time.Second
+	// http3BlockedTimeout is how long a request waits for the dynamic table entries it refers to
+	http3BlockedTimeout = 2 * time.Second
+)
+
+var errHTTP3FrameTooLarge = errors.New("HTTP/3 frame too large")
+
+// http3Conn holds what the client sent on its unidirectional streams
+type http3Conn struct {
+	conn  *quic.Conn
+	qpack *trackmehttp.QPACKDecoder
+
+	// decoder is our QPACK decoder stream, it acknowledges the client's dynamic table inserts
+	decoderMu sync.Mutex
+	decoder   *quic.SendStream
+
+	mu               sync.Mutex
+	settings         []types.Http3SettingPair
+	settingsReceived chan struct{}
+	settingsOnce     sync.Once
+	// critical are the control and QPACK stream types the client opened, each is allowed once
+	critical map[uint64]bool
+	streams  []types.Http3Stream
+	frames   []types.Http3Frame
+}
+
+// recoverHTTP3 is deferred by the goroutines of a connection, the recover around HandleHTTP3Connection
+// doesn't cover them. It logs the panic and calls abort.
+func recoverHTTP3(c *http3Conn, abort func()) {
+	if r := recover(); r != nil {
+		metrics.Panics.Inc()
+		slog.Error("recovered from a panic in the HTTP/3 handler", "ip", c.conn.RemoteAddr().String(),
+			"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		abort()
+	}
+}
+
+// close closes the connection with an HTTP/3 error code
+func (c *http3Conn) close(code uint64, reason string) {
+	c.conn.CloseWithError(quic.ApplicationErrorCode(code), reason)
+}
+
+// readHTTP3FrameHeader reads the type and length of the next frame
+func readHTTP3FrameHeader(r quicvarint.Reader) (uint64, uint64, error) {
+	t, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	l, err := quicvarint.Read(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	return t, l, nil
+}
+
+// readHTTP3FramePayload reads a frame payload that has to be kept in memory
+func readHTTP3FramePayload(r io.Reader, l uint64) ([]byte, error) {
+	if l > maxHTTP3FrameSize {
+		return nil, errHTTP3FrameTooLarge
+	}
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func appendHTTP3Frame(b []byte, t uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, t)
+	b = quicvarint.Append(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// parseHTTP3Settings parses the payload of a SETTINGS frame, keeping the order the client used
+func parseHTTP3Settings(payload []byte) ([]types.Http3SettingPair, error) {
+	r := bytes.NewReader(payload)
+	settings := []types.Http3SettingPair{}
+	for r.Len() > 0 {
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			return nil, err
+		}
+		val, err := quicvarint.Read(r)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, types.Http3SettingPair{
+			ID:    id,
+			Name:  trackmehttp.GetHTTP3SettingName(id),
+			Value: val,
+		})
+	}
+	return settings, nil
+}
+
+// newHTTP3Frame describes a frame with the given header
+func newHTTP3Frame(str quic.StreamID, t, l uint64) types.Http3Frame {
+	return types.Http3Frame{
+		StreamID: uint64(str),
+		Type:     trackmehttp.GetHTTP3FrameName(t),
+		TypeID:   t,
+		Length:   l,
+	}
+}
+
+// parseHTTP3ControlFrame adds the content of a control stream frame
+func parseHTTP3ControlFrame(f *types.Http3Frame, payload []byte) error {
+	r := bytes.NewReader(payload)
+	switch f.TypeID {
+	case http3FrameSettings:
+		settings, err := parseHTTP3Settings(payload)
+		if err != nil {
+			return err
+		}
+		f.Settings = settings
+	case http3FrameCancelPush, http3FrameGoAway, http3FrameMaxPushID:
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			return err
+		}
+		f.ID = &id
+	case http3FramePriorityUpdate, http3FramePriorityUpdatePush:
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			return err
+		}
+		f.PriorityUpdate = &types.Http3PriorityUpdate{
+			ElementID: id,
+			Priority:  string(payload[len(payload)-r.Len():]),
+		}
+	default:
+		f.Payload = payload
+	}
+	return nil
+}
+
+// writeSettings opens our control stream and QPACK decoder stream. They have to stay open for the
+// lifetime of the connection.
+func (c *http3Conn) writeSettings() error {
+	str, err := c.conn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	// The QPACK dynamic table is allowed so clients encode their requests like they do with real servers
+	var settings []byte
+	for _, setting := range [][2]uint64{
+		{http3SettingQPACKMaxTableCapacity, qpackMaxTableCapacity},
+		{http3SettingQPACKBlockedStreams, qpackBlockedStreams},
+		{http3SettingEnableConnectProtocol, 1},
+	} {
+		settings = quicvarint.Append(settings, setting[0])
+		settings = quicvarint.Append(settings, setting[1])
+	}
+
+	b := quicvarint.Append(nil, http3StreamControl)
+	b = appendHTTP3Frame(b, http3FrameSettings, settings)
+	if _, err = str.Write(b); err != nil {
+		return err
+	}
+
+	if c.decoder, err = c.conn.OpenUniStream(); err != nil {
+		return err
+	}
+	return c.writeDecoderStream(quicvarint.Append(nil, http3StreamQPACKDecoder))
+}
+
+// writeDecoderStream sends QPACK decoder instructions
+func (c *http3Conn) writeDecoderStream(b []byte) error {
+	c.decoderMu.Lock()
+	defer c.decoderMu.Unlock()
+	_, err := c.decoder.Write(b)
+	return err
+}
+
+func (c *http3Conn) acceptUniStreams() {
+	defer recoverHTTP3(c, func() { c.close(http3ErrInternalError, "") })
+	for {
+		str, err := c.conn.AcceptUniStream(c.conn.Context())
+		if err != nil {
+			return
+		}
+		go c.handleUniStream(str)
+	}
+}
+
+func (c *http3Conn) handleUniStream(str *quic.ReceiveStream) {
+	defer recoverHTTP3(c, func() { c.close(http3ErrInternalError, "") })
+	r := bufio.NewReader(str)
+	streamType, err := quicvarint.Read(r)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.streams = append(c.streams, types.Http3Stream{
+		StreamID: uint64(str.StreamID()),
+		Type:     trackmehttp.GetHTTP3StreamTypeName(streamType),
+		TypeID:   streamType,
+	})
+	duplicate := false
+	switch streamType {
+	case http3StreamControl, http3StreamQPACKEncoder, http3StreamQPACKDecoder:
+		duplicate = c.critical[streamType]
+		c.critical[streamType] = true
+	}
+	c.mu.Unlock()
+	// https://www.rfc-editor.org/rfc/rfc9114#section-6.2.1
+	if duplicate {
+		c.close(http3ErrStreamCreation, "duplicate "+trackmehttp.GetHTTP3StreamTypeName(streamType)+" stream")
+		return
+	}
+
+	switch streamType {
+	case http3StreamControl:
+	case http3StreamQPACKEncoder:
+		err := c.qpack.ReadEncoderStream(r, func(increment uint64) {
+			if err := c.writeDecoderStream(trackmehttp.AppendQPACKInsertCountIncrement(nil, increment)); err != nil {
+				log.Println("Error writing QPACK Insert Count Increment:", err)
+			}
+		})
+		if err != nil {
+			c.close(qpackErrEncoderStream, err.Error())
+		}
+		return
+	case http3StreamQPACKDecoder:
+		// The responses don't use the dynamic table, so there is nothing to do with the client's instructions
+		_, _ = io.Copy(io.Discard, r)
+		return
+	default:
+		// Unknown (GREASE) and push streams
+		str.CancelRead(quic.StreamErrorCode(http3ErrStreamCreation))
+		return
+	}
+
+	first := true
+	for {
+		t, l, err := readHTTP3FrameHeader(r)
+		if err != nil {
+			return
+		}
+		payload, err := readHTTP3FramePayload(r, l)
+		if err != nil {
+			c.conn.CloseWithError(quic.ApplicationErrorCode(http3ErrFrameError), "")
+			return
+		}
+		// The control stream starts with the only SETTINGS frame
+		if first != (t == http3FrameSettings) {
+			c.conn.CloseWithError(quic.ApplicationErrorCode(http3ErrFrameUnexpected), "unexpected SETTINGS")
+			return
+		}
+		first = false
+
+		frame := newHTTP3Frame(str.StreamID(), t, l)
+		if err := parseHTTP3ControlFrame(&frame, payload); err != nil {
+			c.conn.CloseWithError(quic.ApplicationErrorCode(http3ErrFrameError), "")
+			return
+		}
+		c.mu.Lock()
+		c.frames = append(c.frames, frame)
+		if t == http3FrameSettings {
+			c.settings = frame.Settings
+		}
+		c.mu.Unlock()
+		if t == http3FrameSettings {
+			c.settingsOnce.Do(func() { close(c.settingsReceived) })
+		}
+	}
+}
+
+// getControlStreams waits a bit for the client's SETTINGS, they can arrive after the request.
+// It returns the SETTINGS, the unidirectional streams and the control stream frames received so far.
+func (c *http3Conn) getControlStreams() ([]types.Http3SettingPair, []types.Http3Stream, []types.Http3Frame) {
+	select {
+	case <-c.settingsReceived:
+	case <-time.After(http3SettingsTimeout):
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	streams := append([]types.Http3Stream{}, c.streams...)
+	frames := append([]types.Http3Frame{}, c.frames...)
+	return c.settings, streams, frames
+}
+
+// HandleHTTP3Connection serves the requests of a QUIC connection. Like HTTP/2 in handleHTTP2, HTTP/3
+// is handled here directly, so the frames and field sections are available exactly as the client sent them.
+func (srv *Server) HandleHTTP3Connection(conn *quic.Conn) {
+	metrics.Connections.Inc("h3")
+	c := &http3Conn{
+		conn:             conn,
+		qpack:            trackmehttp.NewQPACKDecoder(qpackMaxTableCapacity, qpackBlockedStreams),
+		settingsReceived: make(chan struct{}),
+		critical:         map[uint64]bool{},
+	}
+	if err := c.writeSettings(); err != nil {
+		log.Println("Error writing HTTP/3 settings:", err)
+		conn.CloseWithError(quic.ApplicationErrorCode(http3ErrNoError), "")
+		return
+	}
+	go c.acceptUniStreams()
+
+	for {
+		str, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		go srv.handleHTTP3Stream(c, str)
+	}
+}
+
+// cancelHTTP3Stream aborts a request stream in both directions
+func cancelHTTP3Stream(str *quic.Stream, code uint64) {
+	str.CancelRead(quic.StreamErrorCode(code))
+	str.CancelWrite(quic.StreamErrorCode(code))
+}
+
+func (srv *Server) handleHTTP3Stream(c *http3Conn, str *quic.Stream) {
+	defer recoverHTTP3(c, func() { cancelHTTP3Stream(str, http3ErrInternalError) })
+	if err := str.SetReadDeadline(time.Now().Add(http3RequestTimeout)); err != nil {
+		log.Println("Error setting HTTP/3 read deadline:", err)
+	}
+	r := bufio.NewReader(str)
+
+	// Unknown frames may come before the HEADERS frame and are skipped
+	var block []byte
+	var frames []types.Http3Frame
+	for block == nil {
+		t, l, err := readHTTP3FrameHeader(r)
+		if err != nil {
+			cancelHTTP3Stream(str, http3ErrRequestIncomplete)
+			return
+		}
+		frame := newHTTP3Frame(str.StreamID(), t, l)
+		switch t {
+		case http3FrameHeaders:
+			if block, err = readHTTP3FramePayload(r, l); err != nil {
+				cancelHTTP3Stream(str, http3ErrFrameError)
+				return
+			}
+		case http3FrameData, http3FrameSettings:
+			c.conn.CloseWithError(quic.ApplicationErrorCode(http3ErrFrameUnexpected), "expected HEADERS")
+			return
+		default:
+			if frame.Payload, err = readHTTP3FramePayload(r, l); err != nil {
+				cancelHTTP3Stream(str, http3ErrFrameError)
+				return
+			}
+		}
+		frames = append(frames, frame)
+	}
+
+	// The rest of the stream is the body, trailers are ignored
+	var body []byte
+	var size int
+	for {
+		t, l, err := readHTTP3FrameHeader(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cancelHTTP3Stream(str, http3ErrRequestIncomplete)
+			return
+		}
+		frames = append(frames, newHTTP3Frame(str.StreamID(), t, l))
+		if t == http3FrameData {
+			size += int(l)
+			if size > maxRequestBodySize {
+				cancelHTTP3Stream(str, http3ErrMessageError)
+				return
+			}
+			body, err = readBodyData(r, int64(l), body)
+		} else {
+			_, err = r.Discard(int(l))
+		}
+		if err != nil {
+			cancelHTTP3Stream(str, http3ErrRequestIncomplete)
+			return
+		}
+	}
+
+	fields, acknowledge, blocked, err := c.qpack.Decode(block, http3BlockedTimeout)
+	if err != nil {
+		c.close(qpackErrDecompression, err.Error())
+		return
+	}
+	if acknowledge {
+		if err := c.writeDecoderStream(trackmehttp.AppendQPACKSectionAck(nil, uint64(str.StreamID()))); err != nil {
+			log.Println("Error writing QPACK Section Acknowledgment:", err)
+		}
+	}
+
+	// Keep the headers in the order the client sent them, pseudo-headers included
+	var headers, names []string
+	var method, path, userAgent, contentType string
+	for _, f := range fields {
+		names = append(names, f.Name)
+		headers = append(headers, fmt.Sprintf("%s: %s", f.Name, f.Value))
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":path":
+			path = f.Value
+		case "user-agent":
+			userAgent = f.Value
+		case "content-type":
+			contentType = f.Value
+		}
+	}
+	if method == "" || path == "" {
+		cancelHTTP3Stream(str, http3ErrMessageError)
+		return
+	}
+
+	qpackDetails, err := trackmehttp.GetQPACKDetails(block, names)
+	if err != nil {
+		log.Println("Error parsing QPACK field section:", err)
+	} else {
+		qpackDetails.Blocked = blocked
+		qpackDetails.DynamicTableCapacity, qpackDetails.InsertCount = c.qpack.Inserts()
+	}
+
+	settings, streams, controlFrames := c.getControlStreams()
+
+	resp := types.Response{
+		Timestamp:   time.Now().UnixMilli(),
+		IP:          c.conn.RemoteAddr().String(),
+		HTTPVersion: "h3",
+		Path:        path,
+		Method:      method,
+		UserAgent:   userAgent,
+		TLS:         getHTTP3TLSDetails(c.conn.ConnectionState()),
+		Http3:       getHTTP3Details(c.conn.ConnectionState(), settings, headers),
+	}
+	if resp.TLS != nil {
+		resp.TLS.SNI = srv.State.VirtualHosts.getSNIDetails(c.conn.ConnectionState().TLS.ServerName)
+	}
+	resp.Http3.QPACK = qpackDetails
+	resp.Http3.QUIC = srv.getQUICDetails(c.conn)
+	resp.Http3.Upgrade = srv.getHTTP3Upgrade(resp.IP)
+	resp.Http3.Streams = streams
+	resp.Http3.Frames = append(controlFrames, frames...)
+	if size > 0 || contentType != "" {
+		resp.Http3.Body = trackmehttp.DecodeBody(contentType, body, size)
+	}
+
+	status, retryAfter := http.StatusOK, ""
+	res, ctype, err := Router(path, resp, srv)
+	if err != nil {
+		if status, retryAfter = routerStatus(err); retryAfter == "" {
+			log.Println("Router error:", err)
+		}
+		res = []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error()))
+		ctype = "application/json"
+	}
+
+	if err := writeHTTP3Response(str, method, status, retryAfter, ctype, srv.GetConfig().AltSvcHeader(), res); err != nil {
+		log.Println("Error writing HTTP/3 response:", err)
+		cancelHTTP3Stream(str, http3ErrNoError)
+		return
+	}
+	if err := str.Close(); err != nil {
+		log.Println("Error closing HTTP/3 stream:", err)
+	}
+}
+
+func writeHTTP3Response(str *quic.Stream, method string, status int, retryAfter, ctype, altSvc string, res []byte) error {
+	var headers bytes.Buffer
+	enc := qpack.NewEncoder(&headers)
+	for _, f := range []qpack.HeaderField{
+		{Name: ":status", Value: strconv.Itoa(status)},
+		{Name: "content-type", Value: ctype},
+		{Name: "content-length", Value: strconv.Itoa(len(res))},
+		{Name: "server", Value: "cloudflare"},
+		{Name: "date", Value: cloudflareHTTPDate()},
+		{Name: "cf-cache-status", Value: "DYNAMIC"},
+		{Name: "vary", Value: "Accept-Encoding"},
+	} {
+		if err := enc.WriteField(f); err != nil {
+			return err
+		}
+	}
+	if altSvc != "" {
+		if err := enc.WriteField(qpack.HeaderField{Name: "alt-svc", Value: altSvc}); err != nil {
+			return err
+		}
+	}
+	if retryAfter != "" {
+		if err := enc.WriteField(qpack.HeaderField{Name: "retry-after", Value: retryAfter}); err != nil {
+			return err
+		}
+	}
+
+	b := appendHTTP3Frame(nil, http3FrameHeaders, headers.Bytes())
+	if method != "HEAD" && len(res) > 0 {
+		b = appendHTTP3Frame(b, http3FrameData, res)
+	}
+	_, err := str.Write(b)
+	return err
+}
+
+// getHTTP3TLSDetails extracts the TLS fingerprint from the QUIC ClientHello
+func getHTTP3TLSDetails(state quic.ConnectionState) *types.TLSDetails {
+	if len(state.ClientHello) == 0 {
+		return nil
+	}
+	clientHelloHex := hex.EncodeToString(state.ClientHello)
+	parsedClientHello := tls.ParseClientHello(clientHelloHex)
+	JA3Data := tls.CalculateJA3(parsedClientHello)
+	peetfp, peetprintHash := tls.CalculatePeetPrint(parsedClientHello, JA3Data)
+
+	return &types.TLSDetails{
+		Ciphers:          JA3Data.ReadableCiphers,
+		Extensions:       parsedClientHello.Extensions,
+		RecordVersion:    JA3Data.Version,
+		NegotiatedVesion: fmt.Sprintf("%v", state.TLS.Version),
+		JA3:              JA3Data.JA3,
+		JA3Hash:          JA3Data.JA3Hash,
+		PeetPrint:        peetfp,
+		PeetPrintHash:    peetprintHash,
+		SessionID:        parsedClientHello.SessionID,
+		ClientRandom:     parsedClientHello.ClientRandom,
+		RawBytes:         clientHelloHex,
+		RawB64:           base64.StdEncoding.EncodeToString(state.ClientHello),
+	}
+}
+
+func getHTTP3Details(state quic.ConnectionState, settings []types.Http3SettingPair, headers []string) *types.Http3Details {
+	headerOrder := trackmehttp.GetHTTP3HeaderOrder(headers)
+	fingerprint := trackmehttp.GetHTTP3SettingsFingerprint(settings, headerOrder)
+
+	return &types.Http3Details{
+		Used0RTT:                           state.Used0RTT,
+		SupportsDatagrams:                  state.SupportsDatagrams,
+		SupportsStreamResetPartialDelivery: state.SupportsStreamResetPartialDelivery,
+		Version:                            uint32(state.Version),
+		GSO:                                state.GSO,
+		Settings:                           settings,
+		AkamaiFingerprint:                  fingerprint,
+		AkamaiFingerprintHash:              trackmehttp.GetHTTP3FingerprintHash(fingerprint),
+		Headers:                            headers,
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/pagpeter/trackme/pkg/logfile"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// NewLogger returns the logger configured by log_level and log_format, it writes to w
+func NewLogger(w io.Writer, c *types.Config) (*slog.Logger, error) {
+	var level slog.Level
+	if c.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return nil, fmt.Errorf("invalid log_level: %w", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch c.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log_format %q, use text or json", c.LogFormat)
+}
+
+// newLogID returns a random ID that links the log lines of a request
+func newLogID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns a logger with the fields every log line about a request has
+func requestLogger(res types.Response) *slog.Logger {
+	return slog.With("log_id", res.LogID, "ip", cleanIP(res.IP), "protocol", res.HTTPVersion)
+}
+
+// writeRequestLog appends v to the log_file as one JSON line
+func (srv *Server) writeRequestLog(v any) {
+	w := srv.GetRequestLog()
+	if w == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("failed to marshal request log entry", "error", err)
+		return
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		slog.Error("failed to write request log", "file", w.Path(), "error", err)
+	}
+}
+
+// GetRequestLog returns the log_file writer, nil if no log_file is configured
+func (s *Server) GetRequestLog() *logfile.Writer {
+	return s.State.RequestLog
+}
+
+// SetRequestLog sets the log_file writer
+func (s *Server) SetRequestLog(w *logfile.Writer) {
+	s.State.RequestLog = w
+}
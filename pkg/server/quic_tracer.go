@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pagpeter/quic-go"
+	"github.com/pagpeter/quic-go/logging"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// maxQUICInitialPackets limits how many Initial packets are recorded per connection
+const maxQUICInitialPackets = 16
+
+// quicInitials holds the Initial packets of a connection, written by the connection's tracer
+type quicInitials struct {
+	mu      sync.Mutex
+	details types.QUICDetails
+}
+
+// getQUICFrameName returns the name of a frame as in RFC 9000, "UNKNOWN_<type>" for others
+func getQUICFrameName(frame logging.Frame) string {
+	switch frame.(type) {
+	case *logging.CryptoFrame:
+		return "CRYPTO"
+	case *logging.PingFrame:
+		return "PING"
+	case *logging.AckFrame:
+		return "ACK"
+	case *logging.ConnectionCloseFrame:
+		return "CONNECTION_CLOSE"
+	case *logging.StreamFrame:
+		return "STREAM"
+	case *logging.ResetStreamFrame:
+		return "RESET_STREAM"
+	case *logging.StopSendingFrame:
+		return "STOP_SENDING"
+	case *logging.NewTokenFrame:
+		return "NEW_TOKEN"
+	case *logging.MaxDataFrame:
+		return "MAX_DATA"
+	case *logging.MaxStreamDataFrame:
+		return "MAX_STREAM_DATA"
+	case *logging.MaxStreamsFrame:
+		return "MAX_STREAMS"
+	case *logging.DataBlockedFrame:
+		return "DATA_BLOCKED"
+	case *logging.StreamDataBlockedFrame:
+		return "STREAM_DATA_BLOCKED"
+	case *logging.StreamsBlockedFrame:
+		return "STREAMS_BLOCKED"
+	case *logging.NewConnectionIDFrame:
+		return "NEW_CONNECTION_ID"
+	case *logging.RetireConnectionIDFrame:
+		return "RETIRE_CONNECTION_ID"
+	case *logging.PathChallengeFrame:
+		return "PATH_CHALLENGE"
+	case *logging.PathResponseFrame:
+		return "PATH_RESPONSE"
+	case *logging.HandshakeDoneFrame:
+		return "HANDSHAKE_DONE"
+	case *logging.DatagramFrame:
+		return "DATAGRAM"
+	case *logging.AckFrequencyFrame:
+		return "ACK_FREQUENCY"
+	case *logging.ImmediateAckFrame:
+		return "IMMEDIATE_ACK"
+	default:
+		name := fmt.Sprintf("%T", frame)
+		name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "Frame")
+		return "UNKNOWN_" + strings.ToUpper(name)
+	}
+}
+
+func (q *quicInitials) add(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.details.InitialPackets) >= maxQUICInitialPackets {
+		return
+	}
+	if len(q.details.InitialPackets) == 0 {
+		q.details.Version = fmt.Sprintf("0x%08x", uint32(hdr.Version))
+		q.details.DCIDLength = hdr.DestConnectionID.Len()
+		q.details.SCIDLength = hdr.SrcConnectionID.Len()
+		q.details.TokenLength = len(hdr.Token)
+	}
+
+	p := types.QUICInitialPacket{
+		PacketNumber: int64(hdr.PacketNumber),
+		Size:         int(size),
+		Frames:       []string{},
+		Crypto:       []types.QUICCryptoFrame{},
+	}
+	for _, f := range frames {
+		p.Frames = append(p.Frames, getQUICFrameName(f))
+		if c, ok := f.(*logging.CryptoFrame); ok {
+			p.Crypto = append(p.Crypto, types.QUICCryptoFrame{Offset: int64(c.Offset), Length: int64(c.Length)})
+		}
+	}
+	q.details.InitialPackets = append(q.details.InitialPackets, p)
+}
+
+// QUICTracer records the Initial packets of every connection, it is used as quic.Config.Tracer
+func (s *Server) QUICTracer() func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	return func(ctx context.Context, p logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+		id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+		if !ok || p != logging.PerspectiveServer {
+			return nil
+		}
+		q := &quicInitials{}
+		s.State.QUICInitials.Store(id, q)
+
+		return &logging.ConnectionTracer{
+			ReceivedLongHeaderPacket: func(hdr *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+				if logging.PacketTypeFromHeader(&hdr.Header) == logging.PacketTypeInitial {
+					q.add(hdr, size, frames)
+				}
+			},
+			Close: func() {
+				s.State.QUICInitials.Delete(id)
+			},
+		}
+	}
+}
+
+// getQUICDetails returns the Initial packet fingerprint of a connection, if it was traced
+func (s *Server) getQUICDetails(conn *quic.Conn) *types.QUICDetails {
+	id, ok := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+	v, ok := s.State.QUICInitials.Load(id)
+	if !ok {
+		return nil
+	}
+	q := v.(*quicInitials)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.details.InitialPackets) == 0 {
+		return nil
+	}
+
+	details := q.details
+	details.InitialPackets = append([]types.QUICInitialPacket{}, q.details.InitialPackets...)
+	var transportParameters string
+	if clientHello := conn.ConnectionState().ClientHello; len(clientHello) > 0 {
+		transportParameters = tls.ParseClientHello(hex.EncodeToString(clientHello)).QUICTransportParameters
+	}
+	trackmehttp.GetQUICFingerprint(&details, transportParameters)
+	return &details
+}
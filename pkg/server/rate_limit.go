@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/metrics"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// rateLimitCleanupInterval is how often the buckets that are full again are dropped
+const rateLimitCleanupInterval = time.Minute
+
+// rateLimitLogEvery logs every nth limited request of a client, besides the first one
+const rateLimitLogEvery = 100
+
+// RateLimitError is returned by Router when a client exceeded a rate limit
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit by %s exceeded, retry in %v seconds", e.Key, retryAfterSeconds(e.RetryAfter))
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// routerStatus returns the HTTP status for the error of Router and the value of the Retry-After header.
+// Other errors are returned as JSON with 200.
+func routerStatus(err error) (int, string) {
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		return http.StatusTooManyRequests, strconv.Itoa(retryAfterSeconds(limited.RetryAfter))
+	}
+	return http.StatusOK, ""
+}
+
+// bucket is a token bucket, it holds up to burst tokens and refills rate per second
+type bucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// rateLimiter holds the buckets of every configured limit
+type rateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+// rateLimitKey returns the bucket key of a request for a limit, false if the request has none (no TLS for ja3)
+func rateLimitKey(limit types.RateLimit, res types.Response) (string, bool) {
+	switch limit.Key {
+	case "ip", "subnet":
+		ap, err := netip.ParseAddrPort(res.IP)
+		if err != nil {
+			return "", false
+		}
+		addr := ap.Addr().Unmap()
+		if limit.Key == "ip" {
+			return addr.String(), true
+		}
+		bits := limit.IPv4Prefix
+		if addr.Is6() {
+			bits = limit.IPv6Prefix
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return "", false
+		}
+		return prefix.String(), true
+	case "ja3":
+		if res.TLS == nil || res.TLS.JA3Hash == "" {
+			return "", false
+		}
+		return res.TLS.JA3Hash, true
+	case "ja4":
+		if res.TLS == nil || res.TLS.JA4 == "" {
+			return "", false
+		}
+		return res.TLS.JA4, true
+	}
+	return "", false
+}
+
+// limitApplies reports whether a limit covers path, a limit without paths covers all of them
+func limitApplies(limit types.RateLimit, path string) bool {
+	if len(limit.Paths) == 0 {
+		return true
+	}
+	for _, route := range limit.Paths {
+		if matchRoute(route, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a token from the bucket id, it returns how long to wait if there is none
+func (r *rateLimiter) take(limit types.RateLimit, id string, now time.Time) (time.Duration, uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = map[string]*bucket{}
+	}
+	if now.Sub(r.lastCleanup) > rateLimitCleanupInterval {
+		r.cleanup(now)
+	}
+
+	b, ok := r.buckets[id]
+	if !ok {
+		b = &bucket{rate: limit.Rate, burst: float64(limit.Burst), tokens: float64(limit.Burst), last: now}
+		r.buckets[id] = b
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return 0, 0, true
+	}
+	b.limited++
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), b.limited, false
+}
+
+// cleanup drops the buckets that are full again, a new one is the same
+func (r *rateLimiter) cleanup(now time.Time) {
+	r.lastCleanup = now
+	for id, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(r.buckets, id)
+		}
+	}
+}
+
+// checkRateLimits takes a token from every limit the request falls under, it returns a *RateLimitError for
+// the first one that is exceeded
+func (srv *Server) checkRateLimits(res types.Response, path string) error {
+	now := time.Now()
+	for i, limit := range srv.GetConfig().GetRateLimits() {
+		if !limitApplies(limit, path) {
+			continue
+		}
+		key, ok := rateLimitKey(limit, res)
+		if !ok {
+			continue
+		}
+		wait, limited, ok := srv.State.RateLimits.take(limit, strconv.Itoa(i)+"/"+key, now)
+		if ok {
+			continue
+		}
+		metrics.RateLimited.Inc(limit.Key)
+		if limited == 1 || limited%rateLimitLogEvery == 0 {
+			requestLogger(res).Warn("rate limited", "key", limit.Key, "value", key, "limited", limited)
+		}
+		return &RateLimitError{Key: limit.Key, RetryAfter: wait}
+	}
+	return nil
+}
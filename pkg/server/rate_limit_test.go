@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	limit := types.RateLimit{Key: "ip", Rate: 2, Burst: 3}
+	var r rateLimiter
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, _, ok := r.take(limit, "a", now); !ok {
+			t.Fatalf("request %d of the burst was limited", i)
+		}
+	}
+	wait, limited, ok := r.take(limit, "a", now)
+	if ok || limited != 1 || wait != 500*time.Millisecond {
+		t.Errorf("take() = %v, %d, %v, want a wait of 500ms", wait, limited, ok)
+	}
+	if _, limited, _ := r.take(limit, "a", now.Add(100*time.Millisecond)); limited != 2 {
+		t.Errorf("limited = %d, want 2", limited)
+	}
+	if _, _, ok := r.take(limit, "b", now); !ok {
+		t.Error("another key shares the bucket")
+	}
+
+	// A token is back after half a second, the bucket never holds more than the burst
+	if _, limited, ok := r.take(limit, "a", now.Add(600*time.Millisecond)); !ok || limited != 0 {
+		t.Errorf("take() after the refill = %d, %v", limited, ok)
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, _, ok := r.take(limit, "a", later); !ok {
+			t.Fatalf("request %d after an hour was limited", i)
+		}
+	}
+	if _, _, ok := r.take(limit, "a", later); ok {
+		t.Error("the bucket refilled above the burst")
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	limit := types.RateLimit{Key: "ip", Rate: 1, Burst: 2}
+	var r rateLimiter
+	now := time.Now()
+	r.take(limit, "full", now)
+	r.take(limit, "empty", now.Add(rateLimitCleanupInterval))
+	r.take(limit, "empty", now.Add(rateLimitCleanupInterval))
+
+	// The next take after the interval drops the buckets that have refilled
+	r.take(limit, "new", now.Add(rateLimitCleanupInterval+time.Second))
+	if _, ok := r.buckets["full"]; ok {
+		t.Error("the full bucket wasn't dropped")
+	}
+	if _, ok := r.buckets["empty"]; !ok {
+		t.Error("the empty bucket was dropped")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tls := &types.TLSDetails{JA3Hash: "ja3hash", JA4: "t13d"}
+	tests := []struct {
+		limit types.RateLimit
+		ip    string
+		tls   *types.TLSDetails
+		want  string
+	}{
+		{limit: types.RateLimit{Key: "ip"}, ip: "192.0.2.1:443", want: "192.0.2.1"},
+		{limit: types.RateLimit{Key: "ip"}, ip: "[::ffff:192.0.2.1]:443", want: "192.0.2.1"},
+		{limit: types.RateLimit{Key: "subnet", IPv4Prefix: 24}, ip: "192.0.2.77:443", want: "192.0.2.0/24"},
+		{limit: types.RateLimit{Key: "subnet", IPv6Prefix: 48}, ip: "[2001:db8:1:2::1]:443", want: "2001:db8:1::/48"},
+		{limit: types.RateLimit{Key: "ip"}, ip: "invalid"},
+		{limit: types.RateLimit{Key: "ja3"}, ip: "192.0.2.1:443", tls: tls, want: "ja3hash"},
+		{limit: types.RateLimit{Key: "ja4"}, ip: "192.0.2.1:443", tls: tls, want: "t13d"},
+		{limit: types.RateLimit{Key: "ja4"}, ip: "192.0.2.1:443"},
+		{limit: types.RateLimit{Key: "cookie"}, ip: "192.0.2.1:443", tls: tls},
+	}
+	for _, tt := range tests {
+		t.Run(tt.limit.Key+" "+tt.ip, func(t *testing.T) {
+			key, ok := rateLimitKey(tt.limit, types.Response{IP: tt.ip, TLS: tt.tls})
+			if key != tt.want || ok != (tt.want != "") {
+				t.Errorf("rateLimitKey() = %q, %v, want %q", key, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitApplies(t *testing.T) {
+	limit := types.RateLimit{Paths: []string{"/api/", "/ip"}}
+	for path, want := range map[string]bool{"/ip": true, "/api/all": true, "/api": false, "/ip/x": false, "/": false} {
+		if got := limitApplies(limit, path); got != want {
+			t.Errorf("limitApplies(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if !limitApplies(types.RateLimit{}, "/anything") {
+		t.Error("a limit without paths doesn't apply")
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	srv := NewServer()
+	srv.State.Config.RateLimits = []types.RateLimit{
+		{Key: "ip", Rate: 1, Burst: 2, Paths: []string{"/api/"}},
+		{Key: "ja4", Rate: 0, Burst: 5}, // invalid, ignored
+	}
+	res := types.Response{IP: "192.0.2.1:443"}
+
+	for i := 0; i < 2; i++ {
+		if err := srv.checkRateLimits(res, "/api/all"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	err := srv.checkRateLimits(res, "/api/all")
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || limited.Key != "ip" {
+		t.Fatalf("checkRateLimits() = %v, want a RateLimitError", err)
+	}
+	if status, retryAfter := routerStatus(fmt.Errorf("router: %w", err)); status != http.StatusTooManyRequests || retryAfter != "1" {
+		t.Errorf("routerStatus() = %d, %q, want 429 and 1", status, retryAfter)
+	}
+	if err := srv.checkRateLimits(res, "/"); err != nil {
+		t.Errorf("a path without a limit was limited: %v", err)
+	}
+	if err := srv.checkRateLimits(types.Response{IP: "192.0.2.2:443"}, "/api/all"); err != nil {
+		t.Errorf("another client was limited: %v", err)
+	}
+	if status, retryAfter := routerStatus(errors.New("other")); status != http.StatusOK || retryAfter != "" {
+		t.Errorf("routerStatus() = %d, %q for another error", status, retryAfter)
+	}
+}
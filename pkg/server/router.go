@@ -1,46 +1,49 @@
 package server
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
+	"github.com/pagpeter/trackme/pkg/consistency"
+	"github.com/pagpeter/trackme/pkg/metrics"
 	"github.com/pagpeter/trackme/pkg/tls"
 	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
 )
 
-func Log(msg string) {
-	t := time.Now()
-	formatted := t.Format("2006-01-02 15:04:05")
-	fmt.Printf("[%v] %v\n", formatted, msg)
+func cleanIP(ip string) string {
+	return strings.Replace(strings.Replace(ip, "]", "", -1), "[", "", -1)
 }
 
-// WriteLog appends a JSON string to the configured log file.
-func WriteLog(msg string, logFile string) error {
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// protocolLabel returns the protocol of a request for metrics: h1, h2, h3 or other
+func protocolLabel(httpVersion string) string {
+	switch {
+	case httpVersion == "h2" || httpVersion == "h3":
+		return httpVersion
+	case strings.HasPrefix(httpVersion, "HTTP/1"):
+		return "h1"
 	}
-	defer file.Close()
-
-	_, err = file.WriteString(msg + "\n\n")
-	return err
-}
-
-func cleanIP(ip string) string {
-	return strings.Replace(strings.Replace(ip, "]", "", -1), "[", "", -1)
+	return "other"
 }
 
 // Router returns bytes, content type, and error that should be sent to the client
 func Router(path string, res types.Response, srv *Server) ([]byte, string, error) {
+	// route is the label of the request latency, it is one of the routes so the number of values is bounded
+	start, route := time.Now(), "404"
+	defer func() {
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), route, protocolLabel(res.HTTPVersion))
+	}()
+
+	// Handlers that log after the response set the ID themselves
+	if res.LogID == "" {
+		res.LogID = newLogID()
+	}
 	if v, ok := srv.GetTCPFingerprints().Load(res.IP); ok {
 		res.TCPIP = v.(types.TCPIPDetails)
 	}
+	ja3, ja4 := "-", "-"
 	if res.TLS != nil {
 		// Use QUIC JA4 for HTTP/3 connections
 		if res.HTTPVersion == "h3" {
@@ -50,16 +53,30 @@ func Router(path string, res types.Response, srv *Server) ([]byte, string, error
 			res.TLS.JA4 = tls.CalculateJa4(res.TLS)
 			res.TLS.JA4_r = tls.CalculateJa4_r(res.TLS)
 		}
-		Log(fmt.Sprintf("%v %v %v %v %v", cleanIP(res.IP), res.Method, res.HTTPVersion, res.Path, res.TLS.JA3Hash))
-	} else {
-		Log(fmt.Sprintf("%v %v %v %v %v", cleanIP(res.IP), res.Method, res.HTTPVersion, res.Path, "-"))
+		metrics.JA4s.Add(res.TLS.JA4)
+		ja3, ja4 = res.TLS.JA3Hash, res.TLS.JA4
 	}
-	if srv.GetConfig().LogFile != "" && res.Path != "/favicon.ico" {
-		data, err := json.Marshal(res)
-		if err != nil {
-			log.Printf("failed to marshal request for file logging: %v", err)
-		} else if err := WriteLog(string(data), srv.GetConfig().LogFile); err != nil {
-			log.Printf("failed to write request log file: %v", err)
+	requestLogger(res).Info("request", "method", res.Method, "path", res.Path, "ja3", ja3, "ja4", ja4)
+	// Limited requests are rejected before the more expensive work below
+	routePath, _, _ := strings.Cut(path, "?")
+	if err := srv.checkRateLimits(res, routePath); err != nil {
+		route = "rate_limited"
+		return nil, "", err
+	}
+	if c := srv.GetKnownClients(); c != nil {
+		res.IdentifiedAs = c.Identify(res)
+	}
+	res.Consistency = consistency.Check(res)
+	// Admin requests carry the admin key, so they are kept out of the log file, the database and snapshots
+	private := res.Path == "/favicon.ico" || isAdminPath(res.Path)
+	if !private {
+		srv.writeRequestLog(res)
+	}
+	if d := srv.GetDB(); d != nil && !private {
+		if id, err := d.Save(res); err != nil {
+			log.Printf("failed to save request to database: %v", err)
+		} else {
+			res.RequestID = id
 		}
 	}
 
@@ -74,9 +91,20 @@ func Router(path string, res types.Response, srv *Server) ([]byte, string, error
 		}
 	}
 
-	paths := getAllPaths()
-	if u != nil {
+	if url.Values(m).Get("save") == "1" && !private && u != nil && snapshotPaths[u.Path] {
+		if err := srv.saveSnapshot(&res, url.Values(m).Get("label")); err != nil {
+			return nil, "", err
+		}
+	}
+
+	paths := getAllPaths(srv)
+	if u != nil && srv.routeAllowed(res, u.Path) {
+		if id, ok := strings.CutPrefix(u.Path, "/api/r/"); ok {
+			route = "/api/r/"
+			return apiSnapshot(srv, id)(res, m)
+		}
 		if val, ok := paths[u.Path]; ok {
+			route = u.Path
 			return val(res, m)
 		}
 	}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/pagpeter/trackme/pkg/db"
+	"github.com/pagpeter/trackme/pkg/diff"
 	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
 )
@@ -16,8 +20,22 @@ type RouteHandler func(types.Response, url.Values) ([]byte, string, error)
 
 var (
 	ErrTLSNotAvailable = errors.New("TLS details not available")
+	ErrNoDatabase      = errors.New("not connected to a database")
+	ErrMissingParam    = errors.New("missing parameter: by")
+	ErrMissingAgainst  = errors.New("missing parameter: against (a known client, a snapshot or request ID, or a posted /api/all output)")
+	ErrUnknownClient   = errors.New("unknown client")
+	ErrNoLocalCA       = errors.New("no local CA, the certificate was not generated by TrackMe")
+	ErrAdminDisabled   = errors.New("admin endpoints are disabled, set admin_key")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrUnknownList     = errors.New("unknown list, use block or allow")
 )
 
+// maxSnapshotLabelLength limits the label given with ?save=1&label=
+const maxSnapshotLabelLength = 200
+
+// searchTop is the number of identifiers of each kind returned by the search endpoints
+const searchTop = 10
+
 func staticFile(file string) RouteHandler {
 	return func(types.Response, url.Values) ([]byte, string, error) {
 		b, err := utils.ReadFile(file)
@@ -67,6 +85,14 @@ func apiClean(res types.Response, _ url.Values) ([]byte, string, error) {
 	return []byte(smallRes.ToJson()), "application/json", nil
 }
 
+func apiConsistency(res types.Response, _ url.Values) ([]byte, string, error) {
+	data, err := json.MarshalIndent(res.Consistency, "", "  ")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal consistency checks: %w", err)
+	}
+	return data, "application/json", nil
+}
+
 func apiRaw(res types.Response, _ url.Values) ([]byte, string, error) {
 	if res.TLS == nil {
 		return nil, "", ErrTLSNotAvailable
@@ -74,16 +100,144 @@ func apiRaw(res types.Response, _ url.Values) ([]byte, string, error) {
 	return []byte(fmt.Sprintf(`{"raw": "%s", "raw_b64": "%s"}`, res.TLS.RawBytes, res.TLS.RawB64)), "application/json", nil
 }
 
-func index(r types.Response, v url.Values) ([]byte, string, error) {
-	res, ct, err := staticFile("static/index.html")(r, v)
-	if err != nil {
-		return nil, "", err
+// index renders the fingerprint of the request, or the snapshot given with ?r=<id>
+func index(srv *Server) RouteHandler {
+	return func(r types.Response, v url.Values) ([]byte, string, error) {
+		if id := v.Get("r"); id != "" {
+			snapshot, err := srv.getSnapshot(id)
+			if err != nil {
+				return nil, "", err
+			}
+			r = snapshot
+		}
+		res, ct, err := staticFile("static/index.html")(r, v)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal response: %w", err)
+		}
+		return []byte(strings.ReplaceAll(string(res), "/*DATA*/", string(data))), ct, nil
 	}
-	data, err := json.Marshal(r)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal response: %w", err)
+}
+
+// snapshotPaths are the routes whose result can be saved with ?save=1
+var snapshotPaths = map[string]bool{
+	"/":        true,
+	"/api/all": true,
+}
+
+// saveSnapshot stores the shareable part of the result of the request, its ID is set on res. Clients
+// can only save snapshotSaveLimit of them.
+func (srv *Server) saveSnapshot(res *types.Response, label string) error {
+	d := srv.GetDB()
+	if d == nil {
+		return ErrNoDatabase
+	}
+	if key, ok := rateLimitKey(snapshotSaveLimit, *res); ok {
+		if wait, _, ok := srv.State.RateLimits.take(snapshotSaveLimit, "snapshot/"+key, time.Now()); !ok {
+			return &RateLimitError{Key: "snapshot", RetryAfter: wait}
+		}
+	}
+	if len(label) > maxSnapshotLabelLength {
+		label = label[:maxSnapshotLabelLength]
+	}
+	res.SnapshotLabel = label
+	snapshot := shareable(*res)
+	if err := d.SaveSnapshot(&snapshot); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	res.SnapshotID = snapshot.SnapshotID
+	return nil
+}
+
+func (srv *Server) getSnapshot(id string) (types.Response, error) {
+	d := srv.GetDB()
+	if d == nil {
+		return types.Response{}, ErrNoDatabase
+	}
+	return d.GetSnapshot(id)
+}
+
+// apiSnapshot returns a result saved with ?save=1
+func apiSnapshot(srv *Server, id string) RouteHandler {
+	return func(types.Response, url.Values) ([]byte, string, error) {
+		snapshot, err := srv.getSnapshot(id)
+		if err != nil {
+			return nil, "", err
+		}
+		return []byte(snapshot.ToJson()), "application/json", nil
+	}
+}
+
+// apiCA returns the local CA certificate, so test clients can trust the generated certificates
+func apiCA(srv *Server) RouteHandler {
+	return func(types.Response, url.Values) ([]byte, string, error) {
+		caFile, _ := srv.GetConfig().GetCAFiles()
+		b, err := utils.ReadFile(caFile)
+		if err != nil {
+			return nil, "", ErrNoLocalCA
+		}
+		return b, "application/x-pem-file", nil
+	}
+}
+
+// isAdminPath reports whether path is an admin endpoint, their requests are neither logged nor saved
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/api/admin/")
+}
+
+// checkAdmin returns an error unless the request carries "Authorization: Bearer <admin_key>"
+func (srv *Server) checkAdmin(res types.Response) error {
+	key := srv.GetConfig().AdminKey
+	if key == "" {
+		return ErrAdminDisabled
+	}
+	auth := res.GetHeaders()["authorization"]
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+key)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// apiAdminAccess lists the blocklist and allowlist, ?list=block|allow with add=<entry> or remove=<entry>
+// changes one of them. Entries are IP addresses or CIDR ranges.
+func apiAdminAccess(srv *Server) RouteHandler {
+	return func(res types.Response, v url.Values) ([]byte, string, error) {
+		if err := srv.checkAdmin(res); err != nil {
+			return nil, "", err
+		}
+
+		var l *accessList
+		switch v.Get("list") {
+		case "", "block":
+			l = &srv.State.Access.block
+		case "allow":
+			l = &srv.State.Access.allow
+		default:
+			return nil, "", ErrUnknownList
+		}
+		if entry := v.Get("add"); entry != "" {
+			if err := l.add(entry); err != nil {
+				return nil, "", fmt.Errorf("failed to add %s to %s: %w", entry, l.file, err)
+			}
+		}
+		if entry := v.Get("remove"); entry != "" {
+			if err := l.remove(entry); err != nil {
+				return nil, "", fmt.Errorf("failed to remove %s from %s: %w", entry, l.file, err)
+			}
+		}
+
+		data, err := json.MarshalIndent(types.AccessLists{
+			Blocklist: srv.State.Access.block.details(),
+			Allowlist: srv.State.Access.allow.details(),
+		}, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal access lists: %w", err)
+		}
+		return data, "application/json", nil
 	}
-	return []byte(strings.ReplaceAll(string(res), "/*DATA*/", string(data))), ct, nil
 }
 
 // apiEmptyGif returns a 1x1 transparent GIF and logs the full request payload.
@@ -98,21 +252,141 @@ func apiEmptyGif(res types.Response, _ url.Values) ([]byte, string, error) {
 	}
 
 	if data, err := json.Marshal(res); err == nil {
-		Log(string(data))
+		requestLogger(res).Info("pixel request", "request", json.RawMessage(data))
 	}
 
 	return emptyGif, "image/gif", nil
 }
 
-func getAllPaths() map[string]RouteHandler {
+func apiRequestCount(srv *Server) RouteHandler {
+	return func(types.Response, url.Values) ([]byte, string, error) {
+		d := srv.GetDB()
+		if d == nil {
+			return nil, "", ErrNoDatabase
+		}
+		n, err := d.Count()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to count requests: %w", err)
+		}
+		return []byte(fmt.Sprintf(`{"total_requests": %d}`, n)), "application/json", nil
+	}
+}
+
+// apiSearch returns the identifiers most often seen together with the one in the "by" parameter
+func apiSearch(srv *Server, kind string) RouteHandler {
+	return func(_ types.Response, v url.Values) ([]byte, string, error) {
+		d := srv.GetDB()
+		if d == nil {
+			return nil, "", ErrNoDatabase
+		}
+		by := utils.GetParam("by", v)
+		if by == "" {
+			return nil, "", ErrMissingParam
+		}
+		res, err := d.Search(kind, by, searchTop)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal search result: %w", err)
+		}
+		return data, "application/json", nil
+	}
+}
+
+// getRequestBody returns the body of a request, whatever the HTTP version
+func getRequestBody(res types.Response) *types.RequestBody {
+	switch {
+	case res.Http1 != nil:
+		return res.Http1.Body
+	case res.Http2 != nil:
+		return res.Http2.Body
+	case res.Http3 != nil:
+		return res.Http3.Body
+	}
+	return nil
+}
+
+// getDiffReference resolves the "against" parameter: a snapshot ID, a request ID, a known client, or the
+// /api/all output posted with the request
+func (srv *Server) getDiffReference(res types.Response, against string, current diff.Fields) (diff.Fields, string, error) {
+	if against == "" || against == "body" {
+		body := getRequestBody(res)
+		if body == nil || len(body.Raw) == 0 {
+			return nil, "", ErrMissingAgainst
+		}
+		var posted types.Response
+		if err := json.Unmarshal(body.Raw, &posted); err != nil {
+			return nil, "", fmt.Errorf("failed to parse posted fingerprint: %w", err)
+		}
+		return diff.FromResponse(posted), "posted fingerprint", nil
+	}
+
+	if snapshot, err := srv.getSnapshot(against); err == nil {
+		return diff.FromResponse(snapshot), "snapshot " + against, nil
+	}
+
+	if d := srv.GetDB(); d != nil {
+		ref, err := d.Get(against)
+		if err == nil {
+			return diff.FromResponse(ref), "request " + against, nil
+		} else if !errors.Is(err, db.ErrRequestNotFound) {
+			return nil, "", err
+		}
+	}
+
+	kc := srv.GetKnownClients()
+	if kc == nil {
+		return nil, "", ErrUnknownClient
+	}
+	c, ok := kc.Find(against)
+	if !ok {
+		return nil, "", ErrUnknownClient
+	}
+	return diff.FromKnownClient(c, current), strings.TrimSpace(c.Name + " " + c.Version), nil
+}
+
+// apiDiff compares the fingerprint of the request with a reference, field by field
+func apiDiff(srv *Server) RouteHandler {
+	return func(res types.Response, v url.Values) ([]byte, string, error) {
+		current := diff.FromResponse(res)
+		reference, against, err := srv.getDiffReference(res, v.Get("against"), current)
+		if err != nil {
+			return nil, "", err
+		}
+		d := diff.Compare(current, reference, against)
+		if v.Get("format") == "text" {
+			return []byte(diff.Format(d)), "text/plain", nil
+		}
+		data, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal diff: %w", err)
+		}
+		return data, "application/json", nil
+	}
+}
+
+func getAllPaths(srv *Server) map[string]RouteHandler {
 	return map[string]RouteHandler{
-		"/":              index,
-		"/explore":       staticFile("static/explore.html"),
-		"/api/all":       apiAll,
-		"/api/tls":       apiTLS,
-		"/api/clean":     apiClean,
-		"/api/raw":       apiRaw,
-		"/pixel.gif":     apiEmptyGif,
-		"/analytics.gif": apiEmptyGif,
+		"/":                 index(srv),
+		"/explore":          staticFile("static/explore.html"),
+		"/api/all":          apiAll,
+		"/api/tls":          apiTLS,
+		"/api/clean":        apiClean,
+		"/api/raw":          apiRaw,
+		"/api/consistency":  apiConsistency,
+		"/api/diff":         apiDiff(srv),
+		"/ca.pem":           apiCA(srv),
+		"/api/admin/access": apiAdminAccess(srv),
+		"/pixel.gif":        apiEmptyGif,
+		"/analytics.gif":    apiEmptyGif,
+
+		"/api/request-count":    apiRequestCount(srv),
+		"/api/search-ja3":       apiSearch(srv, db.JA3),
+		"/api/search-ja4":       apiSearch(srv, db.JA4),
+		"/api/search-h2":        apiSearch(srv, db.Akamai),
+		"/api/search-peetprint": apiSearch(srv, db.PeetPrint),
+		"/api/search-useragent": apiSearch(srv, db.UserAgent),
 	}
 }
@@ -4,6 +4,9 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/pagpeter/trackme/pkg/clients"
+	"github.com/pagpeter/trackme/pkg/db"
+	"github.com/pagpeter/trackme/pkg/logfile"
 	"github.com/pagpeter/trackme/pkg/types"
 )
 
@@ -11,7 +14,27 @@ import (
 type State struct {
 	Config          *types.Config
 	TCPFingerprints sync.Map
-	Local           bool
+	// QUICInitials holds the Initial packets of the open QUIC connections, see QUICTracer
+	QUICInitials sync.Map
+	// AltSvc tracks the clients that were told about HTTP/3, see altSvcHeader
+	AltSvc altSvcClients
+	// Handshakes holds the TLS connections whose handshake is in progress, see GetConfigForClient
+	Handshakes handshakes
+	// Tracking links TLS connections that resume a session
+	Tracking sessionTracker
+	// VirtualHosts select the certificate by SNI, see LoadVirtualHosts
+	VirtualHosts virtualHosts
+	// Access holds the blocklist and allowlist, see LoadAccessLists
+	Access accessLists
+	// RateLimits holds the token buckets of the configured rate limits, see checkRateLimits
+	RateLimits rateLimiter
+	// DB is the request history, nil if no database_file is configured
+	DB *db.DB
+	// RequestLog is the log_file, nil if none is configured
+	RequestLog *logfile.Writer
+	// Clients are the known client fingerprints, nil if no known_clients_file is configured
+	Clients *clients.Database
+	Local   bool
 }
 
 // Server provides access to shared state and functionality
@@ -39,6 +62,26 @@ func (s *Server) GetTCPFingerprints() *sync.Map {
 	return &s.State.TCPFingerprints
 }
 
+// GetDB returns the request history database, nil if it is disabled
+func (s *Server) GetDB() *db.DB {
+	return s.State.DB
+}
+
+// SetDB sets the request history database
+func (s *Server) SetDB(d *db.DB) {
+	s.State.DB = d
+}
+
+// GetKnownClients returns the known client fingerprints, nil if they aren't loaded
+func (s *Server) GetKnownClients() *clients.Database {
+	return s.State.Clients
+}
+
+// SetKnownClients sets the known client fingerprints
+func (s *Server) SetKnownClients(c *clients.Database) {
+	s.State.Clients = c
+}
+
 // GetAdmin returns the CORS key configuration
 func (s *Server) GetAdmin() (string, bool) {
 	return s.State.Config.CorsKey, s.State.Config.CorsKey != ""
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/base64"
+	"slices"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// snapshotSaveLimit limits how often a client can save snapshots, they are kept as long as stored requests
+var snapshotSaveLimit = types.RateLimit{Key: "ip", Rate: 1.0 / 60, Burst: 10}
+
+// redactedValue replaces the values of credentialHeaders in snapshots
+const redactedValue = "redacted"
+
+// credentialHeaders are the headers whose values are left out of snapshots, which anyone with the link can see
+var credentialHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+}
+
+// redactHeaderLines returns the "name: value" lines with the values of credentialHeaders replaced
+func redactHeaderLines(lines []string) []string {
+	redacted := slices.Clone(lines)
+	for i, l := range lines {
+		// Pseudo-headers start with a colon, so the separator is searched after it
+		j := strings.Index(l[min(1, len(l)):], ":")
+		if j >= 0 && credentialHeaders[strings.ToLower(strings.TrimSpace(l[:j+1]))] {
+			redacted[i] = l[:j+1] + ": " + redactedValue
+		}
+	}
+	return redacted
+}
+
+// redactRawHead replaces the values of credentialHeaders in a raw HTTP/1 request head, obs-fold
+// continuation lines of their values are dropped
+func redactRawHead(head string) string {
+	lines := strings.SplitAfter(head, "\n")
+	redact := false
+	for i, line := range lines[min(1, len(lines)):] {
+		content := strings.TrimRight(line, "\r\n")
+		ending := line[len(content):]
+		if content != "" && (content[0] == ' ' || content[0] == '\t') {
+			if redact {
+				lines[i+1] = ""
+			}
+			continue
+		}
+		name, _, ok := strings.Cut(content, ":")
+		redact = ok && credentialHeaders[strings.ToLower(strings.TrimSpace(name))]
+		if redact {
+			lines[i+1] = name + ": " + redactedValue + ending
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// shareable returns the result without what identifies the client: its address, the PROXY protocol
+// header, the request and log IDs and the values of credentialHeaders. res itself is not changed.
+func shareable(res types.Response) types.Response {
+	res.IP = ""
+	res.RequestID = ""
+	res.LogID = ""
+	res.ProxyProtocol = nil
+	res.TCPIP.IP.SrcIP = ""
+	res.TCPIP.IP.DstIp = ""
+	res.TCPIP.SrcPort = 0
+
+	if res.Http1 != nil {
+		h := *res.Http1
+		h.Headers = redactHeaderLines(h.Headers)
+		h.RawHead = redactRawHead(h.RawHead)
+		h.RawHeadB64 = base64.StdEncoding.EncodeToString([]byte(h.RawHead))
+		h.HeaderFields = make([]types.Http1HeaderField, len(res.Http1.HeaderFields))
+		for i, f := range res.Http1.HeaderFields {
+			if credentialHeaders[strings.ToLower(f.Name)] {
+				f.Value = redactedValue
+			}
+			h.HeaderFields[i] = f
+		}
+		res.Http1 = &h
+	}
+	if res.Http2 != nil {
+		h := *res.Http2
+		h.SendFrames = make([]types.ParsedFrame, len(res.Http2.SendFrames))
+		for i, f := range res.Http2.SendFrames {
+			f.Headers = redactHeaderLines(f.Headers)
+			h.SendFrames[i] = f
+		}
+		res.Http2 = &h
+	}
+	if res.Http3 != nil {
+		h := *res.Http3
+		h.Headers = redactHeaderLines(h.Headers)
+		res.Http3 = &h
+	}
+	return res
+}
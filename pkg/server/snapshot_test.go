@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/db"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestRedactRawHead(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{
+			name: "credentials",
+			head: "GET / HTTP/1.1\r\nHost: a\r\nCookie: session=1\r\nAuthorization: Bearer x\r\nAccept: */*\r\n\r\n",
+			want: "GET / HTTP/1.1\r\nHost: a\r\nCookie: redacted\r\nAuthorization: redacted\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name: "folded value and bare LF",
+			head: "GET / HTTP/1.1\nhost: a\ncookie : a=1;\n b=2\nx-a: 1\n 2\n\n",
+			want: "GET / HTTP/1.1\nhost: a\ncookie : redacted\nx-a: 1\n 2\n\n",
+		},
+		{
+			name: "request line that looks like a header",
+			head: "COOKIE: / HTTP/1.1\r\nHost: a\r\n\r\n",
+			want: "COOKIE: / HTTP/1.1\r\nHost: a\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactRawHead(tt.head); got != tt.want {
+				t.Errorf("redactRawHead() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShareable(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: a\r\nCookie: session=1\r\n\r\n"
+	res := types.Response{
+		IP:            "192.0.2.1:443",
+		RequestID:     "request",
+		LogID:         "log",
+		ProxyProtocol: &types.ProxyProtocolDetails{SourceAddress: "192.0.2.1:443"},
+		Http1: &types.Http1Details{
+			Headers:    []string{"Host: a", "Cookie: session=1"},
+			RawHead:    head,
+			RawHeadB64: base64.StdEncoding.EncodeToString([]byte(head)),
+			HeaderFields: []types.Http1HeaderField{
+				{Name: "Host", Value: "a"},
+				{Name: "Cookie", Value: "session=1"},
+			},
+		},
+	}
+	res.TCPIP.IP.SrcIP = "192.0.2.1"
+	res.TCPIP.IP.TTL = 64
+
+	s := shareable(res)
+	if s.IP != "" || s.RequestID != "" || s.LogID != "" || s.ProxyProtocol != nil || s.TCPIP.IP.SrcIP != "" {
+		t.Errorf("the client is still identified: %+v", s)
+	}
+	if s.TCPIP.IP.TTL != 64 {
+		t.Error("the TTL was removed")
+	}
+	if !slices.Equal(s.Http1.Headers, []string{"Host: a", "Cookie: redacted"}) || s.Http1.HeaderFields[1].Value != "redacted" {
+		t.Errorf("headers = %q, fields = %+v", s.Http1.Headers, s.Http1.HeaderFields)
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(s.Http1.RawHeadB64); string(raw) != s.Http1.RawHead || strings.Contains(s.Http1.RawHead, "session") {
+		t.Errorf("raw head = %q, base64 = %q", s.Http1.RawHead, raw)
+	}
+	if res.Http1.Headers[1] != "Cookie: session=1" || res.Http1.HeaderFields[1].Value != "session=1" || res.IP == "" {
+		t.Error("the response was changed")
+	}
+
+	h2 := shareable(types.Response{Http2: &types.Http2Details{SendFrames: []types.ParsedFrame{
+		{Type: "SETTINGS"},
+		{Type: "HEADERS", Headers: []string{":method: GET", "authorization: Basic eDp5", "accept: */*"}},
+	}}})
+	if got := h2.Http2.SendFrames[1].Headers; !slices.Equal(got, []string{":method: GET", "authorization: redacted", "accept: */*"}) {
+		t.Errorf("h2 headers = %q", got)
+	}
+	h3 := shareable(types.Response{Http3: &types.Http3Details{Headers: []string{":path: /", "cookie: a=1", "proxy-authorization: x"}}})
+	if got := h3.Http3.Headers; !slices.Equal(got, []string{":path: /", "cookie: redacted", "proxy-authorization: redacted"}) {
+		t.Errorf("h3 headers = %q", got)
+	}
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	srv := NewServer()
+	srv.SetDB(d)
+
+	res := types.Response{IP: "192.0.2.1:443", Http3: &types.Http3Details{Headers: []string{"cookie: a=1"}}}
+	if err := srv.saveSnapshot(&res, "label"); err != nil {
+		t.Fatal(err)
+	}
+	if res.SnapshotID == "" || res.IP == "" || res.Http3.Headers[0] != "cookie: a=1" {
+		t.Errorf("response = %+v", res)
+	}
+	saved, err := srv.getSnapshot(res.SnapshotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IP != "" || saved.Http3.Headers[0] != "cookie: redacted" || saved.SnapshotLabel != "label" || saved.SnapshotID != res.SnapshotID {
+		t.Errorf("snapshot = %+v", saved)
+	}
+
+	// The first one was part of the burst too
+	for i := 1; i < snapshotSaveLimit.Burst; i++ {
+		if err := srv.saveSnapshot(&res, ""); err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+	}
+	var limited *RateLimitError
+	if err := srv.saveSnapshot(&res, ""); !errors.As(err, &limited) {
+		t.Errorf("saveSnapshot() = %v, want a RateLimitError", err)
+	}
+	other := types.Response{IP: "192.0.2.2:443"}
+	if err := srv.saveSnapshot(&other, ""); err != nil {
+		t.Errorf("another client was limited: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+const (
+	// ticketLifetime is how long ticket keys and session IDs are remembered, the lifetime of TLS 1.3 tickets
+	ticketLifetime = 7 * 24 * time.Hour
+	// maxTrackedLinks limits the remembered ticket keys and session IDs, the oldest are dropped first
+	maxTrackedLinks = 100000
+	// maxChainFingerprints limits the distinct fingerprints kept per chain
+	maxChainFingerprints = 20
+)
+
+// trackingChain is a group of connections linked by the tickets and session IDs they presented
+type trackingChain struct {
+	id           string
+	firstSeen    time.Time
+	connections  int
+	fingerprints []types.TrackedFingerprint
+}
+
+// trackingLink points a ticket key or a session ID to the chain of the connection it was issued to
+type trackingLink struct {
+	name    string
+	chain   *trackingChain
+	key     [32]byte // the session ticket key, unset for session IDs
+	created time.Time
+}
+
+// sessionTracker links TLS connections to the connection that issued the session they resume. Every
+// connection gets its own session ticket key, so the key name at the start of a ticket tells which
+// connection it was issued to.
+type sessionTracker struct {
+	mu    sync.Mutex
+	links map[string]*trackingLink
+	order []*trackingLink
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("unable to read random bytes: " + err.Error())
+	}
+	return b
+}
+
+func ticketLinkName(keyName []byte) string {
+	return "ticket:" + hex.EncodeToString(keyName)
+}
+
+func sessionIDLinkName(sessionID string) string {
+	return "session_id:" + sessionID
+}
+
+// addLink remembers a link and drops expired ones, t.mu must be held
+func (t *sessionTracker) addLink(l *trackingLink) {
+	if t.links == nil {
+		t.links = map[string]*trackingLink{}
+	}
+	for len(t.order) > 0 && (len(t.order) >= maxTrackedLinks || time.Since(t.order[0].created) > ticketLifetime) {
+		if t.links[t.order[0].name] == t.order[0] {
+			delete(t.links, t.order[0].name)
+		}
+		t.order = t.order[1:]
+	}
+	t.links[l.name] = l
+	t.order = append(t.order, l)
+}
+
+// ticketKeys returns the session ticket keys for a connection: a new key for the tickets issued on it,
+// followed by the key of the ticket it presented, if that was issued by us
+func (t *sessionTracker) ticketKeys(p *pendingHandshake, hello tls.ClientHello) [][32]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var presented *trackingLink
+	if ticket, err := hex.DecodeString(hello.SessionTicket); err == nil && len(ticket) >= 16 {
+		if l, ok := t.links[ticketLinkName(ticket[:16])]; ok {
+			presented, p.linkedBy = l, "session_ticket"
+		}
+	}
+	for _, identity := range hello.PSKIdentities {
+		if presented != nil {
+			break
+		}
+		if ticket, err := hex.DecodeString(identity); err == nil && len(ticket) >= 16 {
+			if l, ok := t.links[ticketLinkName(ticket[:16])]; ok {
+				presented, p.linkedBy = l, "psk"
+			}
+		}
+	}
+
+	p.link = &trackingLink{created: time.Now()}
+	copy(p.link.key[:], randomBytes(32))
+	keyName := utls.TicketKeyFromBytes(p.link.key).KeyName
+	p.link.name = ticketLinkName(keyName[:])
+	keys := [][32]byte{p.link.key}
+	if presented != nil {
+		p.link.chain = presented.chain
+		keys = append(keys, presented.key)
+	} else {
+		p.link.chain = &trackingChain{id: hex.EncodeToString(randomBytes(8)), firstSeen: time.Now()}
+	}
+	t.addLink(p.link)
+	return keys
+}
+
+// trackConnection adds a connection to its chain after the handshake, and returns the chain. TLS 1.2
+// session IDs link connections that didn't present one of our tickets.
+func (srv *Server) trackConnection(p *pendingHandshake, hello tls.ClientHello, details *types.TLSDetails) *types.TLSTracking {
+	if p == nil || p.link == nil {
+		return nil
+	}
+	t := &srv.State.Tracking
+	conn := p.conn
+	state := conn.ConnectionState()
+	ja4 := tls.CalculateJa4(details)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state.Version == utls.VersionTLS12 && hello.SessionID != "" {
+		name := sessionIDLinkName(hello.SessionID)
+		if l, ok := t.links[name]; ok && p.linkedBy == "" {
+			p.link.chain = l.chain
+			p.linkedBy = "session_id"
+		} else if !ok {
+			t.addLink(&trackingLink{name: name, chain: p.link.chain, created: time.Now()})
+		}
+	}
+
+	chain := p.link.chain
+	chain.connections++
+	found := false
+	for i, fp := range chain.fingerprints {
+		if fp.JA3Hash == details.JA3Hash && fp.JA4 == ja4 && fp.PeetPrintHash == details.PeetPrintHash {
+			chain.fingerprints[i].Connections++
+			found = true
+			break
+		}
+	}
+	if !found && len(chain.fingerprints) < maxChainFingerprints {
+		chain.fingerprints = append(chain.fingerprints, types.TrackedFingerprint{
+			JA3Hash:       details.JA3Hash,
+			JA4:           ja4,
+			PeetPrintHash: details.PeetPrintHash,
+			Connections:   1,
+		})
+	}
+
+	return &types.TLSTracking{
+		ID:           chain.id,
+		LinkedBy:     p.linkedBy,
+		Resumed:      state.DidResume,
+		FirstSeen:    chain.firstSeen.UnixMilli(),
+		Connections:  chain.connections,
+		Fingerprints: append([]types.TrackedFingerprint(nil), chain.fingerprints...),
+	}
+}
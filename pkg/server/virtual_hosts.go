@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+// virtualHost is a configured virtual host with its loaded certificate, the default host has no server names
+type virtualHost struct {
+	types.VirtualHost
+	cert     tls.Certificate
+	utlsCert utls.Certificate
+}
+
+// virtualHosts selects the certificate for a server name, it is set up once at startup
+type virtualHosts struct {
+	hosts       []*virtualHost
+	defaultHost *virtualHost
+}
+
+func newVirtualHost(vh types.VirtualHost, cert tls.Certificate) (*virtualHost, error) {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	return &virtualHost{
+		VirtualHost: vh,
+		cert:        cert,
+		utlsCert: utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		},
+	}, nil
+}
+
+// LoadVirtualHosts loads the certificates of the configured virtual hosts, defaultCert is served
+// to every other server name
+func (srv *Server) LoadVirtualHosts(defaultCert tls.Certificate) error {
+	v := &srv.State.VirtualHosts
+	var err error
+	if v.defaultHost, err = newVirtualHost(types.VirtualHost{}, defaultCert); err != nil {
+		return err
+	}
+	for _, vh := range srv.GetConfig().VirtualHosts {
+		if len(vh.ServerNames) == 0 {
+			return fmt.Errorf("virtual host with %s has no server names", vh.CertFile)
+		}
+		cert, err := tls.LoadX509KeyPair(vh.CertFile, vh.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate of %s: %w", vh.ServerNames[0], err)
+		}
+		h, err := newVirtualHost(vh, cert)
+		if err != nil {
+			return fmt.Errorf("%s: %w", vh.ServerNames[0], err)
+		}
+		v.hosts = append(v.hosts, h)
+	}
+	return nil
+}
+
+// matchServerName reports whether name matches pattern, which may start with "*." for one label
+func matchServerName(pattern, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, rest, found := strings.Cut(name, ".")
+	return found && label != "" && strings.EqualFold("."+rest, suffix)
+}
+
+// certificateMatches reports whether the certificate of h is valid for serverName
+func (h *virtualHost) certificateMatches(serverName string) bool {
+	return serverName != "" && h.cert.Leaf.VerifyHostname(serverName) == nil
+}
+
+// get returns the host configured for serverName, then the first host whose certificate is valid
+// for it, and the default host otherwise. It returns nil if no certificates were loaded.
+func (v *virtualHosts) get(serverName string) *virtualHost {
+	for _, h := range v.hosts {
+		for _, pattern := range h.ServerNames {
+			if matchServerName(pattern, serverName) {
+				return h
+			}
+		}
+	}
+	for _, h := range v.hosts {
+		if h.certificateMatches(serverName) {
+			return h
+		}
+	}
+	return v.defaultHost
+}
+
+// find returns the virtual host by its first server name
+func (v *virtualHosts) find(name string) *virtualHost {
+	for _, h := range v.hosts {
+		if h.ServerNames[0] == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// getSNIDetails describes the certificate that was served for serverName, nil if no certificates were loaded
+func (v *virtualHosts) getSNIDetails(serverName string) *types.SNIDetails {
+	h := v.get(serverName)
+	if h == nil {
+		return nil
+	}
+	d := &types.SNIDetails{
+		ServerName:         serverName,
+		CertificateMatched: h.certificateMatches(serverName),
+	}
+	if len(h.ServerNames) > 0 {
+		d.VirtualHost = h.ServerNames[0]
+	}
+	return d
+}
+
+// GetHTTP3Certificate is the tls.Config.GetCertificate callback of the HTTP/3 server
+func (srv *Server) GetHTTP3Certificate(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h := srv.State.VirtualHosts.get(chi.ServerName)
+	if h == nil {
+		return nil, fmt.Errorf("no certificates loaded")
+	}
+	return &h.cert, nil
+}
+
+// matchRoute reports whether path matches route, a route ending with "/" matches every path below it
+func matchRoute(route, path string) bool {
+	return route == path || (strings.HasSuffix(route, "/") && strings.HasPrefix(path, route))
+}
+
+// routeAllowed reports whether the virtual host of the request serves path
+func (srv *Server) routeAllowed(res types.Response, path string) bool {
+	if res.TLS == nil || res.TLS.SNI == nil || res.TLS.SNI.VirtualHost == "" {
+		return true
+	}
+	h := srv.State.VirtualHosts.find(res.TLS.SNI.VirtualHost)
+	if h == nil || len(h.Routes) == 0 {
+		return true
+	}
+	for _, route := range h.Routes {
+		if matchRoute(route, path) {
+			return true
+		}
+	}
+	return false
+}
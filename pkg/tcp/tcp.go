@@ -11,6 +11,7 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/pagpeter/trackme/pkg/metrics"
 	"github.com/pagpeter/trackme/pkg/server"
 	"github.com/pagpeter/trackme/pkg/types"
 )
@@ -152,6 +153,7 @@ func SniffTCP(device string, tlsPort int, srv *server.Server) {
 			}
 			src := net.JoinHostPort(pack.IP.SrcIP, strconv.Itoa(pack.SrcPort))
 			srv.GetTCPFingerprints().Store(src, pack)
+			metrics.TCPPackets.Inc()
 		}
 	}
 }
@@ -0,0 +1,103 @@
+package tls
+
+import (
+	"slices"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// serverGroups are the key share groups the server supports (X25519, P-256, P-384, P-521)
+var serverGroups = []uint16{29, 23, 24, 25}
+
+// isGreaseValue reports whether v is one of the reserved GREASE values (0x0a0a, 0x1a1a, ...)
+func isGreaseValue(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// HelloRetryGroup returns a group the client supports but sent no key share for, asking for it forces a
+// HelloRetryRequest. It returns false for clients without TLS 1.3 and for clients with a key share for every group.
+func HelloRetryGroup(hello ClientHello) (uint16, bool) {
+	if !slices.Contains(hello.SupportedTLSVersions, 772) {
+		return 0, false
+	}
+	for _, group := range hello.SupportedCurves {
+		if slices.Contains(serverGroups, group) && !slices.Contains(hello.KeyShareGroups, group) {
+			return group, true
+		}
+	}
+	return 0, false
+}
+
+// greaseValues returns the GREASE values of the cipher suites, extensions and key shares, in that order
+func greaseValues(hello ClientHello) []uint16 {
+	var values []uint16
+	for _, c := range hello.CipherSuites {
+		if isGreaseValue(c) {
+			values = append(values, c)
+		}
+	}
+	for _, e := range hello.AllExtensions {
+		if isGreaseValue(uint16(e)) {
+			values = append(values, uint16(e))
+		}
+	}
+	for _, g := range hello.KeyShareGroups {
+		if isGreaseValue(g) {
+			values = append(values, g)
+		}
+	}
+	return values
+}
+
+// withoutGrease returns the extensions without GREASE values
+func withoutGrease(exts []int) []int {
+	var out []int
+	for _, e := range exts {
+		if !isGreaseValue(uint16(e)) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// CompareHelloRetry describes how the ClientHello sent after a HelloRetryRequest differs from the first one.
+// RFC 8446 only allows changes to key_share, early_data, cookie, pre_shared_key and padding.
+func CompareHelloRetry(first, retry ClientHello) *types.TLSHelloRetry {
+	r := &types.TLSHelloRetry{
+		AddedExtensions:    []string{},
+		RemovedExtensions:  []string{},
+		CiphersChanged:     !slices.Equal(first.CipherSuites, retry.CipherSuites),
+		GreaseReused:       len(greaseValues(first)) > 0 && slices.Equal(greaseValues(first), greaseValues(retry)),
+		ClientRandomReused: first.ClientRandom == retry.ClientRandom,
+		SessionIDReused:    first.SessionID == retry.SessionID,
+		PaddingLengths:     [2]int{first.PaddingLength, retry.PaddingLength},
+		KeyShares:          []string{},
+	}
+
+	firstExts, retryExts := withoutGrease(first.AllExtensions), withoutGrease(retry.AllExtensions)
+	var firstCommon, retryCommon []int
+	for _, e := range firstExts {
+		if slices.Contains(retryExts, e) {
+			firstCommon = append(firstCommon, e)
+		} else {
+			r.RemovedExtensions = append(r.RemovedExtensions, types.GetExtensionNameByID(uint16(e)))
+		}
+	}
+	for _, e := range retryExts {
+		if slices.Contains(firstExts, e) {
+			retryCommon = append(retryCommon, e)
+		} else {
+			r.AddedExtensions = append(r.AddedExtensions, types.GetExtensionNameByID(uint16(e)))
+		}
+	}
+	r.ExtensionOrderChanged = !slices.Equal(firstCommon, retryCommon)
+
+	for _, g := range retry.KeyShareGroups {
+		if isGreaseValue(g) {
+			r.KeyShares = append(r.KeyShares, "GREASE")
+		} else {
+			r.KeyShares = append(r.KeyShares, types.GetCurveNameByID(g))
+		}
+	}
+	return r
+}
@@ -0,0 +1,112 @@
+package tls
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHelloRetryGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		hello  ClientHello
+		group  uint16
+		forced bool
+	}{
+		{
+			name:   "missing key share",
+			hello:  ClientHello{SupportedTLSVersions: []int{772, 771}, SupportedCurves: []uint16{0x1a1a, 4588, 29, 23}, KeyShareGroups: []uint16{0x1a1a, 4588, 29}},
+			group:  23,
+			forced: true,
+		},
+		{
+			name:  "key share for every group",
+			hello: ClientHello{SupportedTLSVersions: []int{772}, SupportedCurves: []uint16{29, 23}, KeyShareGroups: []uint16{29, 23}},
+		},
+		{
+			name:  "only unsupported groups left",
+			hello: ClientHello{SupportedTLSVersions: []int{772}, SupportedCurves: []uint16{29, 4588, 256}, KeyShareGroups: []uint16{29}},
+		},
+		{
+			name:  "TLS 1.2",
+			hello: ClientHello{SupportedTLSVersions: []int{771}, SupportedCurves: []uint16{29, 23}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, forced := HelloRetryGroup(tt.hello)
+			if group != tt.group || forced != tt.forced {
+				t.Errorf("HelloRetryGroup() = %d, %v, want %d, %v", group, forced, tt.group, tt.forced)
+			}
+		})
+	}
+}
+
+func TestIsGreaseValue(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGreaseValue(v) {
+			t.Errorf("isGreaseValue(%#04x) = false", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x0b0b, 29, 0} {
+		if isGreaseValue(v) {
+			t.Errorf("isGreaseValue(%#04x) = true", v)
+		}
+	}
+}
+
+func TestCompareHelloRetry(t *testing.T) {
+	first := ClientHello{
+		ClientRandom:   "01",
+		SessionID:      "aa",
+		CipherSuites:   []uint16{0x2a2a, 4865, 4866},
+		AllExtensions:  []int{0x3a3a, 0, 10, 51, 21},
+		KeyShareGroups: []uint16{0x4a4a, 29},
+		PaddingLength:  200,
+	}
+
+	t.Run("compliant", func(t *testing.T) {
+		retry := first
+		retry.ClientRandom = "02"
+		retry.AllExtensions = []int{0x3a3a, 0, 10, 51, 44}
+		retry.KeyShareGroups = []uint16{0x4a4a, 23}
+		retry.PaddingLength = 0
+		r := CompareHelloRetry(first, retry)
+		if !slices.Equal(r.AddedExtensions, []string{"cookie (44)"}) || !slices.Equal(r.RemovedExtensions, []string{"padding (21)"}) {
+			t.Errorf("added = %v, removed = %v", r.AddedExtensions, r.RemovedExtensions)
+		}
+		if r.ExtensionOrderChanged || r.CiphersChanged || r.ClientRandomReused {
+			t.Errorf("order changed = %v, ciphers changed = %v, random reused = %v", r.ExtensionOrderChanged, r.CiphersChanged, r.ClientRandomReused)
+		}
+		if !r.GreaseReused || !r.SessionIDReused {
+			t.Errorf("grease reused = %v, session id reused = %v", r.GreaseReused, r.SessionIDReused)
+		}
+		if r.PaddingLengths != [2]int{200, 0} || !slices.Equal(r.KeyShares, []string{"GREASE", "P-256 (23)"}) {
+			t.Errorf("padding = %v, key shares = %v", r.PaddingLengths, r.KeyShares)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		retry := first
+		retry.SessionID = "bb"
+		retry.CipherSuites = []uint16{0x5a5a, 4866, 4865}
+		retry.AllExtensions = []int{0x6a6a, 10, 0, 51, 21}
+		retry.KeyShareGroups = []uint16{0x7a7a, 23}
+		r := CompareHelloRetry(first, retry)
+		if len(r.AddedExtensions) != 0 || len(r.RemovedExtensions) != 0 {
+			t.Errorf("added = %v, removed = %v, GREASE values don't count", r.AddedExtensions, r.RemovedExtensions)
+		}
+		if !r.ExtensionOrderChanged || !r.CiphersChanged || !r.ClientRandomReused {
+			t.Errorf("order changed = %v, ciphers changed = %v, random reused = %v", r.ExtensionOrderChanged, r.CiphersChanged, r.ClientRandomReused)
+		}
+		if r.GreaseReused || r.SessionIDReused {
+			t.Errorf("grease reused = %v, session id reused = %v", r.GreaseReused, r.SessionIDReused)
+		}
+	})
+
+	t.Run("without GREASE", func(t *testing.T) {
+		hello := ClientHello{CipherSuites: []uint16{4865}, AllExtensions: []int{0, 51}, KeyShareGroups: []uint16{29}}
+		if r := CompareHelloRetry(hello, hello); r.GreaseReused {
+			t.Error("a client without GREASE reused it")
+		}
+	})
+}
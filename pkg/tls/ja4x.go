@@ -0,0 +1,88 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// oidHex returns the hex of the DER encoded OID, without its tag and length
+func oidHex(oid asn1.ObjectIdentifier) string {
+	der, err := asn1.Marshal(oid)
+	if err != nil || len(der) < 2 {
+		return ""
+	}
+	return hex.EncodeToString(der[2:])
+}
+
+// ja4xPart hashes a list of OIDs, in the order they appear in the certificate
+func ja4xPart(oids []asn1.ObjectIdentifier) string {
+	if len(oids) == 0 {
+		return "000000000000"
+	}
+	var parts []string
+	for _, oid := range oids {
+		parts = append(parts, oidHex(oid))
+	}
+	return utils.SHA256trunc(strings.Join(parts, ","))
+}
+
+func nameOIDs(name pkix.Name) []asn1.ObjectIdentifier {
+	var oids []asn1.ObjectIdentifier
+	for _, n := range name.Names {
+		oids = append(oids, n.Type)
+	}
+	return oids
+}
+
+// CalculateJa4X returns the JA4X fingerprint of a certificate: the hashes of the issuer RDN OIDs,
+// the subject RDN OIDs and the extension OIDs. It describes how the certificate was generated,
+// not its values.
+func CalculateJa4X(cert *x509.Certificate) string {
+	var extensions []asn1.ObjectIdentifier
+	for _, e := range cert.Extensions {
+		extensions = append(extensions, e.Id)
+	}
+	return ja4xPart(nameOIDs(cert.Issuer)) + "_" + ja4xPart(nameOIDs(cert.Subject)) + "_" + ja4xPart(extensions)
+}
+
+// GetCertificateDetails describes the certificates a client presented, in the order it sent them
+func GetCertificateDetails(certs []*x509.Certificate) []types.CertificateDetails {
+	var details []types.CertificateDetails
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		d := types.CertificateDetails{
+			Subject:            cert.Subject.String(),
+			Issuer:             cert.Issuer.String(),
+			SerialNumber:       cert.SerialNumber.Text(16),
+			KeyType:            cert.PublicKeyAlgorithm.String(),
+			SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+			NotBefore:          cert.NotBefore.UTC().Unix(),
+			NotAfter:           cert.NotAfter.UTC().Unix(),
+			IsCA:               cert.IsCA,
+			DNSNames:           cert.DNSNames,
+			SHA256:             hex.EncodeToString(fingerprint[:]),
+			JA4X:               CalculateJa4X(cert),
+		}
+		switch key := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			d.KeySize = key.N.BitLen()
+		case *ecdsa.PublicKey:
+			d.KeySize = key.Curve.Params().BitSize
+			d.Curve = key.Curve.Params().Name
+		case ed25519.PublicKey:
+			d.KeySize = 256
+		}
+		details = append(details, d)
+	}
+	return details
+}
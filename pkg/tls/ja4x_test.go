@@ -0,0 +1,128 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestOIDHex(t *testing.T) {
+	for oid, want := range map[string]asn1.ObjectIdentifier{
+		"550403":                 {2, 5, 4, 3},
+		"55040a":                 {2, 5, 4, 10},
+		"551d11":                 {2, 5, 29, 17},
+		"2a864886f70d010901":     {1, 2, 840, 113549, 1, 9, 1},
+		"2b0601040182373c020101": {1, 3, 6, 1, 4, 1, 311, 60, 2, 1, 1},
+	} {
+		if got := oidHex(want); got != oid {
+			t.Errorf("oidHex(%v) = %s, want %s", want, got, oid)
+		}
+	}
+}
+
+func TestJA4XPart(t *testing.T) {
+	tests := []struct {
+		oids []asn1.ObjectIdentifier
+		want string
+	}{
+		// C, O, CN, the issuer of the example in the JA4X specification
+		{oids: []asn1.ObjectIdentifier{{2, 5, 4, 6}, {2, 5, 4, 10}, {2, 5, 4, 3}}, want: "a373a9f83c6b"},
+		{oids: []asn1.ObjectIdentifier{{2, 5, 4, 3}}, want: "7022c563de38"},
+		{want: "000000000000"},
+	}
+	for _, tt := range tests {
+		if got := ja4xPart(tt.oids); got != tt.want {
+			t.Errorf("ja4xPart(%v) = %s, want %s", tt.oids, got, tt.want)
+		}
+	}
+}
+
+func createCertificate(t *testing.T, template *x509.Certificate, key any, public any) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCalculateJa4X(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Country: []string{"US"}, Organization: []string{"Example"}, CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: []byte{0x30, 0x00}},
+		},
+	}
+	cert := createCertificate(t, template, private, public)
+
+	// Self-signed, so issuer and subject are both C, O, CN. Go adds no extensions of its own for a leaf
+	// certificate with an Ed25519 key and no key usages, so subjectAltName is the only one.
+	want := "a373a9f83c6b_a373a9f83c6b_6ea8df877ef2"
+	if got := CalculateJa4X(cert); got != want {
+		t.Errorf("CalculateJa4X() = %s, want %s", got, want)
+	}
+
+	// The values don't matter, only which RDNs and extensions there are and their order
+	template.Subject = pkix.Name{Country: []string{"DE"}, Organization: []string{"Other"}, CommonName: "other.example"}
+	other := createCertificate(t, template, private, public)
+	if CalculateJa4X(other) != CalculateJa4X(cert) {
+		t.Errorf("CalculateJa4X() changed with the subject values: %s", CalculateJa4X(other))
+	}
+	template.Subject = pkix.Name{CommonName: "example.com"}
+	if got := CalculateJa4X(createCertificate(t, template, private, public)); got[:25] != "7022c563de38_7022c563de38" {
+		t.Errorf("CalculateJa4X() = %s, want the hash of CN only", got)
+	}
+}
+
+func TestGetCertificateDetails(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Unix(1700000000, 0)
+	cert := createCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(0xabc),
+		Subject:               pkix.Name{CommonName: "client"},
+		DNSNames:              []string{"client.example"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, private, &private.PublicKey)
+
+	details := GetCertificateDetails([]*x509.Certificate{cert})
+	if len(details) != 1 {
+		t.Fatalf("details = %+v", details)
+	}
+	d := details[0]
+	if d.Subject != "CN=client" || d.Issuer != "CN=client" || d.SerialNumber != "abc" || !d.IsCA {
+		t.Errorf("subject = %s, issuer = %s, serial = %s, CA = %v", d.Subject, d.Issuer, d.SerialNumber, d.IsCA)
+	}
+	if d.KeyType != "ECDSA" || d.KeySize != 256 || d.Curve != "P-256" || d.SignatureAlgorithm != "ECDSA-SHA256" {
+		t.Errorf("key = %s %d %s, signature = %s", d.KeyType, d.KeySize, d.Curve, d.SignatureAlgorithm)
+	}
+	if d.NotBefore != notBefore.Unix() || d.NotAfter != notBefore.Add(time.Hour).Unix() || len(d.SHA256) != 64 {
+		t.Errorf("validity = %d-%d, sha256 = %s", d.NotBefore, d.NotAfter, d.SHA256)
+	}
+	if d.JA4X != CalculateJa4X(cert) || len(d.DNSNames) != 1 {
+		t.Errorf("ja4x = %s, dns names = %v", d.JA4X, d.DNSNames)
+	}
+}
@@ -37,6 +37,17 @@ type ClientHello struct {
 	SignatureAlgorithms       []int
 	PSKKeyExchangeMode        int
 	CertCompressionAlgorithms []int
+
+	// The session ticket (TLS 1.2) and the PSK identities (TLS 1.3) the client offered for resumption, as hex
+	SessionTicket string
+	PSKIdentities []string
+
+	// The groups of the key_share extension (GREASE included) and the length of the padding extension
+	KeyShareGroups []uint16
+	PaddingLength  int
+
+	// The quic_transport_parameters extension of a QUIC ClientHello, as hex
+	QUICTransportParameters string
 }
 
 func hexToInt(hex string) int {
@@ -135,6 +146,47 @@ func parseCompressionMethods(ch string, c int) (string, int) {
 	return "0x" + ch[c:c+length], c + length
 }
 
+// parsePSKIdentities returns the identities of a pre_shared_key extension, each followed by its obfuscated ticket age
+func parsePSKIdentities(d string) []string {
+	if len(d) < 4 {
+		return nil
+	}
+	length := hexToInt(d[0:4]) * 2
+	if len(d) < 4+length {
+		return nil
+	}
+	var identities []string
+	tmpC := 4
+	for tmpC+4 <= 4+length {
+		idLength := hexToInt(d[tmpC:tmpC+4]) * 2
+		tmpC += 4
+		if tmpC+idLength+8 > 4+length {
+			break
+		}
+		identities = append(identities, d[tmpC:tmpC+idLength])
+		tmpC += idLength + 8
+	}
+	return identities
+}
+
+// parseKeyShareGroups returns the groups of the key shares in a key_share extension
+func parseKeyShareGroups(d string) []uint16 {
+	if len(d) < 4 {
+		return nil
+	}
+	length := hexToInt(d[0:4]) * 2
+	if len(d) < 4+length {
+		return nil
+	}
+	var groups []uint16
+	tmpC := 4
+	for tmpC+8 <= 4+length {
+		groups = append(groups, uint16(hexToInt(d[tmpC:tmpC+4])))
+		tmpC += 8 + hexToInt(d[tmpC+4:tmpC+8])*2
+	}
+	return groups
+}
+
 func parseExtensions(ch string, c int) ([]Extension, int) {
 	if len(ch) < c+4 {
 		return nil, c
@@ -597,6 +649,18 @@ func ParseClientHello(ch string) ClientHello {
 	exts, _ := parseExtensions(ch, c)
 	for _, ext := range exts {
 		chp.AllExtensions = append(chp.AllExtensions, hexToInt(ext.Type))
+		switch ext.Type {
+		case "0023": // session_ticket
+			chp.SessionTicket = ext.Data
+		case "0029": // pre_shared_key
+			chp.PSKIdentities = parsePSKIdentities(ext.Data)
+		case "0033": // key_share
+			chp.KeyShareGroups = parseKeyShareGroups(ext.Data)
+		case "0015": // padding
+			chp.PaddingLength = ext.Length / 2
+		case "0039": // quic_transport_parameters
+			chp.QUICTransportParameters = ext.Data
+		}
 	}
 	parsed, chp := parseRawExtensions(exts, chp)
 	chp.Extensions = parsed
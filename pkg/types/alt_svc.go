@@ -0,0 +1,59 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultAltSvcMaxAge is the freshness lifetime of an Alt-Svc entry without a configured max_age
+const DefaultAltSvcMaxAge = 86400
+
+// AltSvc is an alternative service advertised in the Alt-Svc header
+// https://www.rfc-editor.org/rfc/rfc7838#section-3
+type AltSvc struct {
+	ALPN   string `json:"alpn"`
+	Host   string `json:"host,omitempty"`
+	Port   string `json:"port,omitempty"`
+	MaxAge int    `json:"max_age,omitempty"`
+}
+
+// GetAltSvc returns the advertised alternative services. Without any configured, HTTP/3 is
+// advertised on the TLS port if QUIC is enabled.
+func (c *Config) GetAltSvc() []AltSvc {
+	if len(c.AltSvc) > 0 {
+		return c.AltSvc
+	}
+	if !c.EnableQUIC {
+		return nil
+	}
+	return []AltSvc{{ALPN: "h3"}}
+}
+
+// AltSvcHeader builds the Alt-Svc header value, an empty string means no header is sent
+func (c *Config) AltSvcHeader() string {
+	var values []string
+	for _, a := range c.GetAltSvc() {
+		port := a.Port
+		if port == "" {
+			port = c.TLSPort
+		}
+		values = append(values, fmt.Sprintf(`%s="%s:%s"; ma=%d`, a.ALPN, a.Host, port, a.maxAge()))
+	}
+	return strings.Join(values, ", ")
+}
+
+// AltSvcMaxAge is the longest max-age of the advertised alternative services
+func (c *Config) AltSvcMaxAge() int {
+	var m int
+	for _, a := range c.GetAltSvc() {
+		m = max(m, a.maxAge())
+	}
+	return m
+}
+
+func (a AltSvc) maxAge() int {
+	if a.MaxAge > 0 {
+		return a.MaxAge
+	}
+	return DefaultAltSvcMaxAge
+}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+)
+
+// unquoteHTTP2Header undoes the quoting of HTTP/2 headers (see parseHTTP2 in pkg/server), which also
+// trims the closing quote of values ending with one
+func unquoteHTTP2Header(h string) string {
+	if strings.HasSuffix(h, `\`) && !strings.HasSuffix(h, `\\`) {
+		h += `"`
+	}
+	if u, err := strconv.Unquote(`"` + h + `"`); err == nil {
+		return u
+	}
+	return h
+}
+
+// GetHeaders returns the request headers with lowercase names, the first value of each
+func (res Response) GetHeaders() map[string]string {
+	var lines []string
+	switch {
+	case res.Http1 != nil:
+		lines = res.Http1.Headers
+	case res.Http2 != nil:
+		for _, f := range res.Http2.SendFrames {
+			if f.Type == "HEADERS" {
+				for _, h := range f.Headers {
+					lines = append(lines, unquoteHTTP2Header(h))
+				}
+				break
+			}
+		}
+	case res.Http3 != nil:
+		lines = res.Http3.Headers
+	}
+
+	headers := map[string]string{}
+	for _, l := range lines {
+		// Pseudo-headers start with a colon, so the separator is searched after it
+		i := strings.Index(l[min(1, len(l)):], ":")
+		if i < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(l[:i+1]))
+		if _, ok := headers[name]; !ok {
+			headers[name] = strings.TrimSpace(l[i+2:])
+		}
+	}
+	return headers
+}
@@ -0,0 +1,42 @@
+package types
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestGetHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		res  Response
+		want map[string]string
+	}{
+		{
+			name: "HTTP/1",
+			res:  Response{Http1: &Http1Details{Headers: []string{"Host: a", "Authorization: Bearer x", "X-A: 1", "x-a: 2", "invalid"}}},
+			want: map[string]string{"host": "a", "authorization": "Bearer x", "x-a": "1"},
+		},
+		{
+			name: "HTTP/2",
+			res: Response{Http2: &Http2Details{SendFrames: []ParsedFrame{
+				{Type: "SETTINGS"},
+				{Type: "HEADERS", Headers: []string{":method: GET", `sec-ch-ua: \"Chromium\";v=\"130\`, `x-b: a\\b`}},
+				{Type: "HEADERS", Headers: []string{"x-c: trailer"}},
+			}}},
+			want: map[string]string{":method": "GET", "sec-ch-ua": `"Chromium";v="130"`, "x-b": `a\b`},
+		},
+		{
+			name: "HTTP/3",
+			res:  Response{Http3: &Http3Details{Headers: []string{":path: /", "cookie: a=1"}}},
+			want: map[string]string{":path": "/", "cookie": "a=1"},
+		},
+		{name: "none", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.res.GetHeaders(); !maps.Equal(got, tt.want) {
+				t.Errorf("GetHeaders() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
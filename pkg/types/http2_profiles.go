@@ -0,0 +1,118 @@
+package types
+
+import "golang.org/x/net/http2"
+
+// HTTP2Setting is a single SETTINGS parameter sent by the server
+type HTTP2Setting struct {
+	ID    uint16 `json:"id"`
+	Value uint32 `json:"value"`
+}
+
+// HTTP2Profile controls what the server sends at the start of an HTTP/2 connection,
+// so the reaction of clients to different servers can be observed
+type HTTP2Profile struct {
+	Settings        []HTTP2Setting `json:"settings"`
+	WindowUpdate    uint32         `json:"window_update,omitempty"`
+	SendPing        bool           `json:"send_ping,omitempty"`
+	PingCount       int            `json:"ping_count,omitempty"`
+	SendSettingsAck bool           `json:"send_settings_ack,omitempty"`
+	HeaderTableSize uint32         `json:"header_table_size,omitempty"`
+}
+
+// DefaultHTTP2Profile is used when no (or an unknown) profile is configured
+const DefaultHTTP2Profile = "google"
+
+// BuiltinHTTP2Profiles can be used by name without defining them in the config
+var BuiltinHTTP2Profiles = map[string]HTTP2Profile{
+	"google": {
+		Settings: []HTTP2Setting{
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 1048576},
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 100},
+			{ID: uint16(http2.SettingMaxHeaderListSize), Value: 65536},
+		},
+	},
+	// google-ping is google with a PING to measure the round-trip time
+	"google-ping": {
+		Settings: []HTTP2Setting{
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 1048576},
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 100},
+			{ID: uint16(http2.SettingMaxHeaderListSize), Value: 65536},
+		},
+		SendPing: true,
+	},
+	"nginx": {
+		Settings: []HTTP2Setting{
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 128},
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 65536},
+			{ID: uint16(http2.SettingMaxFrameSize), Value: 16777215},
+		},
+		WindowUpdate:    2147418112,
+		SendSettingsAck: true,
+	},
+	"golang": {
+		Settings: []HTTP2Setting{
+			{ID: uint16(http2.SettingMaxFrameSize), Value: 1048576},
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 250},
+			{ID: uint16(http2.SettingMaxHeaderListSize), Value: 1048896},
+			{ID: uint16(http2.SettingHeaderTableSize), Value: 4096},
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 1048576},
+		},
+		WindowUpdate:    983041,
+		SendSettingsAck: true,
+	},
+}
+
+// GetHTTP2Profile returns the configured server profile, falling back to the default one
+func (c *Config) GetHTTP2Profile() (string, HTTP2Profile) {
+	name := c.HTTP2Profile
+	if name == "" {
+		name = DefaultHTTP2Profile
+	}
+	if p, ok := c.HTTP2Profiles[name]; ok {
+		return name, p
+	}
+	if p, ok := BuiltinHTTP2Profiles[name]; ok {
+		return name, p
+	}
+	return DefaultHTTP2Profile, BuiltinHTTP2Profiles[DefaultHTTP2Profile]
+}
+
+// Pings is the number of PINGs sent to measure the round-trip time, each one after the previous was acknowledged
+func (p HTTP2Profile) Pings() int {
+	if p.PingCount > 0 {
+		return p.PingCount
+	}
+	if p.SendPing {
+		return 1
+	}
+	return 0
+}
+
+// HTTP2Settings returns the SETTINGS frame parameters of the profile, including the header table size
+func (p HTTP2Profile) HTTP2Settings() []http2.Setting {
+	settings := []http2.Setting{}
+	hasTableSize := false
+	for _, s := range p.Settings {
+		if http2.SettingID(s.ID) == http2.SettingHeaderTableSize {
+			hasTableSize = true
+		}
+		settings = append(settings, http2.Setting{ID: http2.SettingID(s.ID), Val: s.Value})
+	}
+	if p.HeaderTableSize != 0 && !hasTableSize {
+		settings = append([]http2.Setting{{ID: http2.SettingHeaderTableSize, Val: p.HeaderTableSize}}, settings...)
+	}
+	return settings
+}
+
+// DecoderTableSize is the HPACK dynamic table size clients may use when encoding their headers
+func (p HTTP2Profile) DecoderTableSize() uint32 {
+	for _, s := range p.Settings {
+		if http2.SettingID(s.ID) == http2.SettingHeaderTableSize {
+			return s.Value
+		}
+	}
+	if p.HeaderTableSize != 0 {
+		return p.HeaderTableSize
+	}
+	return 4096
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 type TLSDetails struct {
@@ -26,16 +27,213 @@ type TLSDetails struct {
 	SessionID    string `json:"session_id"`
 	RawBytes     string `json:"-"`
 	RawB64       string `json:"-"`
+
+	Tracking *TLSTracking `json:"tracking,omitempty"`
+	// HelloRetry is set when the server answered with a HelloRetryRequest, the fields above describe the first ClientHello
+	HelloRetry *TLSHelloRetry `json:"hello_retry,omitempty"`
+	// ClientCertificates is the chain the client presented on the mTLS port
+	ClientCertificates []CertificateDetails `json:"client_certificates,omitempty"`
+	SNI                *SNIDetails          `json:"sni,omitempty"`
+}
+
+// SNIDetails tells which certificate was served for the server name the client sent
+type SNIDetails struct {
+	ServerName string `json:"server_name"`
+	// VirtualHost is the first server name of the selected virtual host, empty for the default certificate
+	VirtualHost string `json:"virtual_host,omitempty"`
+	// CertificateMatched is set when the served certificate is valid for the server name
+	CertificateMatched bool `json:"certificate_matched"`
+}
+
+// CertificateDetails describes a certificate, NotBefore and NotAfter are unix timestamps
+type CertificateDetails struct {
+	Subject            string   `json:"subject"`
+	Issuer             string   `json:"issuer"`
+	SerialNumber       string   `json:"serial_number"`
+	KeyType            string   `json:"key_type"`
+	KeySize            int      `json:"key_size"`
+	Curve              string   `json:"curve,omitempty"`
+	SignatureAlgorithm string   `json:"signature_algorithm"`
+	NotBefore          int64    `json:"not_before"`
+	NotAfter           int64    `json:"not_after"`
+	IsCA               bool     `json:"is_ca"`
+	DNSNames           []string `json:"dns_names,omitempty"`
+	SHA256             string   `json:"sha256"`
+	JA4X               string   `json:"ja4x"`
+}
+
+// TLSHelloRetry describes the second ClientHello, sent after a HelloRetryRequest, and how it differs from the first
+type TLSHelloRetry struct {
+	// Group is the key share group the HelloRetryRequest asked for
+	Group       string      `json:"group"`
+	ClientHello *TLSDetails `json:"client_hello"`
+
+	AddedExtensions       []string `json:"added_extensions"`
+	RemovedExtensions     []string `json:"removed_extensions"`
+	ExtensionOrderChanged bool     `json:"extension_order_changed"`
+	CiphersChanged        bool     `json:"ciphers_changed"`
+	GreaseReused          bool     `json:"grease_reused"`
+	ClientRandomReused    bool     `json:"client_random_reused"`
+	SessionIDReused       bool     `json:"session_id_reused"`
+	// PaddingLengths are the lengths of the padding extension in the first and the second ClientHello
+	PaddingLengths [2]int   `json:"padding_lengths"`
+	KeyShares      []string `json:"key_shares"`
+}
+
+// TLSTracking links a connection to the earlier connections of the same client, through the session
+// tickets and TLS 1.2 session IDs it presented
+type TLSTracking struct {
+	// ID stays the same for every connection in the chain
+	ID string `json:"id"`
+	// LinkedBy is "session_ticket", "psk" or "session_id", empty for the first connection of a chain
+	LinkedBy     string               `json:"linked_by,omitempty"`
+	Resumed      bool                 `json:"resumed"`
+	FirstSeen    int64                `json:"first_seen"`
+	Connections  int                  `json:"connection_count"`
+	Fingerprints []TrackedFingerprint `json:"fingerprints"`
+}
+
+// TrackedFingerprint is a TLS fingerprint seen in a tracking chain, with the number of connections that sent it
+type TrackedFingerprint struct {
+	JA3Hash       string `json:"ja3_hash"`
+	JA4           string `json:"ja4"`
+	PeetPrintHash string `json:"peetprint_hash"`
+	Connections   int    `json:"connections"`
 }
 
 type Http1Details struct {
 	Headers []string `json:"headers"`
+
+	// The request head as it was sent, and its header fields with their exact formatting
+	RawHead         string             `json:"raw_head"`
+	RawHeadB64      string             `json:"raw_head_b64"`
+	HeaderFields    []Http1HeaderField `json:"header_fields"`
+	Anomalies       []string           `json:"anomalies"`
+	HeaderOrder     string             `json:"header_order"`
+	HeaderOrderHash string             `json:"header_order_hash"`
+
+	// RequestIndex is the position of the request on its (keep-alive) connection
+	RequestIndex int  `json:"request_index"`
+	KeepAlive    bool `json:"keep_alive"`
+	// Pipelined is set when the request was already received before the previous response was sent
+	Pipelined  bool         `json:"pipelined,omitempty"`
+	Chunked    bool         `json:"chunked,omitempty"`
+	ChunkSizes []int        `json:"chunk_sizes,omitempty"`
+	Body       *RequestBody `json:"body,omitempty"`
+}
+
+// Http1HeaderField is a header line split into its parts, keeping the whitespace around the colon
+type Http1HeaderField struct {
+	Name        string `json:"name"`
+	Value       string `json:"value"`
+	BeforeColon string `json:"before_colon,omitempty"`
+	AfterColon  string `json:"after_colon"`
+	Trailing    string `json:"trailing,omitempty"`
+	LineEnding  string `json:"line_ending"`
+	Folded      bool   `json:"folded,omitempty"`
 }
 
 type Http2Details struct {
 	AkamaiFingerprint     string        `json:"akamai_fingerprint"`
 	AkamaiFingerprintHash string        `json:"akamai_fingerprint_hash"`
 	SendFrames            []ParsedFrame `json:"sent_frames"`
+
+	// Set for cleartext HTTP/2 (h2c), either with prior knowledge or via "Upgrade: h2c"
+	Cleartext       bool     `json:"cleartext,omitempty"`
+	Upgraded        bool     `json:"upgraded,omitempty"`
+	UpgradeSettings []string `json:"upgrade_settings,omitempty"`
+
+	ServerProfile  string               `json:"server_profile,omitempty"`
+	ClientReaction *Http2ClientReaction `json:"client_reaction,omitempty"`
+	Ping           *Http2PingDetails    `json:"ping,omitempty"`
+
+	Body *RequestBody `json:"body,omitempty"`
+}
+
+// RequestBody is the reassembled request body, decoded according to its content type
+type RequestBody struct {
+	Size        int             `json:"size"`
+	ContentType string          `json:"content_type,omitempty"`
+	Truncated   bool            `json:"truncated,omitempty"`
+	Encoding    string          `json:"encoding,omitempty"`
+	Decoded     interface{}     `json:"decoded,omitempty"`
+	Text        string          `json:"text,omitempty"`
+	Base64      string          `json:"base64,omitempty"`
+	DataFrames  []DataFrameInfo `json:"data_frames,omitempty"`
+	Padding     int             `json:"padding,omitempty"`
+	Raw         []byte          `json:"-"`
+}
+
+type MultipartPart struct {
+	Name        string `json:"name"`
+	FileName    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+	Value       string `json:"value,omitempty"`
+}
+
+// DataFrameInfo describes how the body was split into DATA frames
+type DataFrameInfo struct {
+	Length    uint32 `json:"length"`
+	Data      int    `json:"data"`
+	Padding   int    `json:"padding"`
+	EndStream bool   `json:"end_stream,omitempty"`
+}
+
+// Http2ResponseFlow records the client's flow control while it received our response
+type Http2ResponseFlow struct {
+	Timestamp     int64               `json:"timestamp"`
+	LogID         string              `json:"log_id,omitempty"`
+	IP            string              `json:"ip"`
+	Stream        uint32              `json:"stream_id"`
+	ResponseSize  int                 `json:"response_size"`
+	DataFrames    int                 `json:"data_frames"`
+	BlockedMs     int64               `json:"blocked_ms"`
+	WindowUpdates []Http2WindowUpdate `json:"window_updates"`
+}
+
+// Http2ClientReaction describes how the client reacted to what the server sent first.
+// Frame indexes refer to sent_frames.
+type Http2ClientReaction struct {
+	SettingsAck         bool                `json:"settings_ack"`
+	SettingsAckIndex    int                 `json:"settings_ack_index"`
+	AckBeforeHeaders    bool                `json:"ack_before_headers"`
+	PingAck             bool                `json:"ping_ack,omitempty"`
+	FramesBeforeAck     []string            `json:"frames_before_ack,omitempty"`
+	WindowUpdates       []Http2WindowUpdate `json:"window_updates,omitempty"`
+	ConnectionWindow    int64               `json:"connection_window"`
+	InitialStreamWindow int64               `json:"initial_stream_window"`
+}
+
+type Http2WindowUpdate struct {
+	Index     int    `json:"index"`
+	Stream    uint32 `json:"stream_id"`
+	Increment uint32 `json:"increment"`
+	AfterAck  bool   `json:"after_ack"`
+}
+
+// Http2PingDetails holds the round-trip times of our PINGs and the PINGs the client sent on its own
+type Http2PingDetails struct {
+	Sent              []Http2Ping       `json:"sent"`
+	MinRTTMs          float64           `json:"min_rtt_ms,omitempty"`
+	ClientPings       []Http2ClientPing `json:"client_pings"`
+	ClientPingPattern string            `json:"client_ping_pattern,omitempty"`
+}
+
+// Http2Ping is a PING sent by the server
+type Http2Ping struct {
+	Data     string    `json:"data"`
+	Acked    bool      `json:"acked"`
+	AckIndex int       `json:"ack_index,omitempty"`
+	RTTMs    float64   `json:"rtt_ms,omitempty"`
+	SentAt   time.Time `json:"-"`
+}
+
+// Http2ClientPing is a PING sent by the client, Index refers to sent_frames
+type Http2ClientPing struct {
+	Index        int    `json:"index"`
+	Data         string `json:"data"`
+	AfterHeaders bool   `json:"after_headers"`
 }
 
 type Http3Details struct {
@@ -48,6 +246,105 @@ type Http3Details struct {
 	AkamaiFingerprint                  string             `json:"akamai_fingerprint"`
 	AkamaiFingerprintHash              string             `json:"akamai_fingerprint_hash"`
 	Headers                            []string           `json:"headers,omitempty"`
+	QPACK                              *QPACKDetails      `json:"qpack,omitempty"`
+	QUIC                               *QUICDetails       `json:"quic,omitempty"`
+	Streams                            []Http3Stream      `json:"streams"`
+	Frames                             []Http3Frame       `json:"frames"`
+	Body                               *RequestBody       `json:"body,omitempty"`
+	Upgrade                            *Http3Upgrade      `json:"upgrade,omitempty"`
+}
+
+// Http3Upgrade describes how the client got to HTTP/3 after Alt-Svc was advertised to it over TCP
+type Http3Upgrade struct {
+	AdvertisedVia  string  `json:"advertised_via"`
+	Advertisements int     `json:"advertisements"`
+	DelayMs        float64 `json:"delay_ms"`
+	Requests       int     `json:"requests"`
+}
+
+// QUICDetails describes the Initial packets of the client, which carry the ClientHello
+type QUICDetails struct {
+	Version             string              `json:"version"`
+	DCIDLength          int                 `json:"dcid_length"`
+	SCIDLength          int                 `json:"scid_length"`
+	TokenLength         int                 `json:"token_length"`
+	TransportParameters []string            `json:"transport_parameters"`
+	InitialPackets      []QUICInitialPacket `json:"initial_packets"`
+	CryptoPackets       int                 `json:"crypto_packets"`
+	CryptoFrames        int                 `json:"crypto_frames"`
+	CryptoLength        int64               `json:"crypto_length"`
+	CryptoReordered     bool                `json:"crypto_reordered"`
+	Fingerprint         string              `json:"fingerprint"`
+	FingerprintHash     string              `json:"fingerprint_hash"`
+}
+
+// QUICInitialPacket is a single Initial packet. Size includes the padding, Frames doesn't contain PADDING frames.
+// Retransmitted is set when its CRYPTO frames only repeat data of earlier packets.
+type QUICInitialPacket struct {
+	PacketNumber  int64             `json:"packet_number"`
+	Size          int               `json:"size"`
+	Frames        []string          `json:"frames"`
+	Crypto        []QUICCryptoFrame `json:"crypto"`
+	Retransmitted bool              `json:"retransmitted,omitempty"`
+}
+
+type QUICCryptoFrame struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Http3Stream is a unidirectional stream opened by the client, in the order they were opened
+type Http3Stream struct {
+	StreamID uint64 `json:"stream_id"`
+	Type     string `json:"type"`
+	TypeID   uint64 `json:"type_id"`
+}
+
+// Http3Frame is a frame sent by the client. The frames of the control stream come first
+// (in the order they were received), followed by the frames of the request stream.
+type Http3Frame struct {
+	StreamID uint64             `json:"stream_id"`
+	Type     string             `json:"frame_type"`
+	TypeID   uint64             `json:"frame_type_id"`
+	Length   uint64             `json:"length"`
+	Settings []Http3SettingPair `json:"settings,omitempty"`
+	// ID is the stream or push ID of GOAWAY, MAX_PUSH_ID and CANCEL_PUSH frames
+	ID             *uint64              `json:"id,omitempty"`
+	PriorityUpdate *Http3PriorityUpdate `json:"priority_update,omitempty"`
+	Payload        []byte               `json:"payload,omitempty"`
+}
+
+// Http3PriorityUpdate is the content of a PRIORITY_UPDATE frame (RFC 9218)
+type Http3PriorityUpdate struct {
+	ElementID uint64 `json:"element_id"`
+	Priority  string `json:"priority"`
+}
+
+// QPACKDetails describes how the client encoded the field section of its request
+type QPACKDetails struct {
+	RequiredInsertCount uint64       `json:"required_insert_count"`
+	DeltaBaseSign       bool         `json:"delta_base_sign,omitempty"`
+	DeltaBase           uint64       `json:"delta_base"`
+	Fields              []QPACKField `json:"fields"`
+	Fingerprint         string       `json:"fingerprint"`
+	FingerprintHash     string       `json:"fingerprint_hash"`
+	// Blocked is set if the request had to wait for dynamic table entries on the encoder stream.
+	// DynamicTableCapacity and InsertCount are the state of the client's dynamic table when it was decoded.
+	Blocked              bool   `json:"blocked,omitempty"`
+	DynamicTableCapacity uint64 `json:"dynamic_table_capacity"`
+	InsertCount          uint64 `json:"insert_count"`
+}
+
+// QPACKField is the representation of a single field line. Index refers to the static
+// table if Static is set, otherwise to the dynamic table.
+type QPACKField struct {
+	Name           string `json:"name"`
+	Representation string `json:"representation"`
+	Index          uint64 `json:"index"`
+	Static         bool   `json:"static,omitempty"`
+	NameHuffman    bool   `json:"name_huffman,omitempty"`
+	ValueHuffman   bool   `json:"value_huffman,omitempty"`
+	NeverIndexed   bool   `json:"never_indexed,omitempty"`
 }
 
 // Http3SettingPair represents a single HTTP/3 setting for fingerprinting
@@ -108,6 +405,8 @@ type TCPIPDetails struct {
 
 type Response struct {
 	Donate      string        `json:"donate,omitempty"`
+	RequestID   string        `json:"request_id,omitempty"`
+	LogID       string        `json:"log_id,omitempty"`
 	Timestamp   int64         `json:"timestamp"`
 	IP          string        `json:"ip"`
 	HTTPVersion string        `json:"http_version"`
@@ -119,6 +418,107 @@ type Response struct {
 	Http2       *Http2Details `json:"http2,omitempty"`
 	Http3       *Http3Details `json:"http3,omitempty"`
 	TCPIP       TCPIPDetails  `json:"tcpip,omitempty"`
+	// ProxyProtocol is set for connections from a trusted load balancer, IP is the client it reported
+	ProxyProtocol *ProxyProtocolDetails `json:"proxy_protocol,omitempty"`
+
+	IdentifiedAs *IdentifiedClient   `json:"identified_as,omitempty"`
+	Consistency  *ConsistencyDetails `json:"consistency,omitempty"`
+
+	// Set when the result was saved with ?save=1, it can be retrieved at /api/r/<id>
+	SnapshotID    string `json:"snapshot_id,omitempty"`
+	SnapshotLabel string `json:"snapshot_label,omitempty"`
+}
+
+// ProxyProtocolDetails is the PROXY protocol header a load balancer sent before the connection
+type ProxyProtocolDetails struct {
+	Version int `json:"version"`
+	// Command is PROXY, or LOCAL for the balancer's own connections (health checks)
+	Command string `json:"command"`
+	// Protocol is TCP4, TCP6, UDP4, UDP6, UNIX or UNKNOWN
+	Protocol           string `json:"protocol"`
+	SourceAddress      string `json:"source_address,omitempty"`
+	DestinationAddress string `json:"destination_address,omitempty"`
+	// ProxyAddress is the address the connection actually came from
+	ProxyAddress string     `json:"proxy_address"`
+	TLVs         []ProxyTLV `json:"tlvs,omitempty"`
+}
+
+// ProxyTLV is a type-length-value field of a PROXY protocol v2 header. Value is text if it is
+// printable and hex otherwise.
+type ProxyTLV struct {
+	Type    int        `json:"type"`
+	Name    string     `json:"name,omitempty"`
+	Value   string     `json:"value"`
+	SubTLVs []ProxyTLV `json:"sub_tlvs,omitempty"`
+}
+
+// AccessLists are the blocklist and allowlist, as returned by /api/admin/access
+type AccessLists struct {
+	Blocklist AccessListDetails `json:"blocklist"`
+	Allowlist AccessListDetails `json:"allowlist"`
+}
+
+type AccessListDetails struct {
+	File    string   `json:"file"`
+	Entries []string `json:"entries"`
+}
+
+// FingerprintDiff compares the fingerprint of a request with a reference, field by field
+type FingerprintDiff struct {
+	Against     string      `json:"against"`
+	Identical   bool        `json:"identical"`
+	Differences int         `json:"differences"`
+	Fields      []FieldDiff `json:"fields"`
+	// Skipped are the fields only one of the two has
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// FieldDiff compares the values of one field in the order they were sent
+type FieldDiff struct {
+	Field        string   `json:"field"`
+	Equal        bool     `json:"equal"`
+	Current      []string `json:"current"`
+	Reference    []string `json:"reference"`
+	Missing      []string `json:"missing,omitempty"`
+	Extra        []string `json:"extra,omitempty"`
+	OrderChanged bool     `json:"order_changed,omitempty"`
+}
+
+// ConsistencyDetails compares the client claimed by the User-Agent and Client Hints with the fingerprints
+type ConsistencyDetails struct {
+	Claimed    ClaimedClient      `json:"claimed"`
+	Consistent bool               `json:"consistent"`
+	Mismatches []string           `json:"mismatches"`
+	Checks     []ConsistencyCheck `json:"checks"`
+}
+
+// ClaimedClient is the client parsed from the User-Agent
+type ClaimedClient struct {
+	Browser string `json:"browser,omitempty"`
+	Family  string `json:"family,omitempty"`
+	Version int    `json:"version,omitempty"`
+	OS      string `json:"os,omitempty"`
+	Mobile  bool   `json:"mobile"`
+}
+
+// ConsistencyCheck is a single comparison, Message explains a failed one
+type ConsistencyCheck struct {
+	Layer   string `json:"layer"`
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// IdentifiedClient is the known client whose fingerprints match the request best
+type IdentifiedClient struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version,omitempty"`
+	OS         string   `json:"os,omitempty"`
+	Confidence float64  `json:"confidence"`
+	Matched    []string `json:"matched"`
+	Mismatched []string `json:"mismatched,omitempty"`
+	// Unknown are the fingerprints of the request that the known client doesn't list
+	Unknown []string `json:"unknown,omitempty"`
 }
 
 func (res Response) ToJson() string {
@@ -168,25 +568,178 @@ type ParsedFrame struct {
 	Stream    uint32    `json:"stream_id,omitempty"`
 	Length    uint32    `json:"length,omitempty"`
 	Payload   []byte    `json:"payload,omitempty"`
+	Padding   int       `json:"padding,omitempty"`
 	Headers   []string  `json:"headers,omitempty"`
 	Settings  []string  `json:"settings,omitempty"`
 	Increment uint32    `json:"increment,omitempty"`
 	Flags     []string  `json:"flags,omitempty"`
 	Priority  *Priority `json:"priority,omitempty"`
 	GoAway    *GoAway   `json:"goaway,omitempty"`
+
+	ReceivedAt time.Time `json:"-"`
 }
 
 type Config struct {
-	TLSPort      string `json:"tls_port"`
-	HTTPPort     string `json:"http_port"`
-	CertFile     string `json:"cert_file"`
-	KeyFile      string `json:"key_file"`
+	TLSPort string `json:"tls_port"`
+	// MTLSPort is an optional second TLS port that requests a client certificate
+	MTLSPort string `json:"mtls_port,omitempty"`
+	HTTPPort string `json:"http_port"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile and CAKeyFile are the local CA that signs cert_file if it doesn't exist, see GetCAFiles
+	CAFile       string `json:"ca_file,omitempty"`
+	CAKeyFile    string `json:"ca_key_file,omitempty"`
 	Host         string `json:"host"`
 	HTTPRedirect string `json:"http_redirect"`
 	Device       string `json:"device"`
 	CorsKey      string `json:"cors_key"`
-	LogFile      string `json:"log_file"`
+	// LogFile gets every request as one JSON line, LogRotation rotates it
+	LogFile string `json:"log_file"`
+	// DatabaseFile stores every request, DatabaseRetention limits how many and for how long
+	DatabaseFile      string             `json:"database_file"`
+	DatabaseRetention *DatabaseRetention `json:"database_retention,omitempty"`
+	// KnownClients is the file with the fingerprints of known clients, responses include the best match
+	KnownClients string `json:"known_clients_file"`
 	EnableQUIC   bool   `json:"enable_quic"`
+	EnableH2C    bool   `json:"enable_h2c"`
+	ServePlainH1 bool   `json:"serve_plain_http1"`
+
+	HTTP2Profile  string                  `json:"http2_profile"`
+	HTTP2Profiles map[string]HTTP2Profile `json:"http2_profiles,omitempty"`
+
+	AltSvc []AltSvc `json:"alt_svc,omitempty"`
+
+	// VirtualHosts are served their own certificate, chosen by SNI, the default one is cert_file
+	VirtualHosts []VirtualHost `json:"virtual_hosts,omitempty"`
+
+	// ForceHelloRetry answers every TLS 1.3 ClientHello with a HelloRetryRequest, HelloRetryServerNames
+	// only those for the given server names
+	ForceHelloRetry       bool     `json:"force_hello_retry"`
+	HelloRetryServerNames []string `json:"hello_retry_server_names,omitempty"`
+
+	// ProxyProtocol reads a PROXY protocol v1 or v2 header on the TLS and HTTP ports from connections of
+	// TrustedProxies (IP addresses or CIDR ranges). Other connections are handled as they are.
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// BlocklistFile and AllowlistFile hold IP addresses and CIDR ranges, see GetAccessListFiles. Clients on
+	// the blocklist get BlockedResponse: "raw" writes BlockedMessage before the TLS handshake (the default),
+	// "http" answers with a 403 and "close" closes the connection.
+	BlocklistFile   string `json:"blocklist_file,omitempty"`
+	AllowlistFile   string `json:"allowlist_file,omitempty"`
+	BlockedResponse string `json:"blocked_response,omitempty"`
+	BlockedMessage  string `json:"blocked_message,omitempty"`
+	// AdminKey enables /api/admin/access for requests with "Authorization: Bearer <admin_key>"
+	AdminKey string `json:"admin_key,omitempty"`
+
+	// RateLimits are token buckets per client, requests over a limit get 429 Too Many Requests
+	RateLimits []RateLimit `json:"rate_limits,omitempty"`
+
+	// MetricsAddress serves Prometheus metrics at /metrics on its own listener, like "127.0.0.1:9090"
+	MetricsAddress string `json:"metrics_address,omitempty"`
+
+	// LogLevel is debug, info (the default), warn or error, LogFormat is text (the default) or json
+	LogLevel    string       `json:"log_level,omitempty"`
+	LogFormat   string       `json:"log_format,omitempty"`
+	LogRotation *LogRotation `json:"log_rotation,omitempty"`
+}
+
+// LogRotation starts a new log file once it is MaxSizeMB big or MaxAgeHours old. Rotated files get the
+// time in their name and are gzipped with Compress, only the newest MaxBackups are kept (all with 0).
+type LogRotation struct {
+	MaxSizeMB   int  `json:"max_size_mb,omitempty"`
+	MaxAgeHours int  `json:"max_age_hours,omitempty"`
+	MaxBackups  int  `json:"max_backups,omitempty"`
+	Compress    bool `json:"compress,omitempty"`
+}
+
+// DatabaseRetention removes stored requests and snapshots once they are MaxAgeHours old (720 with 0) or
+// there are more than MaxRequests requests (no limit with 0) or MaxSnapshots snapshots (10000 with 0).
+// Bodies are stored up to MaxBody bytes (4096 with 0).
+type DatabaseRetention struct {
+	MaxAgeHours  int `json:"max_age_hours,omitempty"`
+	MaxRequests  int `json:"max_requests,omitempty"`
+	MaxSnapshots int `json:"max_snapshots,omitempty"`
+	MaxBody      int `json:"max_body,omitempty"`
+}
+
+// RateLimit allows Burst requests at once and Rate requests per second after that, for each value of
+// Key: "ip", "subnet" (IPv4Prefix and IPv6Prefix long), "ja3" or "ja4". Paths limits it to some paths,
+// those ending with "/" match every path below them.
+type RateLimit struct {
+	Key        string   `json:"key"`
+	Rate       float64  `json:"rate"`
+	Burst      int      `json:"burst"`
+	IPv4Prefix int      `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int      `json:"ipv6_prefix,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+}
+
+// VirtualHost is a set of server names with their own certificate. "*.example.com" matches every
+// subdomain of example.com. Routes limits the paths that are served, all are served if it is empty.
+type VirtualHost struct {
+	ServerNames []string `json:"server_names"`
+	CertFile    string   `json:"cert_file"`
+	KeyFile     string   `json:"key_file"`
+	Routes      []string `json:"routes,omitempty"`
+}
+
+// GetCAFiles returns the files of the local CA, they default to certs/ca.pem and certs/ca-key.pem
+func (c *Config) GetCAFiles() (string, string) {
+	caFile, caKeyFile := c.CAFile, c.CAKeyFile
+	if caFile == "" {
+		caFile = "certs/ca.pem"
+	}
+	if caKeyFile == "" {
+		caKeyFile = "certs/ca-key.pem"
+	}
+	return caFile, caKeyFile
+}
+
+// GetKnownClientsFile returns the file with the known client fingerprints, it defaults to static/known_clients.json
+func (c *Config) GetKnownClientsFile() string {
+	if c.KnownClients == "" {
+		return "static/known_clients.json"
+	}
+	return c.KnownClients
+}
+
+// GetAccessListFiles returns the blocklist and allowlist files, they default to blockedIPs and allowedIPs
+func (c *Config) GetAccessListFiles() (string, string) {
+	blocklist, allowlist := c.BlocklistFile, c.AllowlistFile
+	if blocklist == "" {
+		blocklist = "blockedIPs"
+	}
+	if allowlist == "" {
+		allowlist = "allowedIPs"
+	}
+	return blocklist, allowlist
+}
+
+// GetRateLimits returns the valid rate limits, subnets default to /24 for IPv4 and /64 for IPv6
+func (c *Config) GetRateLimits() []RateLimit {
+	var limits []RateLimit
+	for _, l := range c.RateLimits {
+		if l.Rate <= 0 || l.Burst < 1 {
+			continue
+		}
+		if l.IPv4Prefix == 0 {
+			l.IPv4Prefix = 24
+		}
+		if l.IPv6Prefix == 0 {
+			l.IPv6Prefix = 64
+		}
+		limits = append(limits, l)
+	}
+	return limits
+}
+
+// GetBlockedMessage returns the message for blocked clients
+func (c *Config) GetBlockedMessage() string {
+	if c.BlockedMessage == "" {
+		return "Don't waste proxies"
+	}
+	return c.BlockedMessage
 }
 
 func (c *Config) LoadFromFile() error {
@@ -204,14 +757,40 @@ func (c *Config) LoadFromFile() error {
 
 	c.Host = tmp.Host
 	c.TLSPort = tmp.TLSPort
+	c.MTLSPort = tmp.MTLSPort
 	c.HTTPPort = tmp.HTTPPort
 	c.CertFile = tmp.CertFile
 	c.KeyFile = tmp.KeyFile
+	c.CAFile = tmp.CAFile
+	c.CAKeyFile = tmp.CAKeyFile
 	c.HTTPRedirect = tmp.HTTPRedirect
 	c.Device = tmp.Device
 	c.CorsKey = tmp.CorsKey
 	c.LogFile = tmp.LogFile
+	c.DatabaseFile = tmp.DatabaseFile
+	c.DatabaseRetention = tmp.DatabaseRetention
+	c.KnownClients = tmp.KnownClients
 	c.EnableQUIC = tmp.EnableQUIC
+	c.EnableH2C = tmp.EnableH2C
+	c.ServePlainH1 = tmp.ServePlainH1
+	c.HTTP2Profile = tmp.HTTP2Profile
+	c.HTTP2Profiles = tmp.HTTP2Profiles
+	c.AltSvc = tmp.AltSvc
+	c.VirtualHosts = tmp.VirtualHosts
+	c.ForceHelloRetry = tmp.ForceHelloRetry
+	c.HelloRetryServerNames = tmp.HelloRetryServerNames
+	c.ProxyProtocol = tmp.ProxyProtocol
+	c.TrustedProxies = tmp.TrustedProxies
+	c.BlocklistFile = tmp.BlocklistFile
+	c.AllowlistFile = tmp.AllowlistFile
+	c.BlockedResponse = tmp.BlockedResponse
+	c.BlockedMessage = tmp.BlockedMessage
+	c.AdminKey = tmp.AdminKey
+	c.RateLimits = tmp.RateLimits
+	c.MetricsAddress = tmp.MetricsAddress
+	c.LogLevel = tmp.LogLevel
+	c.LogFormat = tmp.LogFormat
+	c.LogRotation = tmp.LogRotation
 	return nil
 }
 
@@ -232,8 +811,15 @@ func (c *Config) MakeDefault() {
 	c.HTTPPort = "80"
 	c.CertFile = "certs/chain.pem"
 	c.KeyFile = "certs/key.pem"
+	c.CAFile, c.CAKeyFile = c.GetCAFiles()
+	c.BlocklistFile, c.AllowlistFile = c.GetAccessListFiles()
 	c.HTTPRedirect = "https://tls.peet.ws"
 	c.CorsKey = "X-CORS"
 	c.LogFile = ""
+	c.DatabaseFile = ""
+	c.KnownClients = "static/known_clients.json"
 	c.EnableQUIC = true
+	c.EnableH2C = false
+	c.ServePlainH1 = false
+	c.HTTP2Profile = DefaultHTTP2Profile
 }
@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"sort"
@@ -106,16 +108,37 @@ func GetAdmin() (string, bool) {
 	return "", false
 }
 
-func IsIPBlocked(ip string) bool {
-	rawIPs, err := ReadFile("blockedIPs")
+// ParsePrefixes parses a list of IP addresses and CIDR ranges
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// PrefixesContain reports whether the IP of addr (a *net.TCPAddr, *net.UDPAddr or "ip:port") is in one of prefixes
+func PrefixesContain(prefixes []netip.Prefix, addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
 	if err != nil {
-		WriteToFile("blockedIPs", []byte(""))
 		return false
 	}
-	ips := strings.Split(string(rawIPs), "\n")
-
-	for _, i := range ips {
-		if ip == i {
+	ip := ap.Addr().Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
 			return true
 		}
 	}